@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"wex/src/application"
+	"wex/src/external"
+	"wex/src/persistance"
+)
+
+// prefetchCurrencies lists the currencies warmed by the prefetch job: the
+// configured comma separated list, or the default currencies of the tenants
+// and every currency seen in their past conversions when none is configured.
+func prefetchCurrencies(tenants persistance.Tenants,
+	catalog external.CurrencyCatalogInterface, configured string) func(context.Context) ([]string, error) {
+	return func(ctx context.Context) ([]string, error) {
+		seen := make(map[string]bool)
+		if strings.TrimSpace(configured) != "" {
+			for _, query := range strings.Split(configured, ",") {
+				currency, err := resolveCurrency(ctx, catalog, "", query)
+				if err != nil {
+					return nil, fmt.Errorf("prefetch currency %v: %w", strings.TrimSpace(query), err)
+				}
+				seen[currency.CountryCurrency] = true
+			}
+		} else {
+			for _, tenant := range tenants.Names() {
+				if settings, err := tenants.Settings(tenant); err == nil && settings.Currency != "" {
+					seen[settings.Currency] = true
+				}
+				driver, err := tenants.Tenant(tenant)
+				if err != nil {
+					return nil, err
+				}
+				transactions, err := driver.ListTransactions(ctx, application.TransactionFilter{})
+				if err != nil {
+					return nil, err
+				}
+				for _, transaction := range transactions {
+					conversions, err := driver.QueryConversions(ctx, transaction.Uid)
+					if err != nil {
+						continue
+					}
+					for _, conversion := range conversions {
+						seen[conversion.Currency] = true
+					}
+				}
+			}
+		}
+
+		currencies := make([]string, 0, len(seen))
+		for currency := range seen {
+			currencies = append(currencies, currency)
+		}
+		sort.Strings(currencies)
+		return currencies, nil
+	}
+}
+
+func getAdminPrefetch(prefetcher *external.Prefetcher) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST":
+			prefetcher.Run()
+		default:
+			badRequest(w, r, "Unsupported method")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(prefetcher.Status())
+	}
+}
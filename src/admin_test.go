@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"wex/src/application"
+	"wex/src/external"
+)
+
+func TestPrefetchCurrencies(t *testing.T) {
+	conversions := []application.Conversion{
+		{TransactionUid: "1", Currency: "Mexico-Peso"},
+		{TransactionUid: "1", Currency: "Euro Zone-Euro"},
+		{TransactionUid: "1", Currency: "Mexico-Peso"},
+	}
+	driver := historyMockDriver{conversions: &conversions}
+
+	tests := []struct {
+		name       string
+		configured string
+		expected   []string
+		fail       bool
+	}{
+		{"past conversions", "", []string{"Euro Zone-Euro", "Mexico-Peso"}, false},
+		{"configured", "MXN, canada dollar", []string{"Canada-Dollar", "Mexico-Peso"}, false},
+		{"unknown currency", "MXN,atlantis", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			currencies, err := prefetchCurrencies(oneTenant(driver), MockCatalog{}, test.configured)(context.Background())
+			if (err != nil) != test.fail {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !test.fail && !reflect.DeepEqual(currencies, test.expected) {
+				t.Errorf("got currencies %v but expected %v", currencies, test.expected)
+			}
+		})
+	}
+}
+
+func TestAdminPrefetch(t *testing.T) {
+	prefetcher := &external.Prefetcher{
+		Cache:      external.NewRateCache(MockExternalApi{}),
+		Currencies: func(context.Context) ([]string, error) { return []string{"Mexico-Peso"}, nil },
+	}
+
+	request := func(method string) external.PrefetchStatus {
+		req := httptest.NewRequest(method, "/admin/prefetch", nil)
+		res := httptest.NewRecorder()
+		getAdminPrefetch(prefetcher)(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("got status %d but expected %d", res.Code, http.StatusOK)
+		}
+		var status external.PrefetchStatus
+		if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+			t.Fatalf("Could not parse json response: %v", err)
+		}
+		return status
+	}
+
+	if status := request(http.MethodGet); status.Runs != 0 {
+		t.Errorf("expected no run yet, got %+v", status)
+	}
+	status := request(http.MethodPost)
+	if status.Runs != 1 || status.LastSuccess == nil || status.RatesFetched != 1 ||
+		!reflect.DeepEqual(status.Currencies, []string{"Mexico-Peso"}) {
+		t.Errorf("unexpected prefetch status %+v", status)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/admin/prefetch", nil)
+	res := httptest.NewRecorder()
+	getAdminPrefetch(prefetcher)(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("got status %d but expected %d", res.Code, http.StatusBadRequest)
+	}
+}
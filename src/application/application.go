@@ -73,12 +73,22 @@ const (
 )
 
 type Money struct {
-	whole    int64
-	decimal  int64
+	whole   int64
+	decimal int64
+	// places is the number of digits written after the separator. When
+	// zero, decimal is read as left aligned digits (12.99 -> 9900).
+	places   int
 	currency string // USD for example
 }
 
 func (m Money) toInt() int64 {
+	if m.places > 0 {
+		scale := base
+		for i := 0; i < m.places; i++ {
+			scale /= 10
+		}
+		return m.decimal*scale + base*m.whole
+	}
 	max := []rune("0000")
 	value := fmt.Sprintf("%v", m.decimal)
 	for i, s := range []rune(value) {
@@ -111,11 +121,37 @@ func (m Money) PreciseConvert(rate Money) Money {
 	if (decimal100 % 100) > 0 {
 		decimal += 1
 	}
+	if decimal == 100 {
+		whole += 1
+		decimal = 0
+	}
 
-	return Money{whole: whole, decimal: decimal}
+	return Money{whole: whole, decimal: decimal, places: 2}
+}
+
+var ErrZeroRate = errors.New("Exchange rate should be greater than zero")
+
+// PreciseDivide converts a foreign amount back with the rate it was
+// converted with, rounding to the nearest cent.
+func (m Money) PreciseDivide(rate Money) (Money, error) {
+	t2 := rate.toInt()
+	if t2 == 0 {
+		return Money{}, ErrZeroRate
+	}
+	// both values have 4 digit precision, so the quotient is scaled to cents
+	cents := (m.toInt()*dolars*2 + t2) / (2 * t2)
+	return Money{whole: cents / dolars, decimal: cents % dolars, places: 2}, nil
+}
+
+// moneyFromInt builds a Money from its 4 digit precision integer value.
+func moneyFromInt(value int64) Money {
+	return Money{whole: value / base, decimal: value % base, places: 4}
 }
 
 func (m Money) ToString() string {
+	if m.places > 0 {
+		return fmt.Sprintf("%v%v%0*d", m.whole, pointDecimalSeparator, m.places, m.decimal)
+	}
 	return fmt.Sprintf("%v%v%v", m.whole, pointDecimalSeparator, m.decimal)
 }
 
@@ -171,7 +207,7 @@ func NewMoney(valueString string) (Money, error) {
 		return m, err
 	}
 
-	m = Money{decimal: decimal, whole: whole, currency: "$"}
+	m = Money{decimal: decimal, whole: whole, places: len(decimalString), currency: "$"}
 
 	return m, nil
 }
@@ -180,6 +216,10 @@ type Transaction struct {
 	Description string `json:"description"`
 	Date        Time   `json:"date"`
 	Amount      Money  `json:"amount"`
+	// set for purchases made in a foreign currency, Amount holds the USD value
+	Foreign *ForeignAmount `json:"foreign,omitempty"`
+	// id of the API key that registered the transaction
+	CreatedBy string `json:"createdBy,omitempty"`
 }
 
 type IdentifiedTransaction struct {
@@ -210,3 +250,44 @@ func NewTransaction(description string, dateString string,
 	}
 	return tr, nil
 }
+
+// TransactionFilter selects transactions by purchase date (inclusive) and
+// description. Zero values match every transaction.
+type TransactionFilter struct {
+	From        Time
+	To          Time
+	Description string // case insensitive substring
+}
+
+func NewTransactionFilter(from, to, description string) (TransactionFilter, error) {
+	var filter TransactionFilter
+	var err error
+	if from != "" {
+		filter.From, err = NewTime(from)
+		if err != nil {
+			return filter, err
+		}
+	}
+	if to != "" {
+		filter.To, err = NewTime(to)
+		if err != nil {
+			return filter, err
+		}
+	}
+	filter.Description = description
+	return filter, nil
+}
+
+func (f TransactionFilter) Matches(tran IdentifiedTransaction) bool {
+	if !f.From.IsZero() && tran.Date.Before(f.From.Time) {
+		return false
+	}
+	if !f.To.IsZero() && tran.Date.After(f.To.Time) {
+		return false
+	}
+	if f.Description != "" &&
+		!strings.Contains(strings.ToLower(tran.Description), strings.ToLower(f.Description)) {
+		return false
+	}
+	return true
+}
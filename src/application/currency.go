@@ -0,0 +1,306 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type Currency struct {
+	CountryCurrency string `json:"countryCurrency"`
+	Country         string `json:"country"`
+	Currency        string `json:"currency"`
+	IsoCode         string `json:"isoCode,omitempty"`
+	FirstRecordDate Time   `json:"firstRecordDate"`
+	LastRecordDate  Time   `json:"lastRecordDate"`
+}
+
+// Desc returns the country_currency_desc used by the Treasury dataset,
+// for example "Mexico-Peso".
+func (c Currency) Desc() string {
+	return fmt.Sprintf("%s-%s", c.Country, c.Currency)
+}
+
+func NewCurrency(country, currency string) Currency {
+	return Currency{
+		CountryCurrency: fmt.Sprintf("%s-%s", country, currency),
+		Country:         country,
+		Currency:        currency,
+		IsoCode:         IsoCode(country, currency),
+	}
+}
+
+// isoCodes maps the lower case country_currency_desc to its ISO 4217 code.
+// Members of the euro zone are resolved by IsoCode and are not listed.
+var isoCodes = map[string]string{
+	"afghanistan-afghani":                "AFN",
+	"albania-lek":                        "ALL",
+	"algeria-dinar":                      "DZD",
+	"angola-kwanza":                      "AOA",
+	"argentina-peso":                     "ARS",
+	"armenia-dram":                       "AMD",
+	"australia-dollar":                   "AUD",
+	"azerbaijan-manat":                   "AZN",
+	"bahamas-dollar":                     "BSD",
+	"bahrain-dinar":                      "BHD",
+	"bangladesh-taka":                    "BDT",
+	"barbados-dollar":                    "BBD",
+	"belarus-new ruble":                  "BYN",
+	"belize-dollar":                      "BZD",
+	"bermuda-dollar":                     "BMD",
+	"bolivia-boliviano":                  "BOB",
+	"bosnia-marka":                       "BAM",
+	"botswana-pula":                      "BWP",
+	"brazil-real":                        "BRL",
+	"brunei-dollar":                      "BND",
+	"bulgaria-lev":                       "BGN",
+	"burundi-franc":                      "BIF",
+	"cambodia-riel":                      "KHR",
+	"canada-dollar":                      "CAD",
+	"cape verde-escudo":                  "CVE",
+	"cayman islands-dollar":              "KYD",
+	"chile-peso":                         "CLP",
+	"china-renminbi":                     "CNY",
+	"colombia-peso":                      "COP",
+	"comoros-franc":                      "KMF",
+	"costa rica-colon":                   "CRC",
+	"cuba-peso":                          "CUP",
+	"czech republic-koruna":              "CZK",
+	"dem. rep. of congo-congolese franc": "CDF",
+	"denmark-krone":                      "DKK",
+	"djibouti-franc":                     "DJF",
+	"dominican republic-peso":            "DOP",
+	"egypt-pound":                        "EGP",
+	"eritrea-nakfa":                      "ERN",
+	"ethiopia-birr":                      "ETB",
+	"fiji-dollar":                        "FJD",
+	"gambia-dalasi":                      "GMD",
+	"georgia-lari":                       "GEL",
+	"ghana-cedi":                         "GHS",
+	"guatemala-quetzal":                  "GTQ",
+	"guinea-franc":                       "GNF",
+	"guyana-dollar":                      "GYD",
+	"haiti-gourde":                       "HTG",
+	"honduras-lempira":                   "HNL",
+	"hong kong-dollar":                   "HKD",
+	"hungary-forint":                     "HUF",
+	"iceland-krona":                      "ISK",
+	"india-rupee":                        "INR",
+	"indonesia-rupiah":                   "IDR",
+	"iran-rial":                          "IRR",
+	"iraq-dinar":                         "IQD",
+	"israel-shekel":                      "ILS",
+	"jamaica-dollar":                     "JMD",
+	"japan-yen":                          "JPY",
+	"jordan-dinar":                       "JOD",
+	"kazakhstan-tenge":                   "KZT",
+	"kenya-shilling":                     "KES",
+	"korea-won":                          "KRW",
+	"kuwait-dinar":                       "KWD",
+	"kyrgyzstan-som":                     "KGS",
+	"laos-kip":                           "LAK",
+	"lebanon-pound":                      "LBP",
+	"lesotho-maloti":                     "LSL",
+	"liberia-dollar":                     "LRD",
+	"libya-dinar":                        "LYD",
+	"macao-pataca":                       "MOP",
+	"madagascar-ariary":                  "MGA",
+	"malawi-kwacha":                      "MWK",
+	"malaysia-ringgit":                   "MYR",
+	"maldives-rufiyaa":                   "MVR",
+	"mauritania-ouguiya":                 "MRU",
+	"mauritius-rupee":                    "MUR",
+	"mexico-peso":                        "MXN",
+	"moldova-leu":                        "MDL",
+	"mongolia-tugrik":                    "MNT",
+	"morocco-dirham":                     "MAD",
+	"mozambique-metical":                 "MZN",
+	"myanmar-kyat":                       "MMK",
+	"namibia-dollar":                     "NAD",
+	"nepal-rupee":                        "NPR",
+	"netherlands antilles-guilder":       "ANG",
+	"new zealand-dollar":                 "NZD",
+	"nicaragua-cordoba":                  "NIO",
+	"nigeria-naira":                      "NGN",
+	"north macedonia-denar":              "MKD",
+	"norway-krone":                       "NOK",
+	"oman-rial":                          "OMR",
+	"pakistan-rupee":                     "PKR",
+	"panama-balboa":                      "PAB",
+	"papua new guinea-kina":              "PGK",
+	"paraguay-guarani":                   "PYG",
+	"peru-sol":                           "PEN",
+	"philippines-peso":                   "PHP",
+	"poland-zloty":                       "PLN",
+	"qatar-riyal":                        "QAR",
+	"romania-new leu":                    "RON",
+	"russia-ruble":                       "RUB",
+	"rwanda-franc":                       "RWF",
+	"saudi arabia-riyal":                 "SAR",
+	"serbia-dinar":                       "RSD",
+	"seychelles-rupee":                   "SCR",
+	"sierra leone-leone":                 "SLE",
+	"singapore-dollar":                   "SGD",
+	"solomon islands-dollar":             "SBD",
+	"somali-shilling":                    "SOS",
+	"south africa-rand":                  "ZAR",
+	"south sudan-sudanese pound":         "SSP",
+	"sri lanka-rupee":                    "LKR",
+	"sudan-pound":                        "SDG",
+	"suriname-dollar":                    "SRD",
+	"swaziland-lilangeni":                "SZL",
+	"sweden-krona":                       "SEK",
+	"switzerland-franc":                  "CHF",
+	"syria-pound":                        "SYP",
+	"taiwan-dollar":                      "TWD",
+	"tajikistan-somoni":                  "TJS",
+	"tanzania-shilling":                  "TZS",
+	"thailand-baht":                      "THB",
+	"tonga-pa'anga":                      "TOP",
+	"trinidad & tobago-dollar":           "TTD",
+	"tunisia-dinar":                      "TND",
+	"turkey-new lira":                    "TRY",
+	"turkmenistan-new manat":             "TMT",
+	"uganda-shilling":                    "UGX",
+	"ukraine-hryvnia":                    "UAH",
+	"united arab emirates-dirham":        "AED",
+	"united kingdom-pound":               "GBP",
+	"uruguay-peso":                       "UYU",
+	"uzbekistan-som":                     "UZS",
+	"vanuatu-vatu":                       "VUV",
+	"vietnam-dong":                       "VND",
+	"western samoa-tala":                 "WST",
+	"yemen-rial":                         "YER",
+	"zambia-new kwacha":                  "ZMW",
+}
+
+// IsoCode returns the ISO 4217 code of a Treasury country currency, or an
+// empty string when it is not known.
+func IsoCode(country, currency string) string {
+	c := strings.ToLower(currency)
+	switch {
+	case c == "euro":
+		return "EUR"
+	case c == "east caribbean dollar":
+		return "XCD"
+	case c == "dolares" || strings.HasPrefix(c, "u.s. dollar"):
+		return "USD"
+	}
+	return isoCodes[strings.ToLower(country+"-"+currency)]
+}
+
+var ErrUnknownCurrency = errors.New("Unknown currency")
+var ErrAmbiguousCurrency = errors.New("Ambiguous currency")
+
+// MatchCurrency finds the currency of the catalog described by query. The
+// query may be an ISO code ("MXN"), a country_currency_desc ("Mexico-Peso")
+// or free words ("mexico peso", "peso mexico"), compared case insensitively
+// and tolerating one typo per word.
+func MatchCurrency(catalog []Currency, query string) (Currency, error) {
+	var match Currency
+
+	words := normalizeWords(query)
+	if len(words) == 0 {
+		return match, fmt.Errorf("Empty currency: %w", ErrUnknownCurrency)
+	}
+
+	if len(words) == 1 && len(words[0]) == 3 {
+		var matches []Currency
+		for _, c := range catalog {
+			if strings.EqualFold(c.IsoCode, words[0]) {
+				matches = append(matches, c)
+			}
+		}
+		if len(matches) == 1 {
+			return matches[0], nil
+		}
+	}
+
+	best := 0
+	var matches []Currency
+	for _, c := range catalog {
+		score := matchScore(words, normalizeWords(c.Desc()))
+		if score == 0 || score < best {
+			continue
+		}
+		if score > best {
+			best = score
+			matches = nil
+		}
+		matches = append(matches, c)
+	}
+
+	switch len(matches) {
+	case 0:
+		return match, fmt.Errorf("%v: %w", query, ErrUnknownCurrency)
+	case 1:
+		return matches[0], nil
+	}
+
+	options := make([]string, 0, len(matches))
+	for _, c := range matches {
+		options = append(options, c.Desc())
+	}
+	return match, fmt.Errorf("%v could be any of %v: %w",
+		query, strings.Join(options, ", "), ErrAmbiguousCurrency)
+}
+
+func normalizeWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return r == ' ' || r == '-' || r == '_' || r == ',' || r == '/'
+	})
+}
+
+// matchScore is zero when any of the query words is not found among the
+// candidate words, otherwise higher scores mean closer matches.
+func matchScore(query, candidate []string) int {
+	score := 0
+	for _, q := range query {
+		wordScore := 0
+		for _, c := range candidate {
+			switch {
+			case q == c:
+				wordScore = max(wordScore, 3)
+			case len(q) >= 3 && strings.HasPrefix(c, q):
+				wordScore = max(wordScore, 2)
+			case len(q) >= 4 && withinOneEdit(q, c):
+				wordScore = max(wordScore, 1)
+			}
+		}
+		if wordScore == 0 {
+			return 0
+		}
+		score += wordScore
+	}
+	// prefer candidates without extra words
+	if len(query) == len(candidate) {
+		score++
+	}
+	return score
+}
+
+// withinOneEdit reports whether a can be turned into b with at most one
+// insertion, deletion, substitution or transposition.
+func withinOneEdit(a, b string) bool {
+	if a == b {
+		return true
+	}
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	if len(b)-len(a) > 1 {
+		return false
+	}
+	i := 0
+	for i < len(a) && a[i] == b[i] {
+		i++
+	}
+	if len(a) == len(b) {
+		if a[i+1:] == b[i+1:] {
+			return true
+		}
+		// transposition
+		return i+1 < len(a) && a[i] == b[i+1] && a[i+1] == b[i] && a[i+2:] == b[i+2:]
+	}
+	return a[i:] == b[i+1:]
+}
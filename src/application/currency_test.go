@@ -0,0 +1,86 @@
+package application
+
+import (
+	"errors"
+	"testing"
+)
+
+func sampleCatalog() []Currency {
+	return []Currency{
+		NewCurrency("Mexico", "Peso"),
+		NewCurrency("Chile", "Peso"),
+		NewCurrency("Canada", "Dollar"),
+		NewCurrency("New Zealand", "Dollar"),
+		NewCurrency("Euro Zone", "Euro"),
+		NewCurrency("Germany", "Euro"),
+		NewCurrency("United Kingdom", "Pound"),
+	}
+}
+
+func TestMatchCurrency(t *testing.T) {
+	var tests = []struct {
+		query    string
+		expected string
+	}{
+		{"Mexico-Peso", "Mexico-Peso"},
+		{"mexico peso", "Mexico-Peso"},
+		{"PESO MEXICO", "Mexico-Peso"},
+		{"mexcio peso", "Mexico-Peso"},
+		{"mexico", "Mexico-Peso"},
+		{"MXN", "Mexico-Peso"},
+		{"gbp", "United Kingdom-Pound"},
+		{"united kingdom", "United Kingdom-Pound"},
+		{"new zealand", "New Zealand-Dollar"},
+		{"euro zone euro", "Euro Zone-Euro"},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.query, func(t *testing.T) {
+			c, err := MatchCurrency(sampleCatalog(), testCase.query)
+			if err != nil {
+				t.Fatalf("Received error for valid test case (%v): %v", testCase.query, err)
+			}
+			if c.CountryCurrency != testCase.expected {
+				t.Errorf("expected %v but received %v", testCase.expected, c.CountryCurrency)
+			}
+		})
+	}
+}
+
+func TestMatchCurrencyErrors(t *testing.T) {
+	var tests = []struct {
+		query    string
+		expected error
+	}{
+		{"", ErrUnknownCurrency},
+		{"yen", ErrUnknownCurrency},
+		{"mexico dollar", ErrUnknownCurrency},
+		{"peso", ErrAmbiguousCurrency},
+		{"euro", ErrAmbiguousCurrency},
+		{"EUR", ErrAmbiguousCurrency},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.query, func(t *testing.T) {
+			_, err := MatchCurrency(sampleCatalog(), testCase.query)
+			if !errors.Is(err, testCase.expected) {
+				t.Errorf("Error differs from expected: received (%v); expected (%v)", err, testCase.expected)
+			}
+		})
+	}
+}
+
+func TestIsoCode(t *testing.T) {
+	var tests = [][3]string{
+		{"Mexico", "Peso", "MXN"},
+		{"Euro Zone", "Euro", "EUR"},
+		{"Austria", "Euro", "EUR"},
+		{"Ecuador", "Dolares", "USD"},
+		{"Atlantis", "Shell", ""},
+	}
+	for _, testCase := range tests {
+		if code := IsoCode(testCase[0], testCase[1]); code != testCase[2] {
+			t.Errorf("expected %v for %v-%v but received %v", testCase[2], testCase[0], testCase[1], code)
+		}
+	}
+}
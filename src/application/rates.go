@@ -0,0 +1,224 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+type ExchangeRate struct {
+	CountryCurrency string `json:"countryCurrency"`
+	Rate            Money  `json:"exchangeRate"`
+	RecordDate      Time   `json:"recordDate"`
+}
+
+func NewExchangeRate(countryCurrency, rate, recordDate string) (ExchangeRate, error) {
+	var r ExchangeRate
+	value, err := NewMoney(rate)
+	if err != nil {
+		return r, err
+	}
+	date, err := NewTime(recordDate)
+	if err != nil {
+		return r, err
+	}
+	return ExchangeRate{
+		CountryCurrency: countryCurrency,
+		Rate:            value,
+		RecordDate:      date,
+	}, nil
+}
+
+// RatePolicy decides which of the rates found within the lookback window is
+// used to convert a purchase.
+type RatePolicy string
+
+const (
+	// most recent rate on or before the purchase date
+	LatestRate RatePolicy = "latest"
+	// rate closest to the purchase date, before or after it
+	NearestRate RatePolicy = "nearest"
+	// average of every rate on or before the purchase date
+	AverageRate RatePolicy = "average"
+	// rate published on a record date supplied by the caller
+	RecordDateRate RatePolicy = "recordDate"
+)
+
+var ErrRatePolicy = errors.New("Invalid rate policy")
+
+func NewRatePolicy(policy string) (RatePolicy, error) {
+	switch p := RatePolicy(policy); p {
+	case LatestRate, NearestRate, AverageRate, RecordDateRate:
+		return p, nil
+	}
+	return "", fmt.Errorf("%v: %w", policy, ErrRatePolicy)
+}
+
+const (
+	DefaultRateWindow = 6 // months
+	maxRateWindow     = 120
+)
+
+var ErrRateWindow = errors.New("Invalid rate window")
+
+func NewRateWindow(months string) (int, error) {
+	window, err := strconv.Atoi(months)
+	if err != nil || window < 1 || window > maxRateWindow {
+		return 0, fmt.Errorf("Window should be between 1 and %v months: %w",
+			maxRateWindow, ErrRateWindow)
+	}
+	return window, nil
+}
+
+type RateSelection struct {
+	Policy       RatePolicy
+	WindowMonths int
+	RecordDate   Time // only used by RecordDateRate
+}
+
+var ErrNoRate = errors.New("No exchange rate available")
+
+// Window returns the record date range that has to be queried to apply the
+// selection to a purchase made on date.
+func (s RateSelection) Window(date Time) (Time, Time) {
+	switch s.Policy {
+	case RecordDateRate:
+		return s.RecordDate, s.RecordDate
+	case NearestRate:
+		return Time{date.AddDate(0, -s.WindowMonths, 0)},
+			Time{date.AddDate(0, s.WindowMonths, 0)}
+	default:
+		return Time{date.AddDate(0, -s.WindowMonths, 0)}, date
+	}
+}
+
+// Select picks the rate to be used for a purchase made on date. Rates outside
+// of the selection window are ignored. For AverageRate the record date
+// returned is the most recent one taken into the average.
+func (s RateSelection) Select(rates []ExchangeRate, date Time) (ExchangeRate, error) {
+	var selected ExchangeRate
+	from, to := s.Window(date)
+
+	candidates := make([]ExchangeRate, 0, len(rates))
+	for _, rate := range rates {
+		if rate.RecordDate.Before(from.Time) || rate.RecordDate.After(to.Time) {
+			continue
+		}
+		candidates = append(candidates, rate)
+	}
+	if len(candidates) == 0 {
+		return selected, ErrNoRate
+	}
+
+	switch s.Policy {
+	case NearestRate:
+		best := absDuration(candidates[0].RecordDate.Sub(date.Time))
+		selected = candidates[0]
+		for _, rate := range candidates[1:] {
+			distance := absDuration(rate.RecordDate.Sub(date.Time))
+			// on a tie the rate before the purchase wins
+			if distance < best || (distance == best && rate.RecordDate.Before(selected.RecordDate.Time)) {
+				best = distance
+				selected = rate
+			}
+		}
+	case AverageRate:
+		var sum int64
+		selected = candidates[0]
+		for _, rate := range candidates {
+			sum += rate.Rate.toInt()
+			if rate.RecordDate.After(selected.RecordDate.Time) {
+				selected = rate
+			}
+		}
+		n := int64(len(candidates))
+		selected.Rate = moneyFromInt((sum + n/2) / n)
+	default:
+		// LatestRate and RecordDateRate
+		selected = candidates[0]
+		for _, rate := range candidates[1:] {
+			if rate.RecordDate.After(selected.RecordDate.Time) {
+				selected = rate
+			}
+		}
+	}
+	return selected, nil
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// Conversion records the conversion of a transaction to another currency,
+// with the rate used, so that it can be reproduced later on.
+type Conversion struct {
+	TransactionUid string     `json:"transactionId"`
+	Currency       string     `json:"currency"`
+	ExchangeRate   Money      `json:"exchangeRate"`
+	RateRecordDate Time       `json:"rateRecordDate"`
+	RatePolicy     RatePolicy `json:"ratePolicy"`
+	Provider       string     `json:"provider"`
+	ConvertedValue Money      `json:"convertedValue"`
+	Timestamp      time.Time  `json:"timestamp"`
+}
+
+func NewConversion(transaction IdentifiedTransaction, rate ExchangeRate,
+	policy RatePolicy, provider string) Conversion {
+	return Conversion{
+		TransactionUid: transaction.Uid,
+		Currency:       rate.CountryCurrency,
+		ExchangeRate:   rate.Rate,
+		RateRecordDate: rate.RecordDate,
+		RatePolicy:     policy,
+		Provider:       provider,
+		ConvertedValue: transaction.Amount.PreciseConvert(rate.Rate),
+		Timestamp:      time.Now().UTC(),
+	}
+}
+
+// Matches reports whether the conversion answers a new conversion to
+// currency with the given selection.
+func (c Conversion) Matches(currency string, selection RateSelection) bool {
+	if c.Currency != currency || c.RatePolicy != selection.Policy {
+		return false
+	}
+	if selection.Policy == RecordDateRate {
+		return c.RateRecordDate.Equal(selection.RecordDate.Time)
+	}
+	return true
+}
+
+// ForeignAmount is the amount of a purchase made in a foreign currency, with
+// the rate used to derive its USD value.
+type ForeignAmount struct {
+	Currency       string     `json:"currency"`
+	Amount         Money      `json:"amount"`
+	ExchangeRate   Money      `json:"exchangeRate"`
+	RateRecordDate Time       `json:"rateRecordDate"`
+	RatePolicy     RatePolicy `json:"ratePolicy"`
+	Provider       string     `json:"provider"`
+}
+
+// NewForeignTransaction converts a transaction whose amount is given in the
+// currency of rate to USD, keeping the original amount.
+func NewForeignTransaction(transaction Transaction, rate ExchangeRate,
+	policy RatePolicy, provider string) (Transaction, error) {
+	amount, err := transaction.Amount.PreciseDivide(rate.Rate)
+	if err != nil {
+		return transaction, err
+	}
+	transaction.Foreign = &ForeignAmount{
+		Currency:       rate.CountryCurrency,
+		Amount:         transaction.Amount,
+		ExchangeRate:   rate.Rate,
+		RateRecordDate: rate.RecordDate,
+		RatePolicy:     policy,
+		Provider:       provider,
+	}
+	transaction.Amount = amount
+	return transaction, nil
+}
@@ -0,0 +1,153 @@
+package application
+
+import (
+	"errors"
+	"testing"
+)
+
+func sampleRates() []ExchangeRate {
+	var rates []ExchangeRate
+	for _, r := range [][2]string{
+		{"17.50", "2023-03-31"},
+		{"17.00", "2023-06-30"},
+		{"18.00", "2023-09-30"},
+		{"16.00", "2022-12-31"},
+	} {
+		rate, _ := NewExchangeRate("Mexico-Peso", r[0], r[1])
+		rates = append(rates, rate)
+	}
+	return rates
+}
+
+func TestRateSelection(t *testing.T) {
+	purchase, _ := NewTime("2023-08-20")
+	recordDate, _ := NewTime("2023-03-31")
+
+	var tests = []struct {
+		selection          RateSelection
+		expectedRate       string
+		expectedRecordDate string
+	}{
+		{RateSelection{Policy: LatestRate, WindowMonths: 6}, "17.00", "2023-06-30"},
+		{RateSelection{Policy: NearestRate, WindowMonths: 6}, "18.00", "2023-09-30"},
+		{RateSelection{Policy: AverageRate, WindowMonths: 6}, "17.2500", "2023-06-30"},
+		{RateSelection{Policy: AverageRate, WindowMonths: 12}, "16.8333", "2023-06-30"},
+		{RateSelection{Policy: RecordDateRate, RecordDate: recordDate}, "17.50", "2023-03-31"},
+	}
+
+	for _, testCase := range tests {
+		t.Run(string(testCase.selection.Policy), func(t *testing.T) {
+			rate, err := testCase.selection.Select(sampleRates(), purchase)
+			if err != nil {
+				t.Fatalf("Received error selecting rate: %v", err)
+			}
+			if rate.Rate.ToString() != testCase.expectedRate {
+				t.Errorf("expected rate %v but received %v", testCase.expectedRate, rate.Rate.ToString())
+			}
+			if rate.RecordDate.ToString() != testCase.expectedRecordDate {
+				t.Errorf("expected record date %v but received %v",
+					testCase.expectedRecordDate, rate.RecordDate.ToString())
+			}
+		})
+	}
+}
+
+func TestRateSelectionOutsideWindow(t *testing.T) {
+	purchase, _ := NewTime("2024-08-01")
+	selection := RateSelection{Policy: LatestRate, WindowMonths: 6}
+
+	_, err := selection.Select(sampleRates(), purchase)
+	if !errors.Is(err, ErrNoRate) {
+		t.Errorf("Error differs from expected: received (%v); expected (%v)", err, ErrNoRate)
+	}
+}
+
+func TestRatePolicyAndWindow(t *testing.T) {
+	var tests = []testCase{
+		{"latest", true},
+		{"nearest", true},
+		{"average", true},
+		{"recordDate", true},
+
+		{"", false},
+		{"Latest", false},
+	}
+	for _, testCase := range tests {
+		t.Run(testCase.value, func(t *testing.T) {
+			_, err := NewRatePolicy(testCase.value)
+			if testCase.expectedResult && err != nil {
+				t.Errorf("Received error for valid test case (%v): %v", testCase.value, err)
+			}
+			if !testCase.expectedResult && !errors.Is(err, ErrRatePolicy) {
+				t.Errorf("Error differs from expected: received (%v); expected (%v)", err, ErrRatePolicy)
+			}
+		})
+	}
+
+	for _, window := range []string{"0", "-1", "121", "a"} {
+		if _, err := NewRateWindow(window); !errors.Is(err, ErrRateWindow) {
+			t.Errorf("Error differs from expected: received (%v); expected (%v)", err, ErrRateWindow)
+		}
+	}
+}
+
+func TestMoneyLeadingZeroDecimals(t *testing.T) {
+	value, _ := NewMoney("1.05")
+	if value.ToString() != "1.05" {
+		t.Errorf("expected %v but received %v\n", "1.05", value.ToString())
+	}
+
+	rate, _ := NewMoney("2.0")
+	converted := value.PreciseConvert(rate)
+	if converted.ToString() != "2.10" {
+		t.Errorf("expected %v but received %v\n", "2.10", converted.ToString())
+	}
+}
+
+func TestMoneyDivide(t *testing.T) {
+	tests := []struct {
+		value, rate, expected string
+	}{
+		{"1707.70", "17.077", "100.00"},
+		{"100.00", "3.0", "33.33"},
+		{"200.00", "3.0", "66.67"},
+		{"0.01", "17.077", "0.00"},
+		{"99.99", "1.0", "99.99"},
+		{"159.99", "0.8", "199.99"},
+	}
+	for _, test := range tests {
+		t.Run(test.value+"/"+test.rate, func(t *testing.T) {
+			value, _ := NewMoney(test.value)
+			rate, _ := NewMoney(test.rate)
+			result, err := value.PreciseDivide(rate)
+			if err != nil || result.ToString() != test.expected {
+				t.Errorf("expected %v but received %v (%v)", test.expected, result.ToString(), err)
+			}
+		})
+	}
+
+	value, _ := NewMoney("1.00")
+	if _, err := value.PreciseDivide(Money{}); !errors.Is(err, ErrZeroRate) {
+		t.Errorf("Error differs from expected: received (%v); expected (%v)", err, ErrZeroRate)
+	}
+}
+
+func TestNewForeignTransaction(t *testing.T) {
+	transaction, _ := NewTransaction("Lunch in Mexico City", "2023-07-02", "341.54")
+	rate, _ := NewExchangeRate("Mexico-Peso", "17.077", "2023-06-30")
+
+	foreign, err := NewForeignTransaction(transaction, rate, LatestRate, "treasury")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if foreign.Amount.ToString() != "20.00" {
+		t.Errorf("expected USD amount %v but received %v", "20.00", foreign.Amount.ToString())
+	}
+	if foreign.Foreign == nil || foreign.Foreign.Amount.ToString() != "341.54" ||
+		foreign.Foreign.Currency != "Mexico-Peso" || foreign.Foreign.RateRecordDate.ToString() != "2023-06-30" {
+		t.Errorf("unexpected foreign amount %+v", foreign.Foreign)
+	}
+	if transaction.Foreign != nil {
+		t.Error("original transaction was modified")
+	}
+}
@@ -0,0 +1,47 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TenantSettings are the defaults a tenant applies to its conversions when a
+// request does not choose them.
+type TenantSettings struct {
+	// currency conversions are made to, as a country_currency_desc
+	Currency   string     `json:"currency,omitempty"`
+	RatePolicy RatePolicy `json:"ratePolicy,omitempty"`
+	RateWindow int        `json:"rateWindow,omitempty"`
+}
+
+var ErrTenantSettings = errors.New("Invalid tenant settings")
+
+// Validate checks the rate policy and window, the currency is resolved
+// against the currency catalog by the caller.
+func (s TenantSettings) Validate() error {
+	if s.RatePolicy != "" {
+		if _, err := NewRatePolicy(string(s.RatePolicy)); err != nil {
+			return fmt.Errorf("%w: %v", ErrTenantSettings, err)
+		}
+		if s.RatePolicy == RecordDateRate {
+			return fmt.Errorf("%w: %v policy can only be chosen per request", ErrTenantSettings, s.RatePolicy)
+		}
+	}
+	if s.RateWindow != 0 {
+		if _, err := NewRateWindow(fmt.Sprint(s.RateWindow)); err != nil {
+			return fmt.Errorf("%w: %v", ErrTenantSettings, err)
+		}
+	}
+	return nil
+}
+
+// RateSelection returns defaults overridden by the settings of the tenant.
+func (s TenantSettings) RateSelection(defaults RateSelection) RateSelection {
+	if s.RatePolicy != "" {
+		defaults.Policy = s.RatePolicy
+	}
+	if s.RateWindow != 0 {
+		defaults.WindowMonths = s.RateWindow
+	}
+	return defaults
+}
@@ -0,0 +1,32 @@
+package application
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTenantSettings(t *testing.T) {
+	defaults := RateSelection{Policy: LatestRate, WindowMonths: DefaultRateWindow}
+
+	if selection := (TenantSettings{}).RateSelection(defaults); selection != defaults {
+		t.Errorf("Empty settings changed the defaults: %+v", selection)
+	}
+	settings := TenantSettings{RatePolicy: AverageRate, RateWindow: 12}
+	if selection := settings.RateSelection(defaults); selection.Policy != AverageRate || selection.WindowMonths != 12 {
+		t.Errorf("Settings not applied: %+v", selection)
+	}
+
+	for _, invalid := range []TenantSettings{
+		{RatePolicy: "Latest"},
+		{RatePolicy: RecordDateRate},
+		{RateWindow: 121},
+		{RateWindow: -1},
+	} {
+		if err := invalid.Validate(); !errors.Is(err, ErrTenantSettings) {
+			t.Errorf("Error differs from expected for %+v: received (%v); expected (%v)", invalid, err, ErrTenantSettings)
+		}
+	}
+	if err := settings.Validate(); err != nil {
+		t.Errorf("Received error for valid settings: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+// Package auth authenticates API requests with API keys and checks the
+// scopes granted to them.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type Scope string
+
+const (
+	// query transactions, conversions, currencies and rates
+	ScopeRead Scope = "read"
+	// register and edit transactions
+	ScopeWrite Scope = "write"
+	// convert transactions
+	ScopeConvert Scope = "convert"
+	// operate the server
+	ScopeAdmin Scope = "admin"
+)
+
+var ErrScope = errors.New("Invalid scope")
+
+func NewScope(scope string) (Scope, error) {
+	switch s := Scope(strings.TrimSpace(scope)); s {
+	case ScopeRead, ScopeWrite, ScopeConvert, ScopeAdmin:
+		return s, nil
+	}
+	return "", fmt.Errorf("%v: %w", scope, ErrScope)
+}
+
+// NewScopes parses a comma separated list of scopes.
+func NewScopes(scopes string) ([]Scope, error) {
+	var list []Scope
+	for _, s := range strings.Split(scopes, ",") {
+		scope, err := NewScope(s)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, scope)
+	}
+	return list, nil
+}
+
+const (
+	// DefaultTenant owns the keys created without a tenant and the
+	// transactions stored before tenants were introduced.
+	DefaultTenant = "default"
+	// AnyTenant is granted to keys not bound to a tenant, their requests
+	// choose one with the TenantHeader.
+	AnyTenant = "*"
+)
+
+var ErrTenant = errors.New("Invalid tenant")
+
+// tenant names are used as directory names by the local storage
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+func NewTenant(tenant string) (string, error) {
+	if tenant == AnyTenant || tenantPattern.MatchString(tenant) {
+		return tenant, nil
+	}
+	return "", fmt.Errorf("%v: %w", tenant, ErrTenant)
+}
+
+const keyPrefix = "wex"
+
+// APIKey is a stored key. Only the hash of the secret is kept, the key
+// itself is shown once when created.
+type APIKey struct {
+	Id     string  `json:"id"`
+	Name   string  `json:"name"`
+	Hash   string  `json:"hash"`
+	Scopes []Scope `json:"scopes"`
+	// empty for the DefaultTenant
+	Tenant    string     `json:"tenant,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RotatedAt *time.Time `json:"rotatedAt,omitempty"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+func (k APIKey) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+// TenantName returns the tenant the key is bound to.
+func (k APIKey) TenantName() string {
+	if k.Tenant == "" {
+		return DefaultTenant
+	}
+	return k.Tenant
+}
+
+// NewAPIKey generates a key granting scopes. The key returned is the secret
+// to hand to the client.
+func NewAPIKey(name string, scopes []Scope) (APIKey, string, error) {
+	if strings.TrimSpace(name) == "" {
+		return APIKey{}, "", errors.New("Key name is required")
+	}
+	if len(scopes) == 0 {
+		return APIKey{}, "", fmt.Errorf("At least one scope is required: %w", ErrScope)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return APIKey{}, "", err
+	}
+	k := APIKey{
+		Id:        hex.EncodeToString(id),
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	secret, err := k.newSecret()
+	return k, secret, err
+}
+
+// Rotate replaces the secret of the key, the previous one stops working.
+func (k APIKey) Rotate() (APIKey, string, error) {
+	secret, err := k.newSecret()
+	now := time.Now().UTC()
+	k.RotatedAt = &now
+	return k, secret, err
+}
+
+func (k *APIKey) newSecret() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	secret := fmt.Sprintf("%v_%v_%v", keyPrefix, k.Id, base64.RawURLEncoding.EncodeToString(random))
+	k.Hash = hashSecret(secret)
+	return secret, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// keyId extracts the id of the key from a secret.
+func keyId(secret string) (string, bool) {
+	parts := strings.SplitN(secret, "_", 3)
+	if len(parts) != 3 || parts[0] != keyPrefix || parts[1] == "" || parts[2] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+func (k APIKey) matches(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hashSecret(secret))) == 1
+}
+
+// Principal is the authenticated client of a request.
+type Principal struct {
+	KeyId  string
+	Name   string
+	Scopes []Scope
+	// tenant the request is made for, once authorized
+	Tenant string
+}
+
+func (p Principal) Has(scope Scope) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the principal authenticated for a request.
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
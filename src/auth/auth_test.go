@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type mapKeyStore map[string]APIKey
+
+func (m mapKeyStore) QueryKey(id string) (APIKey, error) {
+	key, ok := m[id]
+	if !ok {
+		return key, errors.New("not found")
+	}
+	return key, nil
+}
+
+func TestNewScopes(t *testing.T) {
+	scopes, err := NewScopes("read, convert")
+	if err != nil || len(scopes) != 2 || scopes[1] != ScopeConvert {
+		t.Errorf("Unexpected scopes %v (%v)", scopes, err)
+	}
+	for _, invalid := range []string{"", "read,", "Read", "delete"} {
+		if _, err := NewScopes(invalid); !errors.Is(err, ErrScope) {
+			t.Errorf("Error differs from expected for %q: received (%v); expected (%v)", invalid, err, ErrScope)
+		}
+	}
+	if _, _, err := NewAPIKey("ci", nil); !errors.Is(err, ErrScope) {
+		t.Errorf("Error differs from expected: received (%v); expected (%v)", err, ErrScope)
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	key, secret, err := NewAPIKey("ci", []Scope{ScopeRead})
+	if err != nil {
+		t.Fatalf("Could not create key: %v", err)
+	}
+	if key.Hash == "" || key.Hash == secret {
+		t.Error("Key secret must be stored hashed")
+	}
+	store := mapKeyStore{key.Id: key}
+	a := Authenticator{Keys: store}
+
+	if p, err := a.Check(secret); err != nil || p.KeyId != key.Id || !p.Has(ScopeRead) || p.Has(ScopeWrite) {
+		t.Errorf("Unexpected principal %+v (%v)", p, err)
+	}
+
+	rotated, newSecret, _ := key.Rotate()
+	store[key.Id] = rotated
+	if _, err := a.Check(secret); err != ErrInvalidCredentials {
+		t.Errorf("Previous secret accepted after rotation: %v", err)
+	}
+	if _, err := a.Check(newSecret); err != nil {
+		t.Errorf("Rotated secret refused: %v", err)
+	}
+
+	now := time.Now()
+	rotated.RevokedAt = &now
+	store[key.Id] = rotated
+	if _, err := a.Check(newSecret); err != ErrInvalidCredentials {
+		t.Errorf("Revoked key accepted: %v", err)
+	}
+
+	for _, invalid := range []string{"", "wex", "wex__x", "abc_" + key.Id + "_x", "wex_unknown_x", "wex_" + key.Id + "_x"} {
+		if _, err := a.Check(invalid); err != ErrInvalidCredentials {
+			t.Errorf("Invalid key %q accepted: %v", invalid, err)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	key, secret, _ := NewAPIKey("ci", []Scope{ScopeRead, ScopeConvert})
+	a := Authenticator{Keys: mapKeyStore{key.Id: key}, Sessions: NewSessions()}
+
+	var principal Principal
+	handler := a.Require(ScopeConvert, func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = PrincipalFrom(r.Context())
+	})
+	admin := a.Require(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		header  string
+		value   string
+		status  int
+	}{
+		{"bearer", handler, "Authorization", "Bearer " + secret, http.StatusOK},
+		{"api key header", handler, "X-API-Key", secret, http.StatusOK},
+		{"session cookie", handler, "Cookie", SessionCookie + "=" + a.Sessions.Start(secret), http.StatusUnauthorized},
+		{"missing key", handler, "", "", http.StatusUnauthorized},
+		{"other scheme", handler, "Authorization", "Basic " + secret, http.StatusUnauthorized},
+		{"invalid key", handler, "X-API-Key", secret + "x", http.StatusUnauthorized},
+		{"missing scope", admin, "X-API-Key", secret, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			principal = Principal{}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.header != "" {
+				req.Header.Set(test.header, test.value)
+			}
+			res := httptest.NewRecorder()
+			test.handler(res, req)
+
+			if res.Code != test.status {
+				t.Fatalf("got status %d but expected %d", res.Code, test.status)
+			}
+			if test.status == http.StatusUnauthorized && res.Header().Get("WWW-Authenticate") == "" {
+				t.Error("missing WWW-Authenticate header")
+			}
+			if test.status == http.StatusOK && principal.KeyId != key.Id {
+				t.Errorf("principal not exposed to handler, got %+v", principal)
+			}
+		})
+	}
+}
+
+func TestRequireLogin(t *testing.T) {
+	key, secret, _ := NewAPIKey("browser", []Scope{ScopeRead})
+	a := Authenticator{Keys: mapKeyStore{key.Id: key}, Sessions: NewSessions()}
+	handler := a.RequireLogin(ScopeRead, "/login", func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{"session", "Cookie", SessionCookie + "=" + a.Sessions.Start(secret), http.StatusOK},
+		{"unknown session", "Cookie", SessionCookie + "=" + secret, http.StatusSeeOther},
+		{"api key header", "X-API-Key", secret, http.StatusSeeOther},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/transactions", nil)
+			req.Header.Set(test.header, test.value)
+			res := httptest.NewRecorder()
+			handler(res, req)
+			if res.Code != test.status {
+				t.Errorf("got status %d but expected %d", res.Code, test.status)
+			}
+		})
+	}
+
+	ended := a.Sessions.Start(secret)
+	a.Sessions.End(ended)
+	req := httptest.NewRequest(http.MethodGet, "/transactions", nil)
+	req.Header.Set("Cookie", SessionCookie+"="+ended)
+	res := httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != http.StatusSeeOther {
+		t.Errorf("got status %d for a session logged out", res.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/transactions?description=lunch", nil)
+	res = httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != http.StatusSeeOther ||
+		res.Header().Get("Location") != "/login?next=%2Ftransactions%3Fdescription%3Dlunch" {
+		t.Errorf("got status %d to %v but expected redirect to login", res.Code, res.Header().Get("Location"))
+	}
+
+	disabled := Authenticator{Disabled: true}.Require(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {})
+	res = httptest.NewRecorder()
+	disabled(res, httptest.NewRequest(http.MethodGet, "/", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("got status %d with authentication disabled", res.Code)
+	}
+}
+
+func TestRequireTenant(t *testing.T) {
+	bound, boundSecret, _ := NewAPIKey("acme", []Scope{ScopeRead})
+	bound.Tenant = "acme"
+	legacy, legacySecret, _ := NewAPIKey("legacy", []Scope{ScopeRead})
+	operator, operatorSecret, _ := NewAPIKey("operator", []Scope{ScopeRead})
+	operator.Tenant = AnyTenant
+	a := Authenticator{Keys: mapKeyStore{bound.Id: bound, legacy.Id: legacy, operator.Id: operator}}
+
+	var principal Principal
+	handler := a.Require(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = PrincipalFrom(r.Context())
+	})
+
+	tests := []struct {
+		name   string
+		secret string
+		tenant string
+		status int
+		want   string
+	}{
+		{"bound key", boundSecret, "", http.StatusOK, "acme"},
+		{"bound key same tenant", boundSecret, "acme", http.StatusOK, "acme"},
+		{"bound key other tenant", boundSecret, "globex", http.StatusForbidden, ""},
+		{"key without tenant", legacySecret, "", http.StatusOK, DefaultTenant},
+		{"key without tenant other tenant", legacySecret, "acme", http.StatusForbidden, ""},
+		{"any tenant key", operatorSecret, "globex", http.StatusOK, "globex"},
+		{"any tenant key default", operatorSecret, "", http.StatusOK, DefaultTenant},
+		{"invalid tenant", operatorSecret, "../acme", http.StatusBadRequest, ""},
+		{"wildcard tenant", operatorSecret, AnyTenant, http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			principal = Principal{}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-API-Key", test.secret)
+			if test.tenant != "" {
+				req.Header.Set(TenantHeader, test.tenant)
+			}
+			res := httptest.NewRecorder()
+			handler(res, req)
+
+			if res.Code != test.status {
+				t.Fatalf("got status %d but expected %d", res.Code, test.status)
+			}
+			if principal.Tenant != test.want {
+				t.Errorf("got tenant %q but expected %q", principal.Tenant, test.want)
+			}
+		})
+	}
+}
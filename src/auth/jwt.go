@@ -0,0 +1,410 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signing algorithms accepted for tokens, "none" never is.
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+// jwk is a key of a JSON Web Key Set (RFC 7517). Only the members needed by
+// the accepted algorithms are read.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// oct
+	K string `json:"k"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verificationKey is a parsed jwk.
+type verificationKey struct {
+	kid string
+	alg string
+	key any
+}
+
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+func decodeBigInt(segment string) (*big.Int, error) {
+	b, err := decodeSegment(segment)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// parse returns the key along with the algorithm it verifies.
+func (k jwk) parse() (verificationKey, error) {
+	parsed := verificationKey{kid: k.Kid}
+	switch k.Kty {
+	case "oct":
+		secret, err := decodeSegment(k.K)
+		if err != nil || len(secret) == 0 {
+			return parsed, errors.New("invalid oct key")
+		}
+		parsed.alg, parsed.key = HS256, secret
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return parsed, fmt.Errorf("invalid RSA modulus: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return parsed, errors.New("invalid RSA exponent")
+		}
+		if n.BitLen() < 2048 {
+			return parsed, errors.New("RSA keys should have at least 2048 bits")
+		}
+		parsed.alg, parsed.key = RS256, &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		if k.Crv != "P-256" {
+			return parsed, fmt.Errorf("unsupported curve %v", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return parsed, fmt.Errorf("invalid EC x: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return parsed, fmt.Errorf("invalid EC y: %w", err)
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return parsed, errors.New("EC point is not on the curve")
+		}
+		parsed.alg, parsed.key = ES256, &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	default:
+		return parsed, fmt.Errorf("unsupported key type %v", k.Kty)
+	}
+	if k.Alg != "" && k.Alg != parsed.alg {
+		return parsed, fmt.Errorf("algorithm %v does not match key type %v", k.Alg, k.Kty)
+	}
+	return parsed, nil
+}
+
+// JWKSFile reads the keys tokens are verified with from a local JWKS file.
+// The file is read again whenever it changes, so that keys can be rotated
+// without a restart.
+type JWKSFile struct {
+	file string
+
+	mu      sync.Mutex
+	keys    []verificationKey
+	modTime time.Time
+}
+
+func OpenJWKSFile(file string) *JWKSFile {
+	return &JWKSFile{file: file}
+}
+
+// reload must be called holding f.mu.
+func (f *JWKSFile) reload() error {
+	info, err := os.Stat(f.file)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	content, err := os.ReadFile(f.file)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &set); err != nil {
+		return err
+	}
+	var keys []verificationKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		parsed, err := k.parse()
+		if err != nil {
+			return fmt.Errorf("key %v (%q): %w", i, k.Kid, err)
+		}
+		keys = append(keys, parsed)
+	}
+	f.keys = keys
+	f.modTime = info.ModTime()
+	return nil
+}
+
+// Load reads the file, checking that it holds valid keys.
+func (f *JWKSFile) Load() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.reload()
+}
+
+// keysFor returns the keys that may have signed a token with the header
+// given: the key named by kid, or every key of the algorithm when the token
+// names none.
+func (f *JWKSFile) keysFor(alg, kid string) []verificationKey {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.reload(); err != nil {
+		// a broken file keeps the keys last read, tokens keep being verified
+		// while it is fixed
+		slog.Warn("Could not read JWKS file, keeping the keys last read", "file", f.file, "error", err)
+	}
+	var keys []verificationKey
+	for _, k := range f.keys {
+		if k.alg == alg && (kid == "" || k.kid == kid) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// TokenVerifier authenticates JSON Web Tokens issued by a gateway.
+type TokenVerifier struct {
+	Keys *JWKSFile
+	// required iss claim
+	Issuer string
+	// value required among the aud claim
+	Audience string
+	// claims holding the tenant and the scopes of the token
+	TenantClaim string
+	ScopeClaim  string
+	// tolerated clock skew when checking exp and nbf
+	Leeway time.Duration
+
+	now func() time.Time
+}
+
+const (
+	DefaultTenantClaim = "tenant"
+	DefaultScopeClaim  = "scope"
+)
+
+// looksLikeToken tells compact JWTs apart from API keys.
+func looksLikeToken(secret string) bool {
+	return strings.Count(secret, ".") == 2
+}
+
+func tokenError(reason string) error {
+	return fmt.Errorf("%w: %v", ErrInvalidCredentials, reason)
+}
+
+// Verify checks the signature and the registered claims of a token and
+// returns its principal.
+func (v *TokenVerifier) Verify(token string) (Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, tokenError("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if content, err := decodeSegment(parts[0]); err != nil || json.Unmarshal(content, &header) != nil {
+		return Principal{}, tokenError("malformed token header")
+	}
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return Principal{}, tokenError("malformed token signature")
+	}
+	switch header.Alg {
+	case HS256, RS256, ES256:
+	default:
+		return Principal{}, tokenError(fmt.Sprintf("unsupported algorithm %q", header.Alg))
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range v.Keys.keysFor(header.Alg, header.Kid) {
+		if key.verify(signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return Principal{}, tokenError("invalid token signature")
+	}
+
+	var claims map[string]any
+	content, err := decodeSegment(parts[1])
+	if err != nil {
+		return Principal{}, tokenError("malformed token claims")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return Principal{}, tokenError("malformed token claims")
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return Principal{}, err
+	}
+	return v.principal(claims)
+}
+
+func (k verificationKey) verify(signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch key := k.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	}
+	return false
+}
+
+// numericDate reads a NumericDate claim, ok is false when it is missing.
+func numericDate(claims map[string]any, name string) (time.Time, bool, error) {
+	value, present := claims[name]
+	if !present {
+		return time.Time{}, false, nil
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, true, tokenError(fmt.Sprintf("invalid %v claim", name))
+	}
+	seconds, err := number.Float64()
+	if err != nil || seconds < 0 || seconds > 1<<40 {
+		return time.Time{}, true, tokenError(fmt.Sprintf("invalid %v claim", name))
+	}
+	return time.Unix(int64(seconds), 0), true, nil
+}
+
+// stringList reads a claim holding a string or a list of strings.
+func stringList(value any) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func (v *TokenVerifier) checkClaims(claims map[string]any) error {
+	now := time.Now()
+	if v.now != nil {
+		now = v.now()
+	}
+
+	exp, ok, err := numericDate(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return tokenError("token without exp claim")
+	}
+	if !now.Before(exp.Add(v.Leeway)) {
+		return tokenError("token expired")
+	}
+	nbf, ok, err := numericDate(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(v.Leeway).Before(nbf) {
+		return tokenError("token not valid yet")
+	}
+
+	if iss, _ := claims["iss"].(string); v.Issuer != "" && iss != v.Issuer {
+		return tokenError(fmt.Sprintf("token issuer %q is not accepted", iss))
+	}
+	if v.Audience != "" {
+		accepted := false
+		for _, aud := range stringList(claims["aud"]) {
+			accepted = accepted || aud == v.Audience
+		}
+		if !accepted {
+			return tokenError("token is not issued for this audience")
+		}
+	}
+	return nil
+}
+
+// tokenKeyPrefix namespaces the KeyId of token principals.
+const tokenKeyPrefix = "jwt:"
+
+// principal maps the claims of a verified token. The subject identifies the
+// client, its KeyId is prefixed with jwt: so that it never collides with the
+// id of an API key; scopes are read from a space or comma separated string
+// or a list, those unknown to this server are ignored; a token without a
+// tenant claim is for the DefaultTenant, and a token cannot grant AnyTenant.
+func (v *TokenVerifier) principal(claims map[string]any) (Principal, error) {
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return Principal{}, tokenError("token without sub claim")
+	}
+	p := Principal{KeyId: tokenKeyPrefix + subject, Name: subject, Tenant: DefaultTenant}
+
+	scopeClaim := v.ScopeClaim
+	if scopeClaim == "" {
+		scopeClaim = DefaultScopeClaim
+	}
+	for _, value := range stringList(claims[scopeClaim]) {
+		for _, s := range strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' }) {
+			if scope, err := NewScope(s); err == nil {
+				p.Scopes = append(p.Scopes, scope)
+			}
+		}
+	}
+
+	tenantClaim := v.TenantClaim
+	if tenantClaim == "" {
+		tenantClaim = DefaultTenantClaim
+	}
+	if value, present := claims[tenantClaim]; present {
+		name, _ := value.(string)
+		tenant, err := NewTenant(name)
+		if err != nil || tenant == AnyTenant {
+			return Principal{}, tokenError(fmt.Sprintf("invalid %v claim", tenantClaim))
+		}
+		p.Tenant = tenant
+	}
+	return p, nil
+}
@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+// signToken signs the claims with key: a []byte for HS256, an RSA or an
+// ECDSA private key.
+func signToken(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatalf("Could not sign token: %v", err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + b64.EncodeToString(signature)
+}
+
+type testJWKS struct {
+	hmacKey []byte
+	rsaKey  *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+}
+
+func newTestJWKS(t *testing.T) testJWKS {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate EC key: %v", err)
+	}
+	return testJWKS{hmacKey: []byte("0123456789abcdef0123456789abcdef"), rsaKey: rsaKey, ecKey: ecKey}
+}
+
+func (k testJWKS) write(t *testing.T, file string) {
+	t.Helper()
+	ecPublic := k.ecKey.PublicKey
+	set := map[string]any{"keys": []map[string]string{
+		{"kty": "oct", "kid": "hs", "alg": HS256, "k": b64.EncodeToString(k.hmacKey)},
+		{"kty": "RSA", "kid": "rs", "use": "sig", "n": b64.EncodeToString(k.rsaKey.N.Bytes()),
+			"e": b64.EncodeToString(big.NewInt(int64(k.rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "es", "crv": "P-256",
+			"x": b64.EncodeToString(ecPublic.X.FillBytes(make([]byte, 32))),
+			"y": b64.EncodeToString(ecPublic.Y.FillBytes(make([]byte, 32)))},
+	}}
+	content, _ := json.Marshal(set)
+	if err := os.WriteFile(file, content, 0600); err != nil {
+		t.Fatalf("Could not write JWKS: %v", err)
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	keys := newTestJWKS(t)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	keys.write(t, file)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	v := &TokenVerifier{Keys: OpenJWKSFile(file), Issuer: "https://gateway", Audience: "wex",
+		Leeway: time.Minute, now: func() time.Time { return now }}
+
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"sub": "reporting", "iss": "https://gateway", "aud": []string{"other", "wex"},
+			"exp": now.Add(time.Hour).Unix(), "nbf": now.Add(-time.Hour).Unix(),
+			"scope": "read convert billing", "tenant": "acme",
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(c, name)
+			} else {
+				c[name] = value
+			}
+		}
+		return c
+	}
+	otherRSA, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"HS256", signToken(t, HS256, "hs", keys.hmacKey, claims(nil)), true},
+		{"RS256", signToken(t, RS256, "rs", keys.rsaKey, claims(nil)), true},
+		{"ES256", signToken(t, ES256, "es", keys.ecKey, claims(nil)), true},
+		{"without kid", signToken(t, ES256, "", keys.ecKey, claims(nil)), true},
+		{"within leeway", signToken(t, RS256, "rs", keys.rsaKey, claims(map[string]any{"exp": now.Add(-30 * time.Second).Unix()})), true},
+		{"single audience", signToken(t, RS256, "rs", keys.rsaKey, claims(map[string]any{"aud": "wex"})), true},
+
+		{"expired", signToken(t, RS256, "rs", keys.rsaKey, claims(map[string]any{"exp": now.Add(-time.Hour).Unix()})), false},
+		{"without exp", signToken(t, RS256, "rs", keys.rsaKey, claims(map[string]any{"exp": nil})), false},
+		{"not valid yet", signToken(t, RS256, "rs", keys.rsaKey, claims(map[string]any{"nbf": now.Add(time.Hour).Unix()})), false},
+		{"other issuer", signToken(t, RS256, "rs", keys.rsaKey, claims(map[string]any{"iss": "https://evil"})), false},
+		{"other audience", signToken(t, RS256, "rs", keys.rsaKey, claims(map[string]any{"aud": "other"})), false},
+		{"without sub", signToken(t, RS256, "rs", keys.rsaKey, claims(map[string]any{"sub": nil})), false},
+		{"invalid tenant", signToken(t, RS256, "rs", keys.rsaKey, claims(map[string]any{"tenant": "../acme"})), false},
+		{"any tenant", signToken(t, RS256, "rs", keys.rsaKey, claims(map[string]any{"tenant": AnyTenant})), false},
+		{"unknown key", signToken(t, RS256, "rs", otherRSA, claims(nil)), false},
+		{"unknown kid", signToken(t, RS256, "missing", keys.rsaKey, claims(nil)), false},
+		// an HMAC keyed with public material must not pass for the RSA key
+		{"algorithm confusion", signToken(t, HS256, "rs", []byte(b64.EncodeToString(keys.rsaKey.N.Bytes())), claims(nil)), false},
+		{"none", strings.Join(strings.Split(signToken(t, "none", "", []byte{}, claims(nil)), ".")[:2], ".") + ".", false},
+		{"tampered", signToken(t, HS256, "hs", keys.hmacKey, claims(nil))[:40] + "x" +
+			signToken(t, HS256, "hs", keys.hmacKey, claims(nil))[41:], false},
+		{"malformed", "a.b.c", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := v.Verify(test.token)
+			if !test.valid {
+				if !errors.Is(err, ErrInvalidCredentials) {
+					t.Errorf("Error differs from expected: received (%v); expected (%v)", err, ErrInvalidCredentials)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Received error for valid token: %v", err)
+			}
+			if p.KeyId != "jwt:reporting" || p.Tenant != "acme" || !p.Has(ScopeRead) || !p.Has(ScopeConvert) || p.Has(ScopeWrite) {
+				t.Errorf("Unexpected principal %+v", p)
+			}
+		})
+	}
+}
+
+func TestJWKSReload(t *testing.T) {
+	keys := newTestJWKS(t)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	keys.write(t, file)
+	v := &TokenVerifier{Keys: OpenJWKSFile(file)}
+	claims := map[string]any{"sub": "ci", "exp": time.Now().Add(time.Hour).Unix()}
+
+	if _, err := v.Verify(signToken(t, ES256, "es", keys.ecKey, claims)); err != nil {
+		t.Fatalf("Received error for valid token: %v", err)
+	}
+
+	rotated := newTestJWKS(t)
+	rotated.write(t, file)
+	// the modification time has to change for the file to be read again
+	later := time.Now().Add(time.Second)
+	os.Chtimes(file, later, later)
+
+	if _, err := v.Verify(signToken(t, ES256, "es", keys.ecKey, claims)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Token signed with a removed key accepted: %v", err)
+	}
+	if _, err := v.Verify(signToken(t, ES256, "es", rotated.ecKey, claims)); err != nil {
+		t.Errorf("Token signed with a new key refused: %v", err)
+	}
+
+	// a broken file keeps the keys last read
+	os.WriteFile(file, []byte("{"), 0600)
+	later = later.Add(time.Second)
+	os.Chtimes(file, later, later)
+	if _, err := v.Verify(signToken(t, ES256, "es", rotated.ecKey, claims)); err != nil {
+		t.Errorf("Token refused while the JWKS file is broken: %v", err)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	keys := newTestJWKS(t)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	keys.write(t, file)
+	a := Authenticator{Keys: mapKeyStore{}, Tokens: &TokenVerifier{Keys: OpenJWKSFile(file), Audience: "wex"}}
+
+	var principal Principal
+	handler := a.Require(ScopeConvert, func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = PrincipalFrom(r.Context())
+	})
+	token := func(scope string) string {
+		return signToken(t, RS256, "rs", keys.rsaKey, map[string]any{"sub": "gateway-client", "aud": "wex",
+			"exp": time.Now().Add(time.Hour).Unix(), "scope": scope, "tenant": "acme"})
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"granted", token("read convert"), http.StatusOK},
+		{"missing scope", token("read"), http.StatusForbidden},
+		{"invalid token", token("convert") + "x", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			principal = Principal{}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+test.token)
+			res := httptest.NewRecorder()
+			handler(res, req)
+			if res.Code != test.status {
+				t.Fatalf("got status %d but expected %d", res.Code, test.status)
+			}
+			if test.status == http.StatusOK && (principal.KeyId != "jwt:gateway-client" || principal.Tenant != "acme") {
+				t.Errorf("principal not exposed to handler, got %+v", principal)
+			}
+		})
+	}
+
+	// tokens are refused when they are not configured
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token("convert"))
+	res := httptest.NewRecorder()
+	Authenticator{Keys: mapKeyStore{}}.Require(ScopeConvert, handler)(res, req)
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d but expected %d without token verification", res.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"wex/src/logging"
+)
+
+// KeyStore holds the API keys.
+type KeyStore interface {
+	QueryKey(id string) (APIKey, error)
+}
+
+var (
+	ErrMissingCredentials = errors.New("Missing API key")
+	ErrInvalidCredentials = errors.New("Invalid API key")
+)
+
+// TenantHeader chooses the tenant of a request made with a key granted
+// AnyTenant.
+const TenantHeader = "X-Tenant"
+
+type Authenticator struct {
+	Keys KeyStore
+	// Tokens verifies JSON Web Tokens, nil when only API keys are accepted
+	Tokens *TokenVerifier
+	// Sessions of the browsers logged in to the web UI, nil when there is
+	// no UI
+	Sessions *Sessions
+	// Disabled lets every request through with every scope, for local
+	// development only.
+	Disabled bool
+}
+
+var anonymous = Principal{Name: "anonymous", Tenant: AnyTenant,
+	Scopes: []Scope{ScopeRead, ScopeWrite, ScopeConvert, ScopeAdmin}}
+
+// Authenticate reads the API key or token from the Authorization header
+// (Bearer scheme) or the X-API-Key header. The web UI cookie is not
+// accepted: browsers send it along with requests made by any site, and only
+// the UI forms are protected against those.
+func (a Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	if a.Disabled {
+		return anonymous, nil
+	}
+
+	secret := r.Header.Get("X-API-Key")
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, _ := strings.Cut(header, " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			return Principal{}, ErrInvalidCredentials
+		}
+		secret = strings.TrimSpace(token)
+	}
+	if secret == "" {
+		return Principal{}, ErrMissingCredentials
+	}
+	return a.Check(secret)
+}
+
+// AuthenticateSession reads the session of a browser logged in to the web
+// UI from its cookie.
+func (a Authenticator) AuthenticateSession(r *http.Request) (Principal, error) {
+	if a.Disabled {
+		return anonymous, nil
+	}
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil || a.Sessions == nil {
+		return Principal{}, ErrMissingCredentials
+	}
+	secret, ok := a.Sessions.secret(cookie.Value)
+	if !ok {
+		return Principal{}, ErrInvalidCredentials
+	}
+	return a.Check(secret)
+}
+
+// Check returns the principal of an API key or, when tokens are accepted,
+// of a JSON Web Token.
+func (a Authenticator) Check(secret string) (Principal, error) {
+	id, ok := keyId(secret)
+	if !ok && a.Tokens != nil && looksLikeToken(secret) {
+		return a.Tokens.Verify(secret)
+	}
+	if !ok {
+		return Principal{}, ErrInvalidCredentials
+	}
+	key, err := a.Keys.QueryKey(id)
+	if err != nil || key.Revoked() || !key.matches(secret) {
+		return Principal{}, ErrInvalidCredentials
+	}
+	return Principal{KeyId: key.Id, Name: key.Name, Scopes: key.Scopes, Tenant: key.TenantName()}, nil
+}
+
+// selectTenant sets the tenant the request is made for: the one of the key,
+// or the one chosen with the TenantHeader when the key is granted AnyTenant.
+func selectTenant(r *http.Request, p Principal) (Principal, error) {
+	requested := r.Header.Get(TenantHeader)
+	if requested == "" {
+		if p.Tenant == AnyTenant {
+			p.Tenant = DefaultTenant
+		}
+		return p, nil
+	}
+	tenant, err := NewTenant(requested)
+	if err != nil || tenant == AnyTenant {
+		return p, fmt.Errorf("%v: %w", requested, ErrTenant)
+	}
+	if p.Tenant != AnyTenant && p.Tenant != tenant {
+		return p, fmt.Errorf("API key %v is not granted the %v tenant", p.Name, tenant)
+	}
+	p.Tenant = tenant
+	return p, nil
+}
+
+// authorize checks the principal is granted scope and the tenant requested,
+// writing the error response otherwise.
+func authorize(w http.ResponseWriter, r *http.Request, p Principal, scope Scope) (Principal, bool) {
+	if !p.Has(scope) {
+		deny(w, r, http.StatusForbidden, fmt.Sprintf("API key %v is not granted the %v scope", p.Name, scope))
+		return p, false
+	}
+	p, err := selectTenant(r, p)
+	if errors.Is(err, ErrTenant) {
+		deny(w, r, http.StatusBadRequest, err.Error())
+		return p, false
+	}
+	if err != nil {
+		deny(w, r, http.StatusForbidden, err.Error())
+		return p, false
+	}
+	return p, true
+}
+
+func deny(w http.ResponseWriter, r *http.Request, status int, reason string) {
+	message := fmt.Sprintf("%v: %v", http.StatusText(status), reason)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="wex"`)
+	}
+	http.Error(w, message, status)
+	logging.FromContext(r.Context()).Info("Request denied", "status", status, "reason", reason)
+}
+
+// Require lets through the requests authenticated with a key granted scope
+// and the tenant requested, exposing its principal through the request
+// context.
+func (a Authenticator) Require(scope Scope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			deny(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		p, ok := authorize(w, r, p, scope)
+		if !ok {
+			return
+		}
+		next(w, r.WithContext(WithPrincipal(r.Context(), p)))
+	}
+}
+
+// RequireLogin is Require for web UI pages, authenticated by their session:
+// browsers without a valid one are sent to loginPath, coming back once
+// logged in.
+func (a Authenticator) RequireLogin(scope Scope, loginPath string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.AuthenticateSession(r)
+		if err != nil {
+			target := loginPath + "?" + url.Values{"next": {r.URL.RequestURI()}}.Encode()
+			http.Redirect(w, r, target, http.StatusSeeOther)
+			return
+		}
+		p, ok := authorize(w, r, p, scope)
+		if !ok {
+			return
+		}
+		next(w, r.WithContext(WithPrincipal(r.Context(), p)))
+	}
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// SessionCookie holds the session of browsers logged in to the web UI.
+const SessionCookie = "wex_session"
+
+// SessionTTL is how long a web UI login lasts.
+const SessionTTL = 12 * time.Hour
+
+// Sessions keeps the key or token browsers logged in with, so that their
+// cookie holds a random session token rather than the secret itself. The
+// secret is checked again on every request, revoked keys end their sessions.
+type Sessions struct {
+	mu       sync.Mutex
+	sessions map[string]session
+}
+
+type session struct {
+	secret  string
+	expires time.Time
+}
+
+func NewSessions() *Sessions {
+	return &Sessions{sessions: make(map[string]session)}
+}
+
+// Start returns the token of a new session logged in with secret.
+func (s *Sessions) Start(secret string) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for t, expired := range s.sessions {
+		if now.After(expired.expires) {
+			delete(s.sessions, t)
+		}
+	}
+	s.sessions[token] = session{secret: secret, expires: now.Add(SessionTTL)}
+	return token
+}
+
+// secret returns the secret of the session of token, while it lasts.
+func (s *Sessions) secret(token string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[token]
+	if !ok || time.Now().After(session.expires) {
+		return "", false
+	}
+	return session.secret, true
+}
+
+// End logs the session of token out.
+func (s *Sessions) End(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"wex/src/application"
+	"wex/src/external"
+	"wex/src/logging"
+	"wex/src/persistance"
+)
+
+// most transaction ids accepted by a single bulk conversion request
+const maxBulkTransactions = 10000
+
+type bulkConversionRequest struct {
+	TransactionIds []string `json:"transactionIds"`
+	// filter used when no transaction ids are given
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Description string `json:"description"`
+
+	Currency   string `json:"currency"`
+	Policy     string `json:"policy"`
+	Window     int    `json:"window"`
+	RecordDate string `json:"recordDate"`
+}
+
+type bulkConversion struct {
+	Uid             string `json:"uid"`
+	TransactionDate string `json:"transactionDate,omitempty"`
+	OriginalValue   string `json:"originalValue,omitempty"`
+	currencyConversion
+}
+
+// rateRange groups transactions whose rate windows overlap, so that a single
+// upstream query covers all of them.
+type rateRange struct {
+	from, to     application.Time
+	transactions []application.IdentifiedTransaction
+}
+
+// groupRateRanges sorts the transactions by date and merges their rate
+// windows into disjoint ranges.
+func groupRateRanges(transactions []application.IdentifiedTransaction,
+	selection application.RateSelection) []rateRange {
+
+	sort.SliceStable(transactions, func(i, j int) bool {
+		return transactions[i].Date.Before(transactions[j].Date.Time)
+	})
+
+	var ranges []rateRange
+	for _, transaction := range transactions {
+		from, to := selection.Window(transaction.Date)
+		if n := len(ranges); n > 0 && !from.After(ranges[n-1].to.AddDate(0, 0, 1)) {
+			last := &ranges[n-1]
+			if to.After(last.to.Time) {
+				last.to = to
+			}
+			last.transactions = append(last.transactions, transaction)
+			continue
+		}
+		ranges = append(ranges, rateRange{
+			from:         from,
+			to:           to,
+			transactions: []application.IdentifiedTransaction{transaction},
+		})
+	}
+	return ranges
+}
+
+func getBulkConvert(tenants persistance.Tenants,
+	middleware external.FiscalDataInterface,
+	catalog external.CurrencyCatalogInterface,
+	defaults application.RateSelection) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			badRequest(w, r, "Unsupported method")
+			return
+		}
+
+		var req bulkConversionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			badRequest(w, r, "Could not parse request body")
+			return
+		}
+		if len(req.TransactionIds) > maxBulkTransactions {
+			badRequest(w, r, fmt.Sprintf("at most %v transaction ids can be converted at once", maxBulkTransactions))
+			return
+		}
+
+		driver := tenantDriver(tenants, r)
+		settings, tenantDefaults := tenantSettings(tenants, r, defaults)
+		if req.Currency == "" {
+			req.Currency = settings.Currency
+		}
+
+		target, err := resolveCurrency(r.Context(), catalog, "", req.Currency)
+		if err != nil {
+			badRequest(w, r, err.Error())
+			return
+		}
+
+		window := ""
+		if req.Window != 0 {
+			window = strconv.Itoa(req.Window)
+		}
+		selection, err := newRateSelection(req.Policy, window, req.RecordDate, tenantDefaults)
+		if err != nil {
+			badRequest(w, r, err.Error())
+			return
+		}
+
+		var results []bulkConversion
+		var transactions []application.IdentifiedTransaction
+		if len(req.TransactionIds) > 0 {
+			for _, uid := range req.TransactionIds {
+				transaction, err := driver.QueryTransaction(r.Context(), uid)
+				if err != nil {
+					results = append(results, bulkConversion{Uid: uid,
+						currencyConversion: currencyConversion{Currency: target.CountryCurrency, Error: err.Error()}})
+					continue
+				}
+				transactions = append(transactions, transaction)
+			}
+		} else {
+			filter, err := application.NewTransactionFilter(req.From, req.To, req.Description)
+			if err != nil {
+				badRequest(w, r, err.Error())
+				return
+			}
+			transactions, err = driver.ListTransactions(r.Context(), filter)
+			if err != nil {
+				storageUnavailable(w, r, err)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+
+		for _, result := range results {
+			encoder.Encode(result)
+		}
+
+		converted, failed := 0, len(results)
+		for _, group := range groupRateRanges(transactions, selection) {
+			rates, queryErr := middleware.QueryRates(r.Context(),
+				[]string{target.CountryCurrency}, group.from, group.to)
+			if queryErr != nil {
+				logging.FromContext(r.Context()).Warn("Could not query rates",
+					"currencies", []string{target.CountryCurrency}, "error", queryErr)
+			}
+
+			for _, transaction := range group.transactions {
+				result := bulkConversion{
+					Uid:                transaction.Uid,
+					TransactionDate:    transaction.Date.ToString(),
+					OriginalValue:      transaction.Amount.ToString(),
+					currencyConversion: currencyConversion{Currency: target.CountryCurrency},
+				}
+
+				if queryErr != nil {
+					result.Error = "error getting conversion rate"
+				} else if rate, err := selection.Select(rates, transaction.Date); err != nil {
+					from, to := selection.Window(transaction.Date)
+					result.Error = fmt.Sprintf("no conversion rate is available between %v and %v (%v policy)",
+						from.ToString(), to.ToString(), selection.Policy)
+				} else {
+					conversion := application.NewConversion(
+						transaction, rate, selection.Policy, external.TreasuryProvider)
+					recordConversion(r.Context(), driver, conversion)
+					result.currencyConversion = newCurrencyConversion(conversion, false)
+				}
+
+				if result.Error != "" {
+					failed++
+				} else {
+					converted++
+				}
+				encoder.Encode(result)
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		logging.FromContext(r.Context()).Info("Bulk conversion done", "currency", target.CountryCurrency,
+			"converted", converted, "failed", failed)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"wex/src/application"
+	"wex/src/logging"
+	"wex/src/metrics"
+	"wex/src/persistance"
+	"wex/src/tracing"
+)
+
+type bulkMockDriver struct {
+	MockDriver
+	transactions map[string]application.IdentifiedTransaction
+}
+
+func newBulkMockDriver(dates ...string) bulkMockDriver {
+	d := bulkMockDriver{transactions: make(map[string]application.IdentifiedTransaction)}
+	for _, date := range dates {
+		tran, _ := application.NewTransaction("bulk", date, "10.00")
+		d.transactions[date] = application.IdentifiedTransaction{Transaction: tran, Uid: date}
+	}
+	return d
+}
+
+func (d bulkMockDriver) QueryTransaction(ctx context.Context, uid string) (application.IdentifiedTransaction, error) {
+	if tran, ok := d.transactions[uid]; ok {
+		return tran, nil
+	}
+	return application.IdentifiedTransaction{}, persistance.QueryNotFoundError
+}
+
+func (d bulkMockDriver) ListTransactions(ctx context.Context, filter application.TransactionFilter) ([]application.IdentifiedTransaction, error) {
+	var transactions []application.IdentifiedTransaction
+	for _, tran := range d.transactions {
+		if filter.Matches(tran) {
+			transactions = append(transactions, tran)
+		}
+	}
+	return transactions, nil
+}
+
+// countingExternalApi records the windows requested and answers with a rate
+// on the last day of each window.
+type countingExternalApi struct {
+	MockExternalApi
+	windows *[][2]string
+}
+
+func (m countingExternalApi) QueryRates(ctx context.Context,
+	currencies []string, from, to application.Time) ([]application.ExchangeRate, error) {
+	*m.windows = append(*m.windows, [2]string{from.ToString(), to.ToString()})
+	rate, err := application.NewExchangeRate(currencies[0], "2.0", to.ToString())
+	return []application.ExchangeRate{rate}, err
+}
+
+func readBulkResults(t *testing.T, res *httptest.ResponseRecorder) map[string]bulkConversion {
+	results := make(map[string]bulkConversion)
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		var result bulkConversion
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			t.Fatalf("Could not parse result line %v: %v", scanner.Text(), err)
+		}
+		results[result.Uid] = result
+	}
+	return results
+}
+
+func TestBulkConvertGroupsRateWindows(t *testing.T) {
+	driver := newBulkMockDriver("2023-01-15", "2023-03-01", "2023-02-10", "2020-06-01")
+	var windows [][2]string
+	middleware := countingExternalApi{windows: &windows}
+
+	body := `{"transactionIds":["2023-01-15","2023-03-01","2023-02-10","2020-06-01","missing"],"currency":"mexico peso"}`
+	req := httptest.NewRequest(http.MethodPost, "/bulkConvert", strings.NewReader(body))
+	res := httptest.NewRecorder()
+
+	getBulkConvert(oneTenant(driver), middleware, MockCatalog{}, testRateSelection)(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d but expected %d", res.Code, http.StatusOK)
+	}
+	if res.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("unexpected content type %v", res.Header().Get("Content-Type"))
+	}
+
+	expectedWindows := [][2]string{
+		{"2019-12-01", "2020-06-01"},
+		{"2022-07-15", "2023-03-01"},
+	}
+	if len(windows) != len(expectedWindows) {
+		t.Fatalf("expected %v upstream queries but got %v", expectedWindows, windows)
+	}
+	for i := range expectedWindows {
+		if windows[i] != expectedWindows[i] {
+			t.Errorf("expected window %v but got %v", expectedWindows[i], windows[i])
+		}
+	}
+
+	results := readBulkResults(t, res)
+	if len(results) != 5 {
+		t.Fatalf("expected 5 results but got %v", results)
+	}
+	if results["missing"].Error == "" {
+		t.Errorf("expected error for missing transaction")
+	}
+	// only the most recent transaction has the rate published at the end of
+	// the shared window on or before its date
+	if results["2023-03-01"].ConvertedValue != "20.00" {
+		t.Errorf("unexpected conversion %v", results["2023-03-01"])
+	}
+	if results["2023-01-15"].Error == "" {
+		t.Errorf("expected no rate before 2023-01-15, got %v", results["2023-01-15"])
+	}
+}
+
+func TestBulkConvertFilter(t *testing.T) {
+	driver := newBulkMockDriver("2023-01-15", "2023-03-01", "2020-06-01")
+	var windows [][2]string
+	middleware := countingExternalApi{windows: &windows}
+
+	body := `{"from":"2023-01-01","to":"2023-12-31","currency":"MXN","policy":"nearest","window":1}`
+	req := httptest.NewRequest(http.MethodPost, "/bulkConvert", strings.NewReader(body))
+	res := httptest.NewRecorder()
+
+	getBulkConvert(oneTenant(driver), middleware, MockCatalog{}, testRateSelection)(res, req)
+
+	results := readBulkResults(t, res)
+	if len(results) != 2 {
+		t.Errorf("expected 2 results but got %v", results)
+	}
+	// nearest windows of both transactions overlap
+	if len(windows) != 1 {
+		t.Errorf("expected a single upstream query but got %v", windows)
+	}
+}
+
+func TestBulkConvertBadRequest(t *testing.T) {
+	for _, body := range []string{
+		`not json`,
+		`{"currency":"yen"}`,
+		`{"currency":"MXN","policy":"oldest"}`,
+		`{"currency":"MXN","from":"not a date"}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/bulkConvert", strings.NewReader(body))
+		res := httptest.NewRecorder()
+
+		getBulkConvert(oneTenant(newBulkMockDriver()), MockExternalApi{}, MockCatalog{}, testRateSelection)(res, req)
+
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("got status %d but expected %d for %v", res.Code, http.StatusBadRequest, body)
+		}
+	}
+}
+
+func TestBulkConvertFlushesThroughMiddlewares(t *testing.T) {
+	driver := newBulkMockDriver("2023-01-15", "2020-06-01")
+	var windows [][2]string
+	requests := metrics.NewRequests(metrics.NewRegistry())
+	handler := tracing.Middleware("/bulkConvert", logging.Middleware("/bulkConvert",
+		requests.Middleware("/bulkConvert",
+			getBulkConvert(oneTenant(driver), countingExternalApi{windows: &windows}, MockCatalog{}, testRateSelection))))
+
+	body := `{"transactionIds":["2023-01-15","2020-06-01"],"currency":"mexico peso"}`
+	req := httptest.NewRequest(http.MethodPost, "/bulkConvert", strings.NewReader(body))
+	res := httptest.NewRecorder()
+	handler(res, req)
+
+	if res.Code != http.StatusOK || !res.Flushed {
+		t.Errorf("bulk conversion not streamed through the middlewares: %d flushed %v", res.Code, res.Flushed)
+	}
+	if results := readBulkResults(t, res); len(results) != 2 {
+		t.Errorf("expected 2 results but got %v", results)
+	}
+}
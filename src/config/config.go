@@ -0,0 +1,445 @@
+// Package config loads the server configuration from command line flags,
+// environment variables and an optional json file.
+//
+// Every option is a flag. The environment variable of an option is its flag
+// name in upper case with dashes turned into underscores and a WEX_ prefix
+// (-treasury-api is WEX_TREASURY_API). The config file is a json object keyed
+// by flag name. Flags take precedence over environment variables, which take
+// precedence over the config file, which takes precedence over the defaults.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"wex/src/application"
+	"wex/src/auth"
+	"wex/src/external"
+	"wex/src/health"
+	"wex/src/logging"
+	"wex/src/persistance"
+	"wex/src/ratelimit"
+)
+
+const envPrefix = "WEX_"
+
+// configFlag names the option holding the config file, it cannot be set
+// from the file itself.
+const configFlag = "config"
+
+type Config struct {
+	Addr        string
+	StorageFile string
+	UIDir       string
+	// API keys are required, disabling it is meant for local development
+	Auth bool
+
+	// registrations waiting to be written beyond which new ones are refused,
+	// and whether registrations wait until written
+	StorageQueue  int
+	DurableWrites bool
+	// comma separated tenants served before anything is stored for them,
+	// and the number of tenants loaded at once
+	Tenants    string
+	MaxTenants int
+
+	// logs are written to stderr as text or json records of LogLevel or above
+	LogFormat string
+	LogLevel  string
+
+	// spans are exported as OTLP-JSON to TraceFile or to the collector at
+	// TraceEndpoint, only propagated when neither is set
+	TraceFile     string
+	TraceEndpoint string
+
+	// JSON Web Tokens are accepted along with API keys when JWKSFile is set
+	JWKSFile       string
+	JWTIssuer      string
+	JWTAudience    string
+	JWTTenantClaim string
+	JWTScopeClaim  string
+	JWTLeeway      time.Duration
+
+	// requests per second of each API key and of each client address, with
+	// per route overrides written route=rate:burst
+	ClientRate        float64
+	ClientBurst       int
+	ClientRouteLimits string
+	IPRate            float64
+	IPBurst           int
+	IPRouteLimits     string
+	// header holding the client address when behind a proxy
+	ClientIPHeader string
+
+	TreasuryApi   string
+	TreasuryRate  float64
+	TreasuryBurst int
+
+	RatePolicy string
+	RateWindow int
+	// years of rates a /rates request may span at most
+	RateSeriesYears int
+
+	RateCacheTTL       time.Duration
+	PrefetchCurrencies string
+	PrefetchInterval   time.Duration
+	PrefetchMonths     int
+
+	// comma separated checks that decide readiness, every check is reported
+	ReadyChecks  string
+	ReadyTimeout time.Duration
+}
+
+func Default() Config {
+	return Config{
+		Addr:              ":3333",
+		StorageFile:       defaultStorageFile(),
+		StorageQueue:      persistance.DefaultQueueSize,
+		MaxTenants:        persistance.DefaultMaxTenants,
+		Auth:              true,
+		LogFormat:         logging.TextFormat,
+		LogLevel:          "info",
+		JWTTenantClaim:    auth.DefaultTenantClaim,
+		JWTScopeClaim:     auth.DefaultScopeClaim,
+		JWTLeeway:         time.Minute,
+		ClientRate:        10,
+		ClientBurst:       20,
+		ClientRouteLimits: "/convertTransaction=2:10,/bulkConvert=0.1:2",
+		IPRate:            20,
+		IPBurst:           40,
+		IPRouteLimits:     "/login=0.2:5",
+		TreasuryApi:       external.TreasuryApi,
+		TreasuryRate:      4,
+		TreasuryBurst:     8,
+		RatePolicy:        string(application.LatestRate),
+		RateWindow:        application.DefaultRateWindow,
+		RateSeriesYears:   10,
+		RateCacheTTL:      external.DefaultRateCacheTTL,
+		PrefetchInterval:  6 * time.Hour,
+		PrefetchMonths:    external.DefaultPrefetchMonths,
+		ReadyChecks:       "storage,persist,rates",
+		ReadyTimeout:      health.DefaultTimeout,
+	}
+}
+
+// defaultStorageFile resolves persistance.DefaultStorageFile against the
+// directory of the executable, so that the same storage is used whatever
+// directory the server is started from.
+func defaultStorageFile() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return persistance.DefaultStorageFile
+	}
+	if resolved, err := filepath.EvalSymlinks(executable); err == nil {
+		executable = resolved
+	}
+	return filepath.Join(filepath.Dir(executable), persistance.DefaultStorageFile)
+}
+
+// pathOptions name files or directories; relative paths in the config file
+// are resolved against its directory.
+var pathOptions = map[string]bool{"storage-file": true, "ui-dir": true, "trace-file": true, "jwks-file": true}
+
+func (c *Config) flagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.String(configFlag, "", "json config file")
+	flags.StringVar(&c.Addr, "addr", c.Addr, "address the server listens on")
+	flags.StringVar(&c.StorageFile, "storage-file", c.StorageFile, "json file the transactions are stored in")
+	flags.IntVar(&c.StorageQueue, "storage-queue", c.StorageQueue,
+		"registrations waiting to be written beyond which new ones are refused with 503")
+	flags.BoolVar(&c.DurableWrites, "durable-writes", c.DurableWrites,
+		"answer registrations once written to the storage file rather than once stored in memory")
+	flags.StringVar(&c.Tenants, "tenants", c.Tenants,
+		"comma separated tenants served before anything is stored for them, e.g. acme,globex")
+	flags.IntVar(&c.MaxTenants, "max-tenants", c.MaxTenants,
+		"tenants loaded at once beyond which requests for new ones are refused with 503")
+	flags.BoolVar(&c.Auth, "auth", c.Auth, "require API keys, false lets every request through (development only)")
+	flags.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log format: text or json")
+	flags.StringVar(&c.LogLevel, "log-level", c.LogLevel, "least severe logs written: debug, info, warn or error")
+	flags.StringVar(&c.TraceFile, "trace-file", c.TraceFile, "file spans are appended to as OTLP-JSON lines")
+	flags.StringVar(&c.TraceEndpoint, "trace-endpoint", c.TraceEndpoint,
+		"OTLP/HTTP traces endpoint of a collector, e.g. http://localhost:4318/v1/traces")
+	flags.StringVar(&c.JWKSFile, "jwks-file", c.JWKSFile,
+		"JWKS file holding the keys bearer tokens are verified with, tokens are refused when empty")
+	flags.StringVar(&c.JWTIssuer, "jwt-issuer", c.JWTIssuer, "iss claim required in tokens")
+	flags.StringVar(&c.JWTAudience, "jwt-audience", c.JWTAudience, "aud claim required in tokens")
+	flags.StringVar(&c.JWTTenantClaim, "jwt-tenant-claim", c.JWTTenantClaim, "token claim holding the tenant")
+	flags.StringVar(&c.JWTScopeClaim, "jwt-scope-claim", c.JWTScopeClaim, "token claim holding the scopes")
+	flags.DurationVar(&c.JWTLeeway, "jwt-leeway", c.JWTLeeway, "clock skew tolerated when checking token expiry")
+	flags.Float64Var(&c.ClientRate, "client-rate", c.ClientRate,
+		"requests per second of each API key, 0 for no limit")
+	flags.IntVar(&c.ClientBurst, "client-burst", c.ClientBurst, "requests of each API key at once before limiting")
+	flags.StringVar(&c.ClientRouteLimits, "client-route-limits", c.ClientRouteLimits,
+		"per route limits of each API key, comma separated route=rate:burst")
+	flags.Float64Var(&c.IPRate, "ip-rate", c.IPRate, "requests per second of each client address, 0 for no limit")
+	flags.IntVar(&c.IPBurst, "ip-burst", c.IPBurst, "requests of each client address at once before limiting")
+	flags.StringVar(&c.IPRouteLimits, "ip-route-limits", c.IPRouteLimits,
+		"per route limits of each client address, comma separated route=rate:burst")
+	flags.StringVar(&c.ClientIPHeader, "client-ip-header", c.ClientIPHeader,
+		"header the client address is read from when behind a proxy, e.g. X-Forwarded-For")
+	flags.StringVar(&c.UIDir, "ui-dir", c.UIDir,
+		"directory the UI is served from instead of the embedded one, for UI development")
+	flags.StringVar(&c.TreasuryApi, "treasury-api", c.TreasuryApi,
+		"address of the Treasury Fiscal Data api")
+	flags.Float64Var(&c.TreasuryRate, "treasury-rate", c.TreasuryRate,
+		"requests per second sent to the Treasury api, 0 for no limit")
+	flags.IntVar(&c.TreasuryBurst, "treasury-burst", c.TreasuryBurst,
+		"requests sent to the Treasury api at once before throttling")
+	flags.StringVar(&c.RatePolicy, "rate-policy", c.RatePolicy,
+		"rate selection policy: latest, nearest or average")
+	flags.IntVar(&c.RateWindow, "rate-window", c.RateWindow,
+		"lookback window in months used to search for conversion rates")
+	flags.IntVar(&c.RateSeriesYears, "rate-series-years", c.RateSeriesYears,
+		"years of rates a /rates request may span at most")
+	flags.DurationVar(&c.RateCacheTTL, "rate-cache-ttl", c.RateCacheTTL,
+		"how long fetched rates are answered from the cache")
+	flags.StringVar(&c.PrefetchCurrencies, "prefetch-currencies", c.PrefetchCurrencies,
+		"comma separated currencies prefetched into the rate cache, defaults to those seen in past conversions")
+	flags.DurationVar(&c.PrefetchInterval, "prefetch-interval", c.PrefetchInterval,
+		"interval between rate prefetches, 0 to prefetch only on startup")
+	flags.IntVar(&c.PrefetchMonths, "prefetch-months", c.PrefetchMonths,
+		"months of rates prefetched, back from today")
+	flags.StringVar(&c.ReadyChecks, "ready-checks", c.ReadyChecks,
+		"comma separated checks that decide readiness on /readyz: storage, persist and rates, empty for none")
+	flags.DurationVar(&c.ReadyTimeout, "ready-timeout", c.ReadyTimeout, "time each readiness check is given")
+	return flags
+}
+
+// EnvName returns the environment variable of the option set by flag name.
+func EnvName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Load builds the configuration from the command line arguments (without the
+// program name) and the environment, looked up with getenv.
+func Load(name string, args []string, getenv func(string) string) (Config, error) {
+	// flags are parsed first to find the config file, and applied last
+	parsed := Default()
+	cmdline := parsed.flagSet(name)
+	cmdline.Usage = func() { Usage(cmdline.Output(), name) }
+	if err := cmdline.Parse(args); err != nil {
+		return parsed, err
+	}
+	if cmdline.NArg() > 0 {
+		return parsed, fmt.Errorf("unexpected arguments %v", cmdline.Args())
+	}
+
+	c := Default()
+	flags := c.flagSet(name)
+	flags.SetOutput(io.Discard)
+
+	file := cmdline.Lookup(configFlag).Value.String()
+	if file == "" {
+		file = getenv(EnvName(configFlag))
+	}
+	if file != "" {
+		if err := loadFile(flags, file); err != nil {
+			return c, fmt.Errorf("config file %v: %w", file, err)
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if value := getenv(EnvName(f.Name)); value != "" && err == nil && f.Name != configFlag {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%v: %w", EnvName(f.Name), setErr)
+			}
+		}
+	})
+	if err != nil {
+		return c, err
+	}
+
+	cmdline.Visit(func(f *flag.Flag) {
+		if err == nil {
+			err = flags.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return c, err
+	}
+
+	return c, c.Validate()
+}
+
+// loadFile sets the options found in a json config file. Relative paths are
+// taken from the directory of the file rather than the working directory.
+func loadFile(flags *flag.FlagSet, file string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	if err := json.Unmarshal(content, &values); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == configFlag || flags.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %v", name)
+		}
+		var value string
+		switch v := values[name].(type) {
+		case string:
+			value = v
+		case float64, bool:
+			value = fmt.Sprint(v)
+		default:
+			return fmt.Errorf("invalid value for %v", name)
+		}
+		if pathOptions[name] && value != "" && !filepath.IsAbs(value) {
+			value = filepath.Join(filepath.Dir(file), value)
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("%v: %w", name, err)
+		}
+	}
+	return nil
+}
+
+var ErrInvalid = errors.New("Invalid configuration")
+
+func (c Config) Validate() error {
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %v", ErrInvalid, fmt.Sprintf(format, args...))
+	}
+
+	if c.Addr == "" {
+		return invalid("addr is required")
+	}
+	if c.StorageFile == "" {
+		return invalid("storage-file is required")
+	}
+	if c.StorageQueue < 1 {
+		return invalid("storage-queue should be at least 1")
+	}
+	if _, err := c.TenantNames(); err != nil {
+		return invalid("tenants: %v", err)
+	}
+	if c.MaxTenants < 1 {
+		return invalid("max-tenants should be at least 1")
+	}
+	if c.LogFormat != logging.TextFormat && c.LogFormat != logging.JSONFormat {
+		return invalid("log-format should be %v or %v", logging.TextFormat, logging.JSONFormat)
+	}
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		return invalid("log-level: %v", err)
+	}
+	if c.TraceFile != "" && c.TraceEndpoint != "" {
+		return invalid("trace-file and trace-endpoint cannot be both set")
+	}
+	if c.JWKSFile != "" && (c.JWTIssuer == "" || c.JWTAudience == "") {
+		return invalid("jwt-issuer and jwt-audience are required with jwks-file")
+	}
+	if c.JWKSFile != "" && (c.JWTTenantClaim == "" || c.JWTScopeClaim == "") {
+		return invalid("jwt-tenant-claim and jwt-scope-claim should not be empty")
+	}
+	if c.JWTLeeway < 0 {
+		return invalid("jwt-leeway should not be negative")
+	}
+	if c.ClientRate < 0 || c.IPRate < 0 {
+		return invalid("client-rate and ip-rate should not be negative")
+	}
+	if (c.ClientRate > 0 && c.ClientBurst < 1) || (c.IPRate > 0 && c.IPBurst < 1) {
+		return invalid("client-burst and ip-burst should be at least 1")
+	}
+	if _, err := ratelimit.ParseRouteLimits(c.ClientRouteLimits); err != nil {
+		return invalid("client-route-limits: %v", err)
+	}
+	if _, err := ratelimit.ParseRouteLimits(c.IPRouteLimits); err != nil {
+		return invalid("ip-route-limits: %v", err)
+	}
+	if c.TreasuryApi == "" {
+		return invalid("treasury-api is required")
+	}
+	if c.TreasuryRate < 0 {
+		return invalid("treasury-rate should not be negative")
+	}
+	if c.TreasuryRate > 0 && c.TreasuryBurst < 1 {
+		return invalid("treasury-burst should be at least 1")
+	}
+	if _, err := c.RateSelection(); err != nil {
+		return invalid("%v", err)
+	}
+	if c.RateSeriesYears < 1 {
+		return invalid("rate-series-years should be at least 1")
+	}
+	if c.RateCacheTTL < 0 {
+		return invalid("rate-cache-ttl should not be negative")
+	}
+	if c.PrefetchInterval < 0 {
+		return invalid("prefetch-interval should not be negative")
+	}
+	if c.PrefetchMonths < 1 {
+		return invalid("prefetch-months should be at least 1")
+	}
+	if c.ReadyTimeout <= 0 {
+		return invalid("ready-timeout should be positive")
+	}
+	return nil
+}
+
+// RateSelection returns the rate selection applied when a request does not
+// choose one.
+func (c Config) RateSelection() (application.RateSelection, error) {
+	var selection application.RateSelection
+	policy, err := application.NewRatePolicy(c.RatePolicy)
+	if err != nil {
+		return selection, err
+	}
+	if policy == application.RecordDateRate {
+		return selection, fmt.Errorf("%v policy can only be chosen per request", policy)
+	}
+	window, err := application.NewRateWindow(fmt.Sprint(c.RateWindow))
+	if err != nil {
+		return selection, err
+	}
+	return application.RateSelection{Policy: policy, WindowMonths: window}, nil
+}
+
+// TenantNames returns the tenants configured with -tenants.
+func (c Config) TenantNames() ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(c.Tenants, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == auth.AnyTenant {
+			return nil, fmt.Errorf("%v: %w", name, auth.ErrTenant)
+		}
+		tenant, err := auth.NewTenant(name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, tenant)
+	}
+	return names, nil
+}
+
+// Usage writes the options with their environment variables and defaults.
+func Usage(w io.Writer, name string) {
+	c := Default()
+	flags := c.flagSet(name)
+	fmt.Fprintf(w, "Usage of %v:\n", name)
+	flags.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(w, "  -%v (%v)\n    \t%v", f.Name, EnvName(f.Name), f.Usage)
+		if f.DefValue != "" {
+			fmt.Fprintf(w, " (default %q)", f.DefValue)
+		}
+		fmt.Fprintln(w)
+	})
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"wex/src/application"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatalf("Could not write config file: %v", err)
+	}
+	return file
+}
+
+func env(values map[string]string) func(string) string {
+	return func(name string) string { return values[name] }
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeConfigFile(t, `{"addr": ":8080", "rate-window": 12, "treasury-api": "http://file", "rate-cache-ttl": "1h"}`)
+
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		expected func(Config) bool
+	}{
+		{"defaults", nil, nil, func(c Config) bool {
+			return c == Default()
+		}},
+		{"config file", []string{"-config", file}, nil, func(c Config) bool {
+			return c.Addr == ":8080" && c.RateWindow == 12 && c.TreasuryApi == "http://file" &&
+				c.RateCacheTTL == time.Hour && c.RatePolicy == "latest"
+		}},
+		{"config file from environment", nil, map[string]string{"WEX_CONFIG": file}, func(c Config) bool {
+			return c.Addr == ":8080"
+		}},
+		{"environment over file", []string{"-config", file}, map[string]string{"WEX_ADDR": ":9090"}, func(c Config) bool {
+			return c.Addr == ":9090" && c.RateWindow == 12
+		}},
+		{"flags over environment", []string{"-config", file, "-addr", ":7070"},
+			map[string]string{"WEX_ADDR": ":9090", "WEX_RATE_POLICY": "nearest"}, func(c Config) bool {
+				return c.Addr == ":7070" && c.RatePolicy == "nearest" && c.RateWindow == 12
+			}},
+		{"flag set to its default", []string{"-rate-window", "6"}, map[string]string{"WEX_RATE_WINDOW": "3"}, func(c Config) bool {
+			return c.RateWindow == 6
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := Load("wex", test.args, env(test.env))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !test.expected(c) {
+				t.Errorf("Unexpected configuration %+v", c)
+			}
+		})
+	}
+}
+
+func TestLoadPaths(t *testing.T) {
+	file := writeConfigFile(t, `{"storage-file": "data/db.json", "ui-dir": "/srv/ui", "trace-file": "../spans.json"}`)
+	dir := filepath.Dir(file)
+
+	c, err := Load("wex", []string{"-config", file}, env(map[string]string{"WEX_JWKS_FILE": "jwks.json",
+		"WEX_JWT_ISSUER": "https://gateway", "WEX_JWT_AUDIENCE": "wex"}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.StorageFile != filepath.Join(dir, "data", "db.json") || c.UIDir != "/srv/ui" ||
+		c.TraceFile != filepath.Join(filepath.Dir(dir), "spans.json") {
+		t.Errorf("Paths of the config file not resolved against its directory: %+v", c)
+	}
+	// paths given by flags and environment variables are left to the
+	// working directory
+	if c.JWKSFile != "jwks.json" {
+		t.Errorf("Path of the environment resolved: %v", c.JWKSFile)
+	}
+
+	if storage := Default().StorageFile; !filepath.IsAbs(storage) ||
+		!strings.HasSuffix(storage, filepath.Join("storage", "localdb.json")) {
+		t.Errorf("Default storage file not resolved against the executable: %v", storage)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string
+	}{
+		{"unknown flag", []string{"-port", "80"}, nil, ""},
+		{"invalid flag value", []string{"-rate-window", "six"}, nil, ""},
+		{"invalid environment value", nil, map[string]string{"WEX_PREFETCH_INTERVAL": "daily"}, ""},
+		{"unknown file option", nil, nil, `{"port": 80}`},
+		{"invalid file value", nil, nil, `{"addr": [":80"]}`},
+		{"malformed file", nil, nil, `{"addr": `},
+		{"missing file", []string{"-config", "missing.json"}, nil, ""},
+		{"invalid policy", []string{"-rate-policy", "recordDate"}, nil, ""},
+		{"invalid window", nil, map[string]string{"WEX_RATE_WINDOW": "0"}, ""},
+		{"negative ttl", []string{"-rate-cache-ttl", "-1h"}, nil, ""},
+		{"zero rate series years", []string{"-rate-series-years", "0"}, nil, ""},
+		{"empty address", []string{"-addr", ""}, nil, ""},
+		{"extra arguments", []string{"serve"}, nil, ""},
+		{"jwks without audience", []string{"-jwks-file", "jwks.json", "-jwt-issuer", "https://gateway"}, nil, ""},
+		{"negative jwt leeway", []string{"-jwt-leeway", "-1m"}, nil, ""},
+		{"invalid route limits", nil, map[string]string{"WEX_CLIENT_ROUTE_LIMITS": "/convertTransaction=2"}, ""},
+		{"zero client burst", []string{"-client-burst", "0"}, nil, ""},
+		{"invalid log format", []string{"-log-format", "xml"}, nil, ""},
+		{"invalid log level", nil, map[string]string{"WEX_LOG_LEVEL": "verbose"}, ""},
+		{"two trace exporters", []string{"-trace-file", "spans.json", "-trace-endpoint", "http://localhost:4318/v1/traces"}, nil, ""},
+		{"empty storage queue", []string{"-storage-queue", "0"}, nil, ""},
+		{"invalid tenant", []string{"-tenants", "acme,Globex"}, nil, ""},
+		{"any tenant configured", nil, map[string]string{"WEX_TENANTS": "*"}, ""},
+		{"zero max tenants", []string{"-max-tenants", "0"}, nil, ""},
+		{"zero ready timeout", []string{"-ready-timeout", "0s"}, nil, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := test.args
+			if test.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, test.file)}, args...)
+			}
+			if _, err := Load("wex", args, env(test.env)); err == nil {
+				t.Error("No error received for invalid configuration")
+			}
+		})
+	}
+}
+
+func TestRateSelection(t *testing.T) {
+	c := Default()
+	c.RatePolicy = "average"
+	c.RateWindow = 3
+	selection, err := c.RateSelection()
+	if err != nil || selection.Policy != application.AverageRate || selection.WindowMonths != 3 {
+		t.Errorf("Unexpected selection %+v (%v)", selection, err)
+	}
+
+	c.RateWindow = 200
+	if err := c.Validate(); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Error differs from expected: received (%v); expected (%v)", err, ErrInvalid)
+	}
+}
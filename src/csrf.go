@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+)
+
+const (
+	csrfCookie = "wex_csrf"
+	csrfField  = "csrfToken"
+)
+
+// csrfProtection guards the UI forms with tokens tied to a random cookie:
+// the token posted must be the signature of the cookie sent along, which a
+// third party site can neither read nor forge.
+type csrfProtection struct {
+	secret []byte
+}
+
+func newCSRFProtection() csrfProtection {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return csrfProtection{secret: secret}
+}
+
+func (c csrfProtection) sign(session string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(session))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// token returns the token to embed in the forms of the page, setting the
+// cookie it is tied to when the browser does not have one yet.
+func (c csrfProtection) token(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		return c.sign(cookie.Value)
+	}
+	session := make([]byte, 24)
+	rand.Read(session)
+	value := base64.RawURLEncoding.EncodeToString(session)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return c.sign(value)
+}
+
+// valid checks the token posted with a form, and the origin of the request
+// when the browser sends one.
+func (c csrfProtection) valid(r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return false
+		}
+	}
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return hmac.Equal([]byte(r.PostFormValue(csrfField)), []byte(c.sign(cookie.Value)))
+}
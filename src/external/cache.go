@@ -0,0 +1,236 @@
+package external
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+	"wex/src/application"
+	"wex/src/tracing"
+)
+
+// DefaultRateCacheTTL is how long fetched rates are answered from the cache.
+const DefaultRateCacheTTL = 12 * time.Hour
+
+// coverage is a record date range whose rates have all been fetched.
+type coverage struct {
+	from, to application.Time
+	fetched  time.Time
+}
+
+type cachedCurrency struct {
+	rates    map[time.Time]application.ExchangeRate // by record date
+	coverage []coverage
+}
+
+// RateCache answers QueryRates from the rates already fetched from Source
+// when they cover the whole date range requested. Only the currencies
+// missing from the cache are requested upstream.
+type RateCache struct {
+	Source FiscalDataInterface
+	TTL    time.Duration
+
+	mu         sync.Mutex
+	currencies map[string]*cachedCurrency
+	hits       int64
+	misses     int64
+}
+
+func NewRateCache(source FiscalDataInterface) *RateCache {
+	return &RateCache{
+		Source:     source,
+		TTL:        DefaultRateCacheTTL,
+		currencies: make(map[string]*cachedCurrency),
+	}
+}
+
+func (c *RateCache) QueryRates(ctx context.Context,
+	currencies []string, from, to application.Time) (_ []application.ExchangeRate, err error) {
+
+	ctx, span := tracing.Start(ctx, "RateCache.QueryRates", tracing.KindInternal)
+	defer func() {
+		span.Fail(err)
+		span.End()
+	}()
+
+	c.mu.Lock()
+	var missing []string
+	for _, currency := range currencies {
+		if c.covers(currency, from, to) {
+			c.hits++
+		} else {
+			c.misses++
+			missing = append(missing, currency)
+		}
+	}
+	c.mu.Unlock()
+	span.Set("cache.hits", len(currencies)-len(missing))
+	span.Set("cache.misses", len(missing))
+
+	if len(missing) > 0 {
+		if _, err := c.Prefetch(ctx, missing, from, to); err != nil {
+			return nil, err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var rates []application.ExchangeRate
+	for _, currency := range currencies {
+		cached, ok := c.currencies[currency]
+		if !ok {
+			continue
+		}
+		for _, rate := range cached.rates {
+			if !rate.RecordDate.Before(from.Time) && !rate.RecordDate.After(to.Time) {
+				rates = append(rates, rate)
+			}
+		}
+	}
+	sort.SliceStable(rates, func(i, j int) bool {
+		return rates[i].RecordDate.After(rates[j].RecordDate.Time)
+	})
+	return rates, nil
+}
+
+// Prefetch fetches the rates of currencies between from and to from Source,
+// replacing what was cached for that range. It returns the number of rates
+// fetched. The range is only recorded as covered up to today, rates may
+// still be published for later dates, and not at all for currencies the
+// response had no rates of.
+func (c *RateCache) Prefetch(ctx context.Context, currencies []string, from, to application.Time) (int, error) {
+	rates, err := c.Source.QueryRates(ctx, currencies, from, to)
+	if err != nil {
+		return 0, err
+	}
+	answered := make(map[string]bool)
+	for _, rate := range rates {
+		answered[rate.CountryCurrency] = true
+	}
+
+	now := time.Now().UTC()
+	covered := to
+	if today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC); covered.After(today) {
+		covered = application.Time{Time: today}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, currency := range currencies {
+		if !answered[currency] {
+			continue
+		}
+		cached, ok := c.currencies[currency]
+		if !ok {
+			cached = &cachedCurrency{rates: make(map[time.Time]application.ExchangeRate)}
+			c.currencies[currency] = cached
+		}
+		// rates revised or withdrawn upstream must not survive the refresh
+		for date := range cached.rates {
+			if !date.Before(from.Time) && !date.After(to.Time) {
+				delete(cached.rates, date)
+			}
+		}
+		fresh := cached.coverage[:0]
+		for _, cov := range cached.coverage {
+			if time.Since(cov.fetched) < c.TTL {
+				fresh = append(fresh, cov)
+			}
+		}
+		cached.coverage = fresh
+		if !covered.Before(from.Time) {
+			cached.coverage = addCoverage(fresh, coverage{from: from, to: covered, fetched: now})
+		}
+	}
+	for _, rate := range rates {
+		if cached, ok := c.currencies[rate.CountryCurrency]; ok {
+			cached.rates[rate.RecordDate.Time] = rate
+		}
+	}
+	return len(rates), nil
+}
+
+// Stats returns how many currency lookups were answered from the cache and
+// how many had to be fetched.
+func (c *RateCache) Stats() (hits, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// Warm tells whether the cache holds rates fetched less than TTL ago, that
+// conversions can be answered with while the api is unreachable.
+func (c *RateCache) Warm() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cached := range c.currencies {
+		for _, cov := range cached.coverage {
+			if time.Since(cov.fetched) < c.TTL {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// covers must be called holding c.mu.
+func (c *RateCache) covers(currency string, from, to application.Time) bool {
+	cached, ok := c.currencies[currency]
+	if !ok {
+		return false
+	}
+
+	var fresh []coverage
+	for _, cov := range cached.coverage {
+		if time.Since(cov.fetched) < c.TTL {
+			fresh = append(fresh, cov)
+		}
+	}
+	sort.Slice(fresh, func(i, j int) bool {
+		return fresh[i].from.Before(fresh[j].from.Time)
+	})
+
+	// walk the ranges looking for a gap between from and to
+	next := from.Time
+	for _, cov := range fresh {
+		if next.After(to.Time) {
+			break
+		}
+		if cov.from.After(next) {
+			return false
+		}
+		if !cov.to.Before(next) {
+			next = cov.to.AddDate(0, 0, 1)
+		}
+	}
+	return next.After(to.Time)
+}
+
+// addCoverage inserts a freshly fetched range. Older ranges are trimmed to
+// what the new one does not cover, keeping their own fetch time.
+func addCoverage(ranges []coverage, added coverage) []coverage {
+	trimmed := []coverage{}
+	for _, cov := range ranges {
+		if cov.to.Before(added.from.Time) || cov.from.After(added.to.Time) {
+			trimmed = append(trimmed, cov)
+			continue
+		}
+		if cov.from.Before(added.from.Time) {
+			trimmed = append(trimmed, coverage{
+				from:    cov.from,
+				to:      application.Time{Time: added.from.AddDate(0, 0, -1)},
+				fetched: cov.fetched,
+			})
+		}
+		if cov.to.After(added.to.Time) {
+			trimmed = append(trimmed, coverage{
+				from:    application.Time{Time: added.to.AddDate(0, 0, 1)},
+				to:      cov.to,
+				fetched: cov.fetched,
+			})
+		}
+	}
+	return append(trimmed, added)
+}
@@ -0,0 +1,149 @@
+package external
+
+import (
+	"context"
+	"testing"
+	"time"
+	"wex/src/application"
+	"wex/src/external/fiscaltest"
+)
+
+func date(s string) application.Time {
+	t, _ := application.NewTime(s)
+	return t
+}
+
+func TestRateCache(t *testing.T) {
+	handler := fiscaltest.NewHandler(fiscaltest.DefaultFixture())
+	server := fiscaltest.NewServer(handler)
+	defer server.Close()
+
+	cache := NewRateCache(FiscalDataMiddleware{ExternalApi: server.URL})
+
+	rates, err := cache.QueryRates(context.Background(), []string{"Mexico-Peso"}, date("2022-01-01"), date("2022-12-31"))
+	if err != nil || len(rates) != 4 {
+		t.Fatalf("Unexpected rates %v (%v)", rates, err)
+	}
+	if rates[0].RecordDate.ToString() != "2022-12-31" {
+		t.Errorf("Rates not sorted by most recent first: %v", rates)
+	}
+
+	// narrower range answered from the cache
+	rates, err = cache.QueryRates(context.Background(), []string{"Mexico-Peso"}, date("2022-05-01"), date("2022-10-01"))
+	if err != nil || len(rates) != 2 {
+		t.Errorf("Unexpected rates %v (%v)", rates, err)
+	}
+	if handler.Requests() != 1 {
+		t.Errorf("Expected a single upstream request, got %v", handler.Requests())
+	}
+
+	// only the missing currency is fetched
+	rates, err = cache.QueryRates(context.Background(), []string{"Mexico-Peso", "Japan-Yen"}, date("2022-05-01"), date("2022-10-01"))
+	if err != nil || len(rates) != 4 {
+		t.Errorf("Unexpected rates %v (%v)", rates, err)
+	}
+	if handler.Requests() != 2 {
+		t.Errorf("Expected 2 upstream requests, got %v", handler.Requests())
+	}
+
+	hits, misses := cache.Stats()
+	if hits != 2 || misses != 2 {
+		t.Errorf("Expected 2 hits and 2 misses, got %v and %v", hits, misses)
+	}
+
+	// expired entries are fetched again
+	cache.TTL = 0
+	cache.QueryRates(context.Background(), []string{"Mexico-Peso"}, date("2022-05-01"), date("2022-10-01"))
+	if handler.Requests() != 3 {
+		t.Errorf("Expected 3 upstream requests, got %v", handler.Requests())
+	}
+}
+
+func TestRateCacheAdjacentRanges(t *testing.T) {
+	handler := fiscaltest.NewHandler(fiscaltest.DefaultFixture())
+	server := fiscaltest.NewServer(handler)
+	defer server.Close()
+
+	cache := NewRateCache(FiscalDataMiddleware{ExternalApi: server.URL})
+	cache.Prefetch(context.Background(), []string{"Canada-Dollar"}, date("2021-01-01"), date("2021-12-31"))
+	cache.Prefetch(context.Background(), []string{"Canada-Dollar"}, date("2022-01-01"), date("2022-12-31"))
+
+	rates, err := cache.QueryRates(context.Background(), []string{"Canada-Dollar"}, date("2021-06-01"), date("2022-06-01"))
+	if err != nil || len(rates) != 4 {
+		t.Errorf("Unexpected rates %v (%v)", rates, err)
+	}
+	if handler.Requests() != 2 {
+		t.Errorf("Expected ranges to be joined without upstream request, got %v requests", handler.Requests())
+	}
+}
+
+func TestRateCacheUpstreamError(t *testing.T) {
+	handler := fiscaltest.NewHandler(fiscaltest.DefaultFixture())
+	server := fiscaltest.NewServer(handler)
+	defer server.Close()
+
+	cache := NewRateCache(FiscalDataMiddleware{ExternalApi: server.URL})
+	handler.SetFaults(fiscaltest.Faults{ErrorRate: 1})
+
+	if _, err := cache.QueryRates(context.Background(), []string{"Mexico-Peso"}, date("2022-01-01"), date("2022-12-31")); err == nil {
+		t.Error("No error received for upstream failure")
+	}
+}
+
+func TestRateCacheWarm(t *testing.T) {
+	server := fiscaltest.NewServer(fiscaltest.NewHandler(fiscaltest.DefaultFixture()))
+	defer server.Close()
+
+	upstream := FiscalDataMiddleware{ExternalApi: server.URL}
+	if err := upstream.Ping(context.Background()); err != nil {
+		t.Errorf("Api not reachable: %v", err)
+	}
+
+	cache := NewRateCache(upstream)
+	if cache.Warm() {
+		t.Error("Empty cache reported warm")
+	}
+	cache.QueryRates(context.Background(), []string{"Mexico-Peso"}, date("2022-01-01"), date("2022-12-31"))
+	if !cache.Warm() {
+		t.Error("Cache not warm after a query")
+	}
+	cache.TTL = 0
+	if cache.Warm() {
+		t.Error("Expired cache reported warm")
+	}
+
+	server.Close()
+	if err := upstream.Ping(context.Background()); err == nil {
+		t.Error("No error received for unreachable api")
+	}
+}
+
+func TestRateCacheCoverage(t *testing.T) {
+	handler := fiscaltest.NewHandler(fiscaltest.DefaultFixture())
+	server := fiscaltest.NewServer(handler)
+	defer server.Close()
+
+	cache := NewRateCache(FiscalDataMiddleware{ExternalApi: server.URL})
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	future := application.Time{Time: today.AddDate(1, 0, 0)}
+
+	// rates may still be published after today
+	cache.QueryRates(context.Background(), []string{"Mexico-Peso"}, date("2022-01-01"), future)
+	cache.QueryRates(context.Background(), []string{"Mexico-Peso"}, date("2022-05-01"), date("2022-10-01"))
+	if handler.Requests() != 1 {
+		t.Errorf("Expected the past to be answered from the cache, got %v requests", handler.Requests())
+	}
+	cache.QueryRates(context.Background(), []string{"Mexico-Peso"}, application.Time{Time: today.AddDate(0, 0, 1)}, future)
+	if handler.Requests() != 2 {
+		t.Errorf("Expected the future to be fetched again, got %v requests", handler.Requests())
+	}
+
+	// a currency without rates is not cached as having none
+	for i := 0; i < 2; i++ {
+		cache.QueryRates(context.Background(), []string{"Atlantis-Dollar"}, date("2022-01-01"), date("2022-12-31"))
+	}
+	if handler.Requests() != 4 {
+		t.Errorf("Expected a currency without rates to be fetched again, got %v requests", handler.Requests())
+	}
+}
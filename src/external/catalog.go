@@ -0,0 +1,130 @@
+package external
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+	"wex/src/application"
+	"wex/src/logging"
+)
+
+// DefaultCatalogTTL is how long the currency catalog is kept before the
+// Treasury dataset is queried again.
+const DefaultCatalogTTL = 24 * time.Hour
+
+type CurrencySource interface {
+	QueryCurrencies(ctx context.Context) ([]application.Currency, error)
+}
+
+type CurrencyCatalogInterface interface {
+	Currencies(ctx context.Context) ([]application.Currency, error)
+	ResolveCurrency(ctx context.Context, query string) (application.Currency, error)
+}
+
+// QueryCurrencies lists every country currency found in the rates_of_exchange
+// dataset with the first and last record dates available.
+func (f FiscalDataMiddleware) QueryCurrencies(ctx context.Context) ([]application.Currency, error) {
+	params := url.Values{}
+	params.Add("fields", "country,currency,record_date")
+	params.Add("sort", "country,currency,record_date")
+	// every dated record is read, a couple of pages at the largest size
+	// rather than hundreds at the default one
+	f.PageSize = maxPageSize
+
+	it := recordIterator{ctx: ctx, middleware: f, params: params}
+
+	found := make(map[string]*application.Currency)
+	for it.Next() {
+		record := it.current
+		date, err := application.NewTime(record["record_date"])
+		if err != nil {
+			continue
+		}
+
+		c := application.NewCurrency(record["country"], record["currency"])
+		current, ok := found[c.CountryCurrency]
+		if !ok {
+			c.FirstRecordDate, c.LastRecordDate = date, date
+			found[c.CountryCurrency] = &c
+			continue
+		}
+		if date.Before(current.FirstRecordDate.Time) {
+			current.FirstRecordDate = date
+		}
+		if date.After(current.LastRecordDate.Time) {
+			current.LastRecordDate = date
+		}
+	}
+	if err := it.err; err != nil {
+		return nil, err
+	}
+
+	currencies := make([]application.Currency, 0, len(found))
+	for _, c := range found {
+		currencies = append(currencies, *c)
+	}
+	sort.Slice(currencies, func(i, j int) bool {
+		return currencies[i].CountryCurrency < currencies[j].CountryCurrency
+	})
+	return currencies, nil
+}
+
+// CurrencyCatalog caches the currencies listed by a CurrencySource. The list
+// is refreshed on first use after TTL has elapsed; when the refresh fails
+// the previous list keeps being served. Concurrent callers share a single
+// refresh.
+type CurrencyCatalog struct {
+	Source CurrencySource
+	TTL    time.Duration
+
+	mu         sync.Mutex
+	currencies []application.Currency
+	fetched    time.Time
+	refreshes  flightGroup[[]application.Currency]
+}
+
+func NewCurrencyCatalog(source CurrencySource) *CurrencyCatalog {
+	return &CurrencyCatalog{Source: source, TTL: DefaultCatalogTTL}
+}
+
+func (c *CurrencyCatalog) Currencies(ctx context.Context) ([]application.Currency, error) {
+	c.mu.Lock()
+	cached, fresh := c.currencies, c.currencies != nil && time.Since(c.fetched) < c.TTL
+	c.mu.Unlock()
+	if fresh {
+		return cached, nil
+	}
+
+	currencies, err := c.refreshes.do(ctx, "", c.refresh)
+	if err != nil {
+		if cached != nil {
+			logging.FromContext(ctx).Warn("Could not refresh currency catalog, serving cached list", "error", err)
+			return cached, nil
+		}
+		return nil, err
+	}
+	return currencies, nil
+}
+
+// refresh queries the source, holding the lock only to keep the list.
+func (c *CurrencyCatalog) refresh(ctx context.Context) ([]application.Currency, error) {
+	currencies, err := c.Source.QueryCurrencies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.currencies = currencies
+	c.fetched = time.Now()
+	c.mu.Unlock()
+	return currencies, nil
+}
+
+func (c *CurrencyCatalog) ResolveCurrency(ctx context.Context, query string) (application.Currency, error) {
+	currencies, err := c.Currencies(ctx)
+	if err != nil {
+		return application.Currency{}, err
+	}
+	return application.MatchCurrency(currencies, query)
+}
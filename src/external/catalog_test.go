@@ -0,0 +1,143 @@
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+	"wex/src/application"
+)
+
+func catalogServer(t *testing.T, calls *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		if fields := r.URL.Query().Get("fields"); fields != "country,currency,record_date" {
+			t.Errorf("Request with unexpected fields %v", fields)
+		}
+		if size := r.URL.Query().Get("page[size]"); size != "10000" {
+			t.Errorf("Request with unexpected page size %v", size)
+		}
+		data := []map[string]string{
+			{"country": "Mexico", "currency": "Peso", "record_date": "2001-03-31"},
+			{"country": "Mexico", "currency": "Peso", "record_date": "2023-06-30"},
+			{"country": "Mexico", "currency": "Peso", "record_date": "2010-12-31"},
+			{"country": "Canada", "currency": "Dollar", "record_date": "2020-03-31"},
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"data": data,
+			"meta": map[string]int{"count": 4, "total-count": 4, "total-pages": 1},
+		})
+	}))
+}
+
+func TestQueryCurrencies(t *testing.T) {
+	calls := 0
+	server := catalogServer(t, &calls)
+	defer server.Close()
+
+	f := FiscalDataMiddleware{ExternalApi: server.URL}
+	currencies, err := f.QueryCurrencies(context.Background())
+	if err != nil {
+		t.Fatalf("Error querying currencies: %v", err)
+	}
+	if len(currencies) != 2 {
+		t.Fatalf("Expected 2 currencies, got %v", currencies)
+	}
+
+	mexico := currencies[1]
+	if mexico.CountryCurrency != "Mexico-Peso" || mexico.IsoCode != "MXN" {
+		t.Errorf("Unexpected currency %v", mexico)
+	}
+	if mexico.FirstRecordDate.ToString() != "2001-03-31" || mexico.LastRecordDate.ToString() != "2023-06-30" {
+		t.Errorf("Unexpected date range %v - %v",
+			mexico.FirstRecordDate.ToString(), mexico.LastRecordDate.ToString())
+	}
+}
+
+func TestCurrencyCatalogCache(t *testing.T) {
+	calls := 0
+	server := catalogServer(t, &calls)
+	defer server.Close()
+
+	catalog := NewCurrencyCatalog(FiscalDataMiddleware{ExternalApi: server.URL})
+
+	c, err := catalog.ResolveCurrency(context.Background(), "mexico peso")
+	if err != nil || c.CountryCurrency != "Mexico-Peso" {
+		t.Errorf("Could not resolve currency: %v %v", c, err)
+	}
+	if _, err := catalog.ResolveCurrency(context.Background(), "real"); !errors.Is(err, application.ErrUnknownCurrency) {
+		t.Errorf("Error differs from expected: received (%v); expected (%v)", err, application.ErrUnknownCurrency)
+	}
+	if calls != 1 {
+		t.Errorf("Expected a single upstream call, got %v", calls)
+	}
+
+	// an expired list is kept when the refresh fails
+	catalog.TTL = 0
+	server.Close()
+	if _, err := catalog.Currencies(context.Background()); err != nil {
+		t.Errorf("Expected cached list after failed refresh, got %v", err)
+	}
+}
+
+// blockingCurrencies lists a currency once release is closed.
+type blockingCurrencies struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (b *blockingCurrencies) QueryCurrencies(ctx context.Context) ([]application.Currency, error) {
+	b.calls.Add(1)
+	select {
+	case <-b.release:
+		return []application.Currency{application.NewCurrency("Mexico", "Peso")}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestCurrencyCatalogConcurrentRefresh(t *testing.T) {
+	source := &blockingCurrencies{release: make(chan struct{})}
+	catalog := NewCurrencyCatalog(source)
+
+	first, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := catalog.Currencies(first)
+		firstErr <- err
+	}()
+	for source.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan error)
+	go func() {
+		_, err := catalog.Currencies(context.Background())
+		second <- err
+	}()
+	for waiting := 0; waiting < 2; time.Sleep(time.Millisecond) {
+		catalog.refreshes.mu.Lock()
+		waiting = catalog.refreshes.inFlight[""].waiting
+		catalog.refreshes.mu.Unlock()
+	}
+
+	// the caller that started the refresh gives up, the other still gets
+	// the list
+	cancel()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("Unexpected error for the cancelled caller %v", err)
+	}
+	close(source.release)
+	if err := <-second; err != nil {
+		t.Errorf("Refresh failed for the waiting caller: %v", err)
+	}
+	if calls := source.calls.Load(); calls != 1 {
+		t.Errorf("Expected a single refresh, got %v", calls)
+	}
+	if currencies, err := catalog.Currencies(context.Background()); err != nil || len(currencies) != 1 {
+		t.Errorf("Refreshed list not cached: %v %v", currencies, err)
+	}
+}
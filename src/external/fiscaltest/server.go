@@ -0,0 +1,426 @@
+// Package fiscaltest provides a stand-in for the Treasury Fiscal Data api,
+// serving the rates_of_exchange endpoint from a fixture dataset.
+//
+// Filters (eq, lt, lte, gt, gte, in), sort, fields and pagination follow the
+// semantics of the real api. Latency, server errors and malformed responses
+// can be injected to exercise clients.
+package fiscaltest
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RatesOfExchangePath = "/services/api/fiscal_service/v1/accounting/od/rates_of_exchange"
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 10000
+)
+
+//go:embed fixture/rates_of_exchange.json
+var defaultFixture []byte
+
+type Record map[string]string
+
+// DefaultFixture returns the bundled dataset: quarterly rates from 2020 to
+// 2023 for Mexico-Peso, Canada-Dollar, Euro Zone-Euro, Japan-Yen and
+// United Kingdom-Pound.
+func DefaultFixture() []Record {
+	var records []Record
+	if err := json.Unmarshal(defaultFixture, &records); err != nil {
+		panic(fmt.Sprintf("fiscaltest: invalid bundled fixture: %v", err))
+	}
+	return records
+}
+
+// LoadFixture reads a dataset from a json file holding a list of records.
+func LoadFixture(fileName string) ([]Record, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	err = json.Unmarshal(content, &records)
+	return records, err
+}
+
+// Faults describes the misbehaviour injected in responses. Rates are
+// fractions of the requests, from 0 to 1.
+type Faults struct {
+	Latency       time.Duration
+	ErrorRate     float64 // answered with 503 Service Unavailable
+	MalformedRate float64 // answered with a truncated json body
+}
+
+type Handler struct {
+	Records []Record
+	Faults  Faults
+
+	mu       sync.Mutex
+	random   *rand.Rand
+	requests int
+}
+
+func NewHandler(records []Record) *Handler {
+	return &Handler{Records: records, random: rand.New(rand.NewSource(1))}
+}
+
+// NewServer starts an httptest server answering with handler. Clients should
+// use the server URL as their api address.
+func NewServer(handler *Handler) *httptest.Server {
+	return httptest.NewServer(handler)
+}
+
+// Requests returns the number of requests received so far.
+func (h *Handler) Requests() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requests
+}
+
+// SetFaults replaces the faults injected from the next request on.
+func (h *Handler) SetFaults(faults Faults) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Faults = faults
+}
+
+// roll counts the request and decides which faults apply to it.
+func (h *Handler) roll() (Faults, bool, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.requests++
+	if h.random == nil {
+		h.random = rand.New(rand.NewSource(1))
+	}
+	fail := h.random.Float64() < h.Faults.ErrorRate
+	malformed := h.random.Float64() < h.Faults.MalformedRate
+	return h.Faults, fail, malformed
+}
+
+type apiError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Error: http.StatusText(status), Message: message})
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	faults, fail, malformed := h.roll()
+
+	if faults.Latency > 0 {
+		select {
+		case <-time.After(faults.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fail {
+		writeError(w, http.StatusServiceUnavailable, "injected failure")
+		return
+	}
+	if r.URL.Path != RatesOfExchangePath {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown endpoint %v", r.URL.Path))
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+
+	response, err := h.query(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(response)
+	content := buffer.Bytes()
+	if malformed {
+		content = content[:len(content)/2]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
+
+type meta struct {
+	Count      int `json:"count"`
+	TotalCount int `json:"total-count"`
+	TotalPages int `json:"total-pages"`
+}
+
+type links struct {
+	Self  string  `json:"self"`
+	First string  `json:"first"`
+	Prev  *string `json:"prev"`
+	Next  *string `json:"next"`
+	Last  string  `json:"last"`
+}
+
+type response struct {
+	Data  []Record `json:"data"`
+	Meta  meta     `json:"meta"`
+	Links links    `json:"links"`
+}
+
+func (h *Handler) query(params url.Values) (response, error) {
+	var resp response
+
+	fields, err := parseFields(params.Get("fields"), h.Records)
+	if err != nil {
+		return resp, err
+	}
+	conditions, err := parseFilter(params.Get("filter"))
+	if err != nil {
+		return resp, err
+	}
+
+	pageNumber, pageSize := 1, defaultPageSize
+	if v := params.Get("page[number]"); v != "" {
+		pageNumber, err = strconv.Atoi(v)
+		if err != nil || pageNumber < 1 {
+			return resp, fmt.Errorf("invalid page[number] %v", v)
+		}
+	}
+	if v := params.Get("page[size]"); v != "" {
+		pageSize, err = strconv.Atoi(v)
+		if err != nil || pageSize < 1 || pageSize > maxPageSize {
+			return resp, fmt.Errorf("invalid page[size] %v", v)
+		}
+	}
+
+	var matches []Record
+	for _, record := range h.Records {
+		if matchAll(record, conditions) {
+			matches = append(matches, record)
+		}
+	}
+	if err := sortRecords(matches, params.Get("sort")); err != nil {
+		return resp, err
+	}
+
+	totalPages := int(math.Ceil(float64(len(matches)) / float64(pageSize)))
+	start := min((pageNumber-1)*pageSize, len(matches))
+	end := min(start+pageSize, len(matches))
+
+	resp.Data = []Record{}
+	for _, record := range matches[start:end] {
+		resp.Data = append(resp.Data, project(record, fields))
+	}
+	resp.Meta = meta{Count: len(resp.Data), TotalCount: len(matches), TotalPages: totalPages}
+	resp.Links = pageLinks(pageNumber, pageSize, totalPages)
+	return resp, nil
+}
+
+func pageLinks(number, size, total int) links {
+	page := func(n int) string {
+		return fmt.Sprintf("&page%%5Bnumber%%5D=%d&page%%5Bsize%%5D=%d", n, size)
+	}
+	l := links{Self: page(number), First: page(1), Last: page(max(total, 1))}
+	if number > 1 {
+		prev := page(number - 1)
+		l.Prev = &prev
+	}
+	if number < total {
+		next := page(number + 1)
+		l.Next = &next
+	}
+	return l
+}
+
+func parseFields(fields string, records []Record) ([]string, error) {
+	if fields == "" {
+		return nil, nil
+	}
+	known := make(map[string]bool)
+	for _, record := range records {
+		for field := range record {
+			known[field] = true
+		}
+	}
+	list := strings.Split(fields, ",")
+	for _, field := range list {
+		if len(records) > 0 && !known[field] {
+			return nil, fmt.Errorf("unknown field %v", field)
+		}
+	}
+	return list, nil
+}
+
+func project(record Record, fields []string) Record {
+	if fields == nil {
+		return record
+	}
+	projected := make(Record, len(fields))
+	for _, field := range fields {
+		projected[field] = record[field]
+	}
+	return projected
+}
+
+type condition struct {
+	field, operator string
+	values          []string
+}
+
+// parseFilter splits "a:eq:1,b:in:(x,y),c:gte:2,lte:3" into conditions. As in
+// the real api, an operator without field applies to the previous field.
+func parseFilter(filter string) ([]condition, error) {
+	if filter == "" {
+		return nil, nil
+	}
+
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range filter {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, filter[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, filter[start:])
+
+	var conditions []condition
+	field := ""
+	for _, part := range parts {
+		pieces := strings.SplitN(part, ":", 3)
+		var operator, value string
+		switch {
+		case len(pieces) == 3:
+			field, operator, value = pieces[0], pieces[1], pieces[2]
+		case len(pieces) == 2 && field != "":
+			operator, value = pieces[0], pieces[1]
+		default:
+			return nil, fmt.Errorf("invalid filter %v", part)
+		}
+
+		c := condition{field: field, operator: operator, values: []string{value}}
+		switch operator {
+		case "eq", "lt", "lte", "gt", "gte":
+		case "in":
+			if !strings.HasPrefix(value, "(") || !strings.HasSuffix(value, ")") {
+				return nil, fmt.Errorf("invalid in filter %v", part)
+			}
+			c.values = strings.Split(value[1:len(value)-1], ",")
+		default:
+			return nil, fmt.Errorf("unknown filter operator %v", operator)
+		}
+		conditions = append(conditions, c)
+	}
+	return conditions, nil
+}
+
+// compare orders numbers numerically and everything else, dates included,
+// as text.
+func compare(a, b string) int {
+	x, errA := strconv.ParseFloat(a, 64)
+	y, errB := strconv.ParseFloat(b, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+func matchAll(record Record, conditions []condition) bool {
+	for _, c := range conditions {
+		value, ok := record[c.field]
+		if !ok {
+			return false
+		}
+		switch c.operator {
+		case "eq":
+			if compare(value, c.values[0]) != 0 {
+				return false
+			}
+		case "lt":
+			if compare(value, c.values[0]) >= 0 {
+				return false
+			}
+		case "lte":
+			if compare(value, c.values[0]) > 0 {
+				return false
+			}
+		case "gt":
+			if compare(value, c.values[0]) <= 0 {
+				return false
+			}
+		case "gte":
+			if compare(value, c.values[0]) < 0 {
+				return false
+			}
+		case "in":
+			found := false
+			for _, v := range c.values {
+				if value == v {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func sortRecords(records []Record, order string) error {
+	if order == "" {
+		return nil
+	}
+	keys := strings.Split(order, ",")
+	for _, key := range keys {
+		if strings.TrimPrefix(key, "-") == "" {
+			return fmt.Errorf("invalid sort %v", order)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		for _, key := range keys {
+			field := strings.TrimPrefix(key, "-")
+			c := compare(records[i][field], records[j][field])
+			if c == 0 {
+				continue
+			}
+			if strings.HasPrefix(key, "-") {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+	return nil
+}
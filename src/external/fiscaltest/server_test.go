@@ -0,0 +1,128 @@
+package fiscaltest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, server string, params url.Values) (int, response) {
+	res, err := http.Get(server + RatesOfExchangePath + "?" + params.Encode())
+	if err != nil {
+		t.Fatalf("Could not query fake server: %v", err)
+	}
+	defer res.Body.Close()
+
+	var resp response
+	if res.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			t.Fatalf("Could not parse response: %v", err)
+		}
+	}
+	return res.StatusCode, resp
+}
+
+func TestFilterSortFields(t *testing.T) {
+	server := NewServer(NewHandler(DefaultFixture()))
+	defer server.Close()
+
+	params := url.Values{}
+	params.Add("fields", "country_currency_desc,exchange_rate,record_date")
+	params.Add("filter", "country_currency_desc:in:(Mexico-Peso,Canada-Dollar),record_date:gte:2023-01-01,lte:2023-06-30")
+	params.Add("sort", "-record_date,country_currency_desc")
+
+	code, resp := get(t, server.URL, params)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d but expected %d", code, http.StatusOK)
+	}
+
+	expected := []Record{
+		{"country_currency_desc": "Canada-Dollar", "exchange_rate": "1.32", "record_date": "2023-06-30"},
+		{"country_currency_desc": "Mexico-Peso", "exchange_rate": "17.1", "record_date": "2023-06-30"},
+		{"country_currency_desc": "Canada-Dollar", "exchange_rate": "1.35", "record_date": "2023-03-31"},
+		{"country_currency_desc": "Mexico-Peso", "exchange_rate": "18.1", "record_date": "2023-03-31"},
+	}
+	if len(resp.Data) != len(expected) {
+		t.Fatalf("expected %v but got %v", expected, resp.Data)
+	}
+	for i := range expected {
+		if len(resp.Data[i]) != 3 {
+			t.Errorf("fields not projected: %v", resp.Data[i])
+		}
+		for field, value := range expected[i] {
+			if resp.Data[i][field] != value {
+				t.Errorf("expected %v but got %v", expected[i], resp.Data[i])
+			}
+		}
+	}
+	if resp.Meta.TotalCount != 4 || resp.Meta.TotalPages != 1 || resp.Links.Next != nil {
+		t.Errorf("unexpected meta %v links %v", resp.Meta, resp.Links)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	server := NewServer(NewHandler(DefaultFixture()))
+	defer server.Close()
+
+	params := url.Values{}
+	params.Add("filter", "country_currency_desc:eq:Japan-Yen")
+	params.Add("page[size]", "5")
+	params.Add("page[number]", "4")
+
+	_, resp := get(t, server.URL, params)
+	if resp.Meta.Count != 1 || resp.Meta.TotalCount != 16 || resp.Meta.TotalPages != 4 {
+		t.Errorf("unexpected meta %v", resp.Meta)
+	}
+	if resp.Links.Prev == nil || resp.Links.Next != nil {
+		t.Errorf("unexpected links %v", resp.Links)
+	}
+}
+
+func TestInvalidQueries(t *testing.T) {
+	server := NewServer(NewHandler(DefaultFixture()))
+	defer server.Close()
+
+	for _, params := range []url.Values{
+		{"fields": {"unknown_field"}},
+		{"filter": {"record_date:like:2020"}},
+		{"filter": {"record_date"}},
+		{"page[size]": {"0"}},
+		{"page[number]": {"a"}},
+	} {
+		if code, _ := get(t, server.URL, params); code != http.StatusBadRequest {
+			t.Errorf("got status %d but expected %d for %v", code, http.StatusBadRequest, params)
+		}
+	}
+}
+
+func TestFaults(t *testing.T) {
+	handler := NewHandler(DefaultFixture())
+	server := NewServer(handler)
+	defer server.Close()
+
+	handler.SetFaults(Faults{ErrorRate: 1})
+	if code, _ := get(t, server.URL, nil); code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d but expected %d", code, http.StatusServiceUnavailable)
+	}
+
+	handler.SetFaults(Faults{MalformedRate: 1})
+	res, _ := http.Get(server.URL + RatesOfExchangePath)
+	var resp response
+	if err := json.NewDecoder(res.Body).Decode(&resp); err == nil {
+		t.Error("expected malformed json")
+	}
+	res.Body.Close()
+
+	handler.SetFaults(Faults{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	get(t, server.URL, nil)
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("expected latency to be injected")
+	}
+
+	if handler.Requests() != 3 {
+		t.Errorf("expected 3 requests but got %v", handler.Requests())
+	}
+}
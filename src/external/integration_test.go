@@ -0,0 +1,82 @@
+package external
+
+import (
+	"context"
+	"testing"
+	"wex/src/application"
+	"wex/src/external/fiscaltest"
+)
+
+func TestFiscalDataEndToEnd(t *testing.T) {
+	handler := fiscaltest.NewHandler(fiscaltest.DefaultFixture())
+	server := fiscaltest.NewServer(handler)
+	defer server.Close()
+
+	f := FiscalDataMiddleware{ExternalApi: server.URL, PageSize: 3}
+	from, _ := application.NewTime("2022-01-01")
+	to, _ := application.NewTime("2023-12-31")
+
+	rates, err := f.QueryRates(context.Background(), []string{"Mexico-Peso", "Euro Zone-Euro"}, from, to)
+	if err != nil {
+		t.Fatalf("Error querying rates: %v", err)
+	}
+	if len(rates) != 16 {
+		t.Fatalf("Expected 16 rates, got %v", len(rates))
+	}
+	// 16 records in pages of 3
+	if handler.Requests() != 6 {
+		t.Errorf("Expected 6 page requests, got %v", handler.Requests())
+	}
+	for i := 1; i < len(rates); i++ {
+		if rates[i].RecordDate.After(rates[i-1].RecordDate.Time) {
+			t.Errorf("Rates not sorted by most recent first: %v", rates)
+		}
+	}
+
+	selection := application.RateSelection{Policy: application.LatestRate, WindowMonths: 6}
+	purchase, _ := application.NewTime("2023-05-15")
+	var mexico []application.ExchangeRate
+	for _, rate := range rates {
+		if rate.CountryCurrency == "Mexico-Peso" {
+			mexico = append(mexico, rate)
+		}
+	}
+	rate, err := selection.Select(mexico, purchase)
+	if err != nil || rate.Rate.ToString() != "18.1" || rate.RecordDate.ToString() != "2023-03-31" {
+		t.Errorf("Unexpected rate selected %v (%v)", rate, err)
+	}
+
+	currencies, err := f.QueryCurrencies(context.Background())
+	if err != nil || len(currencies) != 5 {
+		t.Fatalf("Unexpected currencies %v (%v)", currencies, err)
+	}
+	if currencies[1].CountryCurrency != "Euro Zone-Euro" || currencies[1].IsoCode != "EUR" ||
+		currencies[1].FirstRecordDate.ToString() != "2020-03-31" {
+		t.Errorf("Unexpected currency %v", currencies[1])
+	}
+}
+
+func TestFiscalDataFaults(t *testing.T) {
+	handler := fiscaltest.NewHandler(fiscaltest.DefaultFixture())
+	server := fiscaltest.NewServer(handler)
+	defer server.Close()
+
+	f := FiscalDataMiddleware{ExternalApi: server.URL}
+	date, _ := application.NewTime("2023-06-30")
+
+	handler.SetFaults(fiscaltest.Faults{ErrorRate: 1})
+	if _, err := f.QueryRates(context.Background(), []string{"Mexico-Peso"}, date, date); err == nil {
+		t.Error("No error received for upstream failure")
+	}
+
+	handler.SetFaults(fiscaltest.Faults{MalformedRate: 1})
+	if _, err := f.QueryRates(context.Background(), []string{"Mexico-Peso"}, date, date); err == nil {
+		t.Error("No error received for malformed response")
+	}
+
+	handler.SetFaults(fiscaltest.Faults{})
+	rates, err := f.QueryRates(context.Background(), []string{"Mexico-Peso"}, date, date)
+	if err != nil || len(rates) != 1 {
+		t.Errorf("Unexpected rates after faults cleared %v (%v)", rates, err)
+	}
+}
@@ -0,0 +1,122 @@
+package external
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"wex/src/application"
+)
+
+var ErrIncompleteResult = errors.New("Treasury api returned fewer records than announced")
+
+// recordIterator walks through every page of a dataset query. Pages are only
+// requested when the records already fetched have been consumed.
+type recordIterator struct {
+	ctx        context.Context
+	middleware FiscalDataMiddleware
+	params     url.Values
+
+	page    int // last page fetched
+	buffer  []map[string]string
+	current map[string]string
+
+	totalCount int
+	totalPages int
+	seen       int
+
+	err  error
+	done bool
+}
+
+// Next advances to the next record, fetching a new page when needed. It
+// returns false once every record has been read or an error happened.
+func (it *recordIterator) Next() bool {
+	if it.done {
+		return false
+	}
+
+	for len(it.buffer) == 0 {
+		if it.page > 0 && (it.page >= it.totalPages || it.seen >= it.totalCount) {
+			if it.seen < it.totalCount {
+				it.fail(fmt.Errorf("%w: %v of %v", ErrIncompleteResult, it.seen, it.totalCount))
+				return false
+			}
+			it.done = true
+			return false
+		}
+
+		page, err := it.middleware.fetchPage(it.ctx, it.params, it.page+1)
+		if err != nil {
+			it.fail(err)
+			return false
+		}
+		it.page++
+		it.totalCount = page.Meta.TotalCount
+		it.totalPages = page.Meta.TotalPages
+		it.buffer = page.Data
+
+		if len(page.Data) == 0 {
+			// nothing else will come, even if more were announced
+			it.totalPages = it.page
+		}
+	}
+
+	it.current = it.buffer[0]
+	it.buffer = it.buffer[1:]
+	it.seen++
+	return true
+}
+
+func (it *recordIterator) fail(err error) {
+	it.err = err
+	it.done = true
+	it.buffer = nil
+}
+
+// RateIterator walks through every rate of a query, one page at a time.
+//
+//	it := middleware.IterateRates(ctx, currencies, from, to)
+//	for it.Next() {
+//		rate := it.Rate()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type RateIterator struct {
+	records recordIterator
+	current application.ExchangeRate
+}
+
+// Next advances to the next rate. It returns false once every rate has been
+// read or an error happened.
+func (it *RateIterator) Next() bool {
+	if !it.records.Next() {
+		return false
+	}
+
+	data := it.records.current
+	rate, err := application.NewExchangeRate(
+		data["country_currency_desc"], data["exchange_rate"], data["record_date"])
+	if err != nil {
+		it.records.fail(fmt.Errorf("Could not parse rate %v: %w", data, err))
+		return false
+	}
+	it.current = rate
+	return true
+}
+
+// Rate returns the rate read by the last call to Next.
+func (it *RateIterator) Rate() application.ExchangeRate {
+	return it.current
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *RateIterator) Err() error {
+	return it.records.err
+}
+
+// TotalCount returns the number of records announced by the api. It is only
+// known once the first page has been fetched.
+func (it *RateIterator) TotalCount() int {
+	return it.records.totalCount
+}
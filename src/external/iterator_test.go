@@ -0,0 +1,86 @@
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"wex/src/application"
+)
+
+// pagedServer serves total records in pages, announcing announced records.
+func pagedServer(t *testing.T, total, announced int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		number, err := strconv.Atoi(r.URL.Query().Get("page[number]"))
+		if err != nil {
+			t.Errorf("Request without page number: %v", r.URL.RawQuery)
+		}
+		size, err := strconv.Atoi(r.URL.Query().Get("page[size]"))
+		if err != nil {
+			t.Errorf("Request without page size: %v", r.URL.RawQuery)
+		}
+
+		data := []map[string]string{}
+		for i := (number - 1) * size; i < number*size && i < total; i++ {
+			data = append(data, map[string]string{
+				"country_currency_desc": "Mexico-Peso",
+				"exchange_rate":         fmt.Sprintf("%v.5", i+1),
+				"record_date":           "2023-06-30",
+			})
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"data": data,
+			"meta": map[string]int{
+				"count":       len(data),
+				"total-count": announced,
+				"total-pages": (announced + size - 1) / size,
+			},
+		})
+	}))
+}
+
+func TestIterateAllPages(t *testing.T) {
+	server := pagedServer(t, 25, 25)
+	defer server.Close()
+
+	f := FiscalDataMiddleware{ExternalApi: server.URL, PageSize: 10}
+	date := application.Time{}
+
+	it := f.IterateRates(context.Background(), []string{"Mexico-Peso"}, date, date)
+	count := 0
+	for it.Next() {
+		count++
+		if it.Rate().Rate.ToString() != fmt.Sprintf("%v.5", count) {
+			t.Errorf("Unexpected rate %v at position %v", it.Rate().Rate.ToString(), count)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Errorf("Error iterating rates: %v", err)
+	}
+	if count != 25 || it.TotalCount() != 25 {
+		t.Errorf("Expected 25 rates, read %v of %v", count, it.TotalCount())
+	}
+
+	rates, err := f.QueryRates(context.Background(), []string{"Mexico-Peso"}, date, date)
+	if err != nil || len(rates) != 25 {
+		t.Errorf("Expected 25 rates from QueryRates, got %v (%v)", len(rates), err)
+	}
+}
+
+func TestIterateTruncatedResult(t *testing.T) {
+	server := pagedServer(t, 15, 30)
+	defer server.Close()
+
+	f := FiscalDataMiddleware{ExternalApi: server.URL, PageSize: 10}
+	date := application.Time{}
+
+	_, err := f.QueryRates(context.Background(), []string{"Mexico-Peso"}, date, date)
+	if !errors.Is(err, ErrIncompleteResult) {
+		t.Errorf("Error differs from expected: received (%v); expected (%v)", err, ErrIncompleteResult)
+	}
+}
@@ -1,33 +1,80 @@
 package external
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 	"wex/src/application"
+	"wex/src/logging"
+	"wex/src/ratelimit"
+	"wex/src/tracing"
 )
 
 const TreasuryApi string = "https://api.fiscaldata.treasury.gov"
 
+// TreasuryProvider names the Treasury as the source of conversion rates.
+const TreasuryProvider string = "fiscaldata.treasury.gov/rates_of_exchange"
+
+const (
+	ratesOfExchangePath = "/services/api/fiscal_service/v1/accounting/od/rates_of_exchange"
+	// page size used when none is configured, same as the api default
+	defaultPageSize = 100
+	// largest page size accepted by the api
+	maxPageSize = 10000
+)
+
+// FiscalDataInterface gives the rates of exchange. The context is the one of
+// the request the rates are needed for, upstream calls are logged with its
+// logger and carry its request id.
 type FiscalDataInterface interface {
-	QueryRates(
-		country, currency string, date application.Time) ([]map[string]string, error)
+	QueryRates(ctx context.Context,
+		currencies []string, from, to application.Time) ([]application.ExchangeRate, error)
 }
 
 type FiscalDataMiddleware struct {
 	ExternalApi string
+	// number of records requested per page, defaults to 100
+	PageSize int
+	// throttles the requests sent to the api, unlimited when nil
+	Limiter *ratelimit.Bucket
+	// told about every request sent to the api once answered: its status,
+	// 0 when no response was received, how long it took and the error that
+	// failed it, if any
+	ObserveRequest func(status int, took time.Duration, err error)
 }
 
-func (f FiscalDataMiddleware) QueryRates(
-	country, currency string, date application.Time) ([]map[string]string, error) {
+// QueryRates returns every rate published for the currencies, given as
+// country_currency_desc values ("Mexico-Peso"), with a record date between
+// from and to (inclusive), most recent first. All currencies are requested
+// in a single query and all pages of the response are fetched.
+func (f FiscalDataMiddleware) QueryRates(ctx context.Context,
+	currencies []string, from, to application.Time) ([]application.ExchangeRate, error) {
 
-	countryCurrencyDesc := fmt.Sprintf("%s-%s", country, currency)
+	it := f.IterateRates(ctx, currencies, from, to)
 
-	dateLowerBound := date.AddDate(0, -6, 0)
-	currency_filter := fmt.Sprintf("(%s)", countryCurrencyDesc)
-	date_filter := fmt.Sprintf("gte:%s,lte:%s", dateLowerBound.Format(time.DateOnly), date.ToString())
+	var rates []application.ExchangeRate
+	for it.Next() {
+		rates = append(rates, it.Rate())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+// IterateRates returns an iterator over the same rates as QueryRates, fetching
+// one page at a time as it advances.
+func (f FiscalDataMiddleware) IterateRates(ctx context.Context,
+	currencies []string, from, to application.Time) *RateIterator {
+
+	currency_filter := fmt.Sprintf("(%s)", strings.Join(currencies, ","))
+	date_filter := fmt.Sprintf("gte:%s,lte:%s", from.ToString(), to.ToString())
 
 	params := url.Values{}
 	params.Add("fields", "country_currency_desc,exchange_rate,record_date")
@@ -36,22 +83,130 @@ func (f FiscalDataMiddleware) QueryRates(
 			fmt.Sprintf("record_date:%s", date_filter))
 	params.Add("sort", "-record_date")
 
-	completeUrl, _ := url.Parse(f.ExternalApi)
-	completeUrl.Path = "/services/api/fiscal_service/v1/accounting/od/rates_of_exchange"
+	return &RateIterator{records: recordIterator{ctx: ctx, middleware: f, params: params}}
+}
 
-	v, _ := url.QueryUnescape(params.Encode())
-	completeUrl.RawQuery = v
+// Ping requests a single record of the rates_of_exchange dataset, telling
+// whether the api is reachable.
+func (f FiscalDataMiddleware) Ping(ctx context.Context) error {
+	params := url.Values{}
+	params.Add("fields", "record_date")
+	params.Add("sort", "-record_date")
+	f.PageSize = 1
+	_, err := f.fetchPage(ctx, params, 1)
+	return err
+}
+
+func (f FiscalDataMiddleware) pageSize() int {
+	if f.PageSize <= 0 {
+		return defaultPageSize
+	}
+	if f.PageSize > maxPageSize {
+		return maxPageSize
+	}
+	return f.PageSize
+}
+
+// queryEscaper escapes the characters that would break a query value, keeping
+// the filter syntax (":", ",", "(", ")", "[", "]") readable as in the api docs.
+var queryEscaper = strings.NewReplacer(
+	"%", "%25", " ", "%20", "&", "%26", "+", "%2B", "#", "%23", "=", "%3D")
 
-	res, err := http.Get(completeUrl.String())
+func encodeQuery(params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		for _, value := range params[key] {
+			parts = append(parts, queryEscaper.Replace(key)+"="+queryEscaper.Replace(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+type pageMeta struct {
+	Count      int `json:"count"`
+	TotalCount int `json:"total-count"`
+	TotalPages int `json:"total-pages"`
+}
+
+type ratesPage struct {
+	Data []map[string]string `json:"data"`
+	Meta pageMeta            `json:"meta"`
+}
+
+// fetchPage requests a single page of the rates_of_exchange dataset.
+func (f FiscalDataMiddleware) fetchPage(ctx context.Context, params url.Values, number int) (page ratesPage, err error) {
+	ctx, span := tracing.Start(ctx, "GET rates_of_exchange", tracing.KindClient)
+	defer func() {
+		span.Fail(err)
+		span.End()
+	}()
+	span.Set("http.request.method", http.MethodGet)
+	span.Set("treasury.page", number)
+
+	pageParams := url.Values{}
+	for key, values := range params {
+		pageParams[key] = values
+	}
+	pageParams.Set("page[number]", strconv.Itoa(number))
+	pageParams.Set("page[size]", strconv.Itoa(f.pageSize()))
+
+	completeUrl, err := url.Parse(f.ExternalApi)
 	if err != nil {
-		return nil, err
+		return page, err
 	}
+	completeUrl.Path = ratesOfExchangePath
 
-	var resp map[string][]map[string]string
+	completeUrl.RawQuery = encodeQuery(pageParams)
 
-	err = json.NewDecoder(res.Body).Decode(&resp)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, completeUrl.String(), nil)
 	if err != nil {
-		return nil, err
+		return page, err
+	}
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set(logging.RequestIDHeader, id)
+	}
+	tracing.Inject(ctx, req.Header)
+	span.Set("url.full", completeUrl.String())
+
+	if f.Limiter != nil {
+		if err = f.Limiter.Wait(ctx); err != nil {
+			return page, err
+		}
+	}
+	logger := logging.FromContext(ctx)
+	started := time.Now()
+	status := 0
+	observe := func(err error) {
+		if f.ObserveRequest != nil {
+			f.ObserveRequest(status, time.Since(started), err)
+		}
 	}
-	return resp["data"], nil
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Warn("Treasury request failed", "page", number, "error", err)
+		observe(err)
+		return page, err
+	}
+	defer res.Body.Close()
+	status = res.StatusCode
+	span.Set("http.response.status_code", status)
+	logger.Debug("Treasury request", "page", number, "status", res.StatusCode,
+		"latencyMs", float64(time.Since(started).Microseconds())/1000)
+
+	if res.StatusCode != http.StatusOK {
+		logger.Warn("Treasury request refused", "page", number, "status", res.StatusCode)
+		err = fmt.Errorf("Treasury api returned status %v", res.StatusCode)
+		observe(err)
+		return page, err
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&page)
+	observe(err)
+	return page, err
 }
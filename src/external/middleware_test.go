@@ -1,12 +1,18 @@
 package external
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 	"wex/src/application"
+	"wex/src/external/fiscaltest"
+	"wex/src/logging"
+	"wex/src/ratelimit"
+	"wex/src/tracing"
 )
 
 func TestExternalCall(t *testing.T) {
@@ -14,6 +20,7 @@ func TestExternalCall(t *testing.T) {
 	date := time.Now()
 	country := "Mexico"
 	currency := "Peso"
+	caller, _ := tracing.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		expectedPath := "/services/api/fiscal_service/v1/accounting/od/rates_of_exchange"
@@ -27,8 +34,10 @@ func TestExternalCall(t *testing.T) {
 		}
 
 		filter := r.URL.Query().Get("filter")
-		if !strings.Contains(filter, "record_date") {
-			t.Error("Request without date filter")
+		expectedDates := fmt.Sprintf("record_date:gte:%s,lte:%s",
+			date.AddDate(0, -6, 0).Format(time.DateOnly), date.Format(time.DateOnly))
+		if !strings.Contains(filter, expectedDates) {
+			t.Errorf("Request without date filter %v: %v", expectedDates, filter)
 		}
 
 		sort := r.URL.Query().Get("sort")
@@ -36,17 +45,107 @@ func TestExternalCall(t *testing.T) {
 			t.Error("Request with wrong sort order")
 		}
 
+		if id := r.Header.Get(logging.RequestIDHeader); id != "request-1" {
+			t.Errorf("Request id not propagated, got %q", id)
+		}
+		traceparent, ok := tracing.ParseTraceparent(r.Header.Get(tracing.TraceparentHeader))
+		if !ok || traceparent.TraceID != caller.TraceID || traceparent.SpanID == caller.SpanID {
+			t.Errorf("Trace not propagated, got %q", r.Header.Get(tracing.TraceparentHeader))
+		}
+
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"data":[{"country_currency_desc":"Mexico-Peso","exchange_rate":"17.077","record_date":"2023-06-30"}]}`))
 	}))
 	defer server.Close()
 
-	f := FiscalDataMiddleware{server.URL}
+	f := FiscalDataMiddleware{ExternalApi: server.URL}
+
+	to := application.Time{Time: date}
+	from := application.Time{Time: date.AddDate(0, -6, 0)}
+	ctx := logging.WithRequestID(context.Background(), "request-1")
+	ctx = tracing.WithSpanContext(ctx, caller)
+	rates, err := f.QueryRates(ctx, []string{country + "-" + currency}, from, to)
+
+	if err != nil {
+		t.Errorf("Error querying rates: %v", err)
+	}
+
+	if len(rates) != 1 || rates[0].RecordDate.ToString() != "2023-06-30" {
+		t.Errorf("Unexpected rates parsed: %v", rates)
+	}
+}
+
+func TestExternalCallError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	var observed []int
+	f := FiscalDataMiddleware{ExternalApi: server.URL, ObserveRequest: func(status int, took time.Duration, err error) {
+		if err == nil {
+			t.Error("Failed request observed without error")
+		}
+		observed = append(observed, status)
+	}}
+	date := application.Time{Time: time.Now()}
+
+	if _, err := f.QueryRates(context.Background(), []string{"Mexico-Peso"}, date, date); err == nil {
+		t.Error("No error received for failed upstream call")
+	}
+
+	server.Close()
+	if _, err := f.QueryRates(context.Background(), []string{"Mexico-Peso"}, date, date); err == nil {
+		t.Error("No error received for unreachable api")
+	}
+	if len(observed) != 2 || observed[0] != http.StatusInternalServerError || observed[1] != 0 {
+		t.Errorf("Unexpected requests observed %v", observed)
+	}
+}
+
+func TestExternalCallManyCurrencies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter := r.URL.Query().Get("filter")
+		if !strings.Contains(filter, "country_currency_desc:in:(Mexico-Peso,Canada-Dollar)") {
+			t.Errorf("Request without currencies filter: %v", filter)
+		}
+		w.Write([]byte(`{"data":[
+			{"country_currency_desc":"Mexico-Peso","exchange_rate":"17.077","record_date":"2023-06-30"},
+			{"country_currency_desc":"Canada-Dollar","exchange_rate":"1.324","record_date":"2023-06-30"}]}`))
+	}))
+	defer server.Close()
 
-	_, err := f.QueryRates(
-		country, currency, application.Time{date})
+	f := FiscalDataMiddleware{ExternalApi: server.URL}
+	date := application.Time{Time: time.Now()}
 
+	rates, err := f.QueryRates(context.Background(), []string{"Mexico-Peso", "Canada-Dollar"}, date, date)
 	if err != nil {
 		t.Errorf("Error querying rates: %v", err)
 	}
+	if len(rates) != 2 || rates[1].CountryCurrency != "Canada-Dollar" {
+		t.Errorf("Unexpected rates parsed: %v", rates)
+	}
+}
+
+func TestExternalCallRateLimit(t *testing.T) {
+	handler := fiscaltest.NewHandler(fiscaltest.DefaultFixture())
+	server := fiscaltest.NewServer(handler)
+	defer server.Close()
+
+	// 4 pages of 5 records, a request every 20ms after the first
+	f := FiscalDataMiddleware{ExternalApi: server.URL, PageSize: 5, Limiter: ratelimit.NewBucket(50, 1)}
+	from, _ := application.NewTime("2020-01-01")
+	to, _ := application.NewTime("2020-12-31")
+
+	start := time.Now()
+	rates, err := f.QueryRates(context.Background(), []string{"Mexico-Peso", "Canada-Dollar", "Japan-Yen", "Euro Zone-Euro", "United Kingdom-Pound"}, from, to)
+	if err != nil || len(rates) != 20 {
+		t.Fatalf("Unexpected rates %v (%v)", rates, err)
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("Requests were not throttled, took %v", elapsed)
+	}
+	if handler.Requests() != 4 {
+		t.Errorf("Expected 4 requests, got %v", handler.Requests())
+	}
 }
@@ -0,0 +1,152 @@
+package external
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+	"wex/src/application"
+	"wex/src/tracing"
+)
+
+// DefaultPrefetchMonths is how far back from today the prefetch job fetches
+// rates, enough for conversions of the last six months with the default
+// six months window.
+const DefaultPrefetchMonths = 12
+
+type PrefetchStatus struct {
+	Running      bool       `json:"running"`
+	Runs         int        `json:"runs"`
+	LastRun      *time.Time `json:"lastRun,omitempty"`
+	LastSuccess  *time.Time `json:"lastSuccess,omitempty"`
+	LastError    string     `json:"lastError,omitempty"`
+	NextRun      *time.Time `json:"nextRun,omitempty"`
+	Currencies   []string   `json:"currencies"`
+	RatesFetched int        `json:"ratesFetched"`
+}
+
+// Prefetcher warms a RateCache on start and then every Interval with the
+// latest rates of the currencies listed by Currencies.
+type Prefetcher struct {
+	Cache *RateCache
+	// currencies to prefetch as country_currency_desc values
+	Currencies func(ctx context.Context) ([]string, error)
+	// zero runs the job only once, on start
+	Interval time.Duration
+	Months   int
+
+	mu     sync.Mutex
+	status PrefetchStatus
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Start runs the job in the background until Stop is called.
+func (p *Prefetcher) Start() {
+	p.mu.Lock()
+	// the goroutine keeps its own copy, Stop clears the field
+	stop := make(chan struct{})
+	p.stop = stop
+	p.mu.Unlock()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.Run()
+		if p.Interval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(p.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.Run()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *Prefetcher) Stop() {
+	p.mu.Lock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// Run prefetches the rates once. Runs requested while another one is in
+// progress are skipped.
+func (p *Prefetcher) Run() {
+	p.mu.Lock()
+	if p.status.Running {
+		p.mu.Unlock()
+		return
+	}
+	p.status.Running = true
+	started := time.Now().UTC()
+	p.status.LastRun = &started
+	p.mu.Unlock()
+
+	currencies, fetched, err := p.run()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.Running = false
+	p.status.Runs++
+	p.status.Currencies = currencies
+	if p.Interval > 0 {
+		next := started.Add(p.Interval)
+		p.status.NextRun = &next
+	}
+	if err != nil {
+		p.status.LastError = err.Error()
+		slog.Warn("Rate prefetch failed", "error", err)
+		return
+	}
+	p.status.LastError = ""
+	finished := time.Now().UTC()
+	p.status.LastSuccess = &finished
+	p.status.RatesFetched = fetched
+	slog.Info("Rate prefetch done", "rates", fetched, "currencies", len(currencies))
+}
+
+func (p *Prefetcher) run() (currencies []string, fetched int, err error) {
+	// the job is not made for a request, its logs go to the default logger
+	// and its spans start a trace of their own
+	ctx, span := tracing.Start(context.Background(), "Prefetch rates", tracing.KindInternal)
+	defer func() {
+		span.Set("currencies", len(currencies))
+		span.Set("rates", fetched)
+		span.Fail(err)
+		span.End()
+	}()
+
+	currencies, err = p.Currencies(ctx)
+	if err != nil || len(currencies) == 0 {
+		return currencies, 0, err
+	}
+
+	months := p.Months
+	if months <= 0 {
+		months = DefaultPrefetchMonths
+	}
+	now := time.Now().UTC()
+	to := application.Time{Time: time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)}
+	from := application.Time{Time: to.AddDate(0, -months, 0)}
+
+	fetched, err = p.Cache.Prefetch(ctx, currencies, from, to)
+	return currencies, fetched, err
+}
+
+func (p *Prefetcher) Status() PrefetchStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := p.status
+	status.Currencies = append([]string{}, p.status.Currencies...)
+	return status
+}
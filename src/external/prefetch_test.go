@@ -0,0 +1,54 @@
+package external
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"wex/src/external/fiscaltest"
+)
+
+func TestPrefetcher(t *testing.T) {
+	handler := fiscaltest.NewHandler(fiscaltest.DefaultFixture())
+	server := fiscaltest.NewServer(handler)
+	defer server.Close()
+
+	cache := NewRateCache(FiscalDataMiddleware{ExternalApi: server.URL})
+	prefetcher := Prefetcher{
+		Cache:      cache,
+		Currencies: func(context.Context) ([]string, error) { return []string{"Mexico-Peso", "Japan-Yen"}, nil },
+		Interval:   time.Hour,
+		// the fixture ends in 2023
+		Months: 12 * (time.Now().Year() - 2022),
+	}
+	prefetcher.Start()
+	defer prefetcher.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for prefetcher.Status().Runs == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	status := prefetcher.Status()
+	if status.LastSuccess == nil || status.LastError != "" || len(status.Currencies) != 2 || status.NextRun == nil {
+		t.Fatalf("Unexpected prefetch status %+v", status)
+	}
+
+	requests := handler.Requests()
+	rates, err := cache.QueryRates(context.Background(), []string{"Mexico-Peso", "Japan-Yen"}, date("2023-01-01"), date("2023-12-31"))
+	if err != nil || len(rates) != 8 {
+		t.Errorf("Unexpected prefetched rates %v (%v)", rates, err)
+	}
+	if handler.Requests() != requests {
+		t.Error("Prefetched rates were fetched again")
+	}
+	if status.RatesFetched < len(rates) {
+		t.Errorf("Expected at least %v rates fetched, got %v", len(rates), status.RatesFetched)
+	}
+
+	prefetcher.Currencies = func(context.Context) ([]string, error) { return nil, errors.New("no currencies") }
+	prefetcher.Run()
+	if status := prefetcher.Status(); status.LastError == "" || status.Runs != 2 {
+		t.Errorf("Expected failed run in status %+v", status)
+	}
+}
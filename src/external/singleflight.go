@@ -0,0 +1,126 @@
+package external
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"wex/src/application"
+)
+
+type flight[T any] struct {
+	done   chan struct{}
+	result T
+	err    error
+
+	// callers still waiting for the result, the upstream call is cancelled
+	// once every one of them has given up
+	waiting int
+	cancel  context.CancelFunc
+}
+
+// flightGroup shares the result of a call among the callers asking for the
+// same key while it is in flight.
+type flightGroup[T any] struct {
+	mu       sync.Mutex
+	inFlight map[string]*flight[T]
+}
+
+// do returns the result of the call in flight for key, starting call if
+// there is none. A caller whose ctx is done stops waiting, the call goes on
+// for the others.
+func (g *flightGroup[T]) do(ctx context.Context, key string,
+	call func(ctx context.Context) (T, error)) (T, error) {
+
+	g.mu.Lock()
+	if g.inFlight == nil {
+		g.inFlight = make(map[string]*flight[T])
+	}
+	f, ok := g.inFlight[key]
+	if !ok {
+		// the call keeps the values of ctx, its logger and span, but not its
+		// cancellation: the caller starting it may give up before the others
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight[T]{done: make(chan struct{}), cancel: cancel}
+		g.inFlight[key] = f
+		go g.call(callCtx, key, f, call)
+	}
+	f.waiting++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.waiting--
+		if f.waiting == 0 {
+			f.cancel()
+			// later callers start a call of their own
+			g.forget(key, f)
+		}
+		g.mu.Unlock()
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+func (g *flightGroup[T]) call(ctx context.Context, key string, f *flight[T],
+	call func(ctx context.Context) (T, error)) {
+
+	f.result, f.err = call(ctx)
+	f.cancel()
+
+	g.mu.Lock()
+	g.forget(key, f)
+	g.mu.Unlock()
+	close(f.done)
+}
+
+// forget must be called holding g.mu.
+func (g *flightGroup[T]) forget(key string, f *flight[T]) {
+	if g.inFlight[key] == f {
+		delete(g.inFlight, key)
+	}
+}
+
+// SingleFlight collapses concurrent identical QueryRates calls into a single
+// request to Source, whose result is shared by every caller.
+type SingleFlight struct {
+	Source FiscalDataInterface
+
+	flights flightGroup[[]application.ExchangeRate]
+}
+
+func NewSingleFlight(source FiscalDataInterface) *SingleFlight {
+	return &SingleFlight{Source: source}
+}
+
+// QueryRates returns the rates fetched by the call in flight for the same
+// query, starting one if there is none. A caller whose ctx is done stops
+// waiting, the call goes on for the others.
+func (s *SingleFlight) QueryRates(ctx context.Context,
+	currencies []string, from, to application.Time) ([]application.ExchangeRate, error) {
+
+	rates, err := s.flights.do(ctx, flightKey(currencies, from, to),
+		func(ctx context.Context) ([]application.ExchangeRate, error) {
+			return s.Source.QueryRates(ctx, currencies, from, to)
+		})
+	return copyRates(rates), err
+}
+
+// flightKey identifies a query regardless of the order of the currencies.
+func flightKey(currencies []string, from, to application.Time) string {
+	sorted := append([]string{}, currencies...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",") + "|" + from.ToString() + "|" + to.ToString()
+}
+
+// callers get their own copy, so that sorting or editing the rates does not
+// affect the others.
+func copyRates(rates []application.ExchangeRate) []application.ExchangeRate {
+	if rates == nil {
+		return nil
+	}
+	return append([]application.ExchangeRate{}, rates...)
+}
@@ -0,0 +1,179 @@
+package external
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"wex/src/application"
+)
+
+// blockingSource answers once release is closed, counting the calls.
+type blockingSource struct {
+	calls   atomic.Int32
+	release chan struct{}
+	err     error
+}
+
+func (b *blockingSource) QueryRates(ctx context.Context,
+	currencies []string, from, to application.Time) ([]application.ExchangeRate, error) {
+	b.calls.Add(1)
+	<-b.release
+	if b.err != nil {
+		return nil, b.err
+	}
+	rate, _ := application.NewExchangeRate(currencies[0], "17.077", to.ToString())
+	return []application.ExchangeRate{rate}, nil
+}
+
+func TestSingleFlight(t *testing.T) {
+	from, _ := application.NewTime("2023-01-01")
+	to, _ := application.NewTime("2023-06-30")
+
+	tests := []struct {
+		name          string
+		currencies    [][]string
+		expectedCalls int32
+		err           error
+	}{
+		{"identical queries", [][]string{{"Mexico-Peso"}, {"Mexico-Peso"}, {"Mexico-Peso"}}, 1, nil},
+		{"currencies in any order", [][]string{{"Mexico-Peso", "Japan-Yen"}, {"Japan-Yen", "Mexico-Peso"}}, 1, nil},
+		{"different queries", [][]string{{"Mexico-Peso"}, {"Japan-Yen"}}, 2, nil},
+		{"shared error", [][]string{{"Mexico-Peso"}, {"Mexico-Peso"}}, 1, errors.New("upstream failure")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := &blockingSource{release: make(chan struct{}), err: test.err}
+			s := NewSingleFlight(source)
+
+			var wg sync.WaitGroup
+			results := make([][]application.ExchangeRate, len(test.currencies))
+			errs := make([]error, len(test.currencies))
+			for i, currencies := range test.currencies {
+				wg.Add(1)
+				go func(i int, currencies []string) {
+					defer wg.Done()
+					results[i], errs[i] = s.QueryRates(context.Background(), currencies, from, to)
+				}(i, currencies)
+			}
+
+			// let every caller join before answering
+			deadline := time.Now().Add(time.Second)
+			for source.calls.Load() < test.expectedCalls && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(20 * time.Millisecond)
+			close(source.release)
+			wg.Wait()
+
+			if calls := source.calls.Load(); calls != test.expectedCalls {
+				t.Errorf("got %v upstream calls but expected %v", calls, test.expectedCalls)
+			}
+			for i := range test.currencies {
+				if test.err != nil && !errors.Is(errs[i], test.err) {
+					t.Errorf("caller %v got error %v but expected %v", i, errs[i], test.err)
+				}
+				if test.err == nil && len(results[i]) != 1 {
+					t.Errorf("caller %v got rates %v", i, results[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSingleFlightAfterCompletion(t *testing.T) {
+	source := &blockingSource{release: make(chan struct{})}
+	close(source.release)
+	s := NewSingleFlight(source)
+	date, _ := application.NewTime("2023-06-30")
+
+	s.QueryRates(context.Background(), []string{"Mexico-Peso"}, date, date)
+	s.QueryRates(context.Background(), []string{"Mexico-Peso"}, date, date)
+	if calls := source.calls.Load(); calls != 2 {
+		t.Errorf("completed queries should not be shared, got %v upstream calls", calls)
+	}
+}
+
+// waitingSource answers once release is closed, or gives up with its
+// context.
+type waitingSource struct {
+	calls     atomic.Int32
+	release   chan struct{}
+	cancelled chan struct{}
+}
+
+func (w *waitingSource) QueryRates(ctx context.Context,
+	currencies []string, from, to application.Time) ([]application.ExchangeRate, error) {
+	w.calls.Add(1)
+	select {
+	case <-w.release:
+		rate, _ := application.NewExchangeRate(currencies[0], "17.077", to.ToString())
+		return []application.ExchangeRate{rate}, nil
+	case <-ctx.Done():
+		close(w.cancelled)
+		return nil, ctx.Err()
+	}
+}
+
+func TestSingleFlightCancel(t *testing.T) {
+	from, _ := application.NewTime("2023-01-01")
+	to, _ := application.NewTime("2023-06-30")
+	currencies := []string{"Mexico-Peso"}
+
+	t.Run("caller giving up", func(t *testing.T) {
+		source := &waitingSource{release: make(chan struct{}), cancelled: make(chan struct{})}
+		s := NewSingleFlight(source)
+
+		first, cancel := context.WithCancel(context.Background())
+		firstErr := make(chan error)
+		go func() {
+			_, err := s.QueryRates(first, currencies, from, to)
+			firstErr <- err
+		}()
+		for source.calls.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		second := make(chan []application.ExchangeRate)
+		go func() {
+			rates, _ := s.QueryRates(context.Background(), currencies, from, to)
+			second <- rates
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		cancel()
+		if err := <-firstErr; err != context.Canceled {
+			t.Errorf("Caller giving up got %v", err)
+		}
+		close(source.release)
+		if rates := <-second; len(rates) != 1 {
+			t.Errorf("Waiting caller got rates %v", rates)
+		}
+		if calls := source.calls.Load(); calls != 1 {
+			t.Errorf("Expected a single upstream call, got %v", calls)
+		}
+	})
+
+	t.Run("every caller giving up", func(t *testing.T) {
+		source := &waitingSource{release: make(chan struct{}), cancelled: make(chan struct{})}
+		s := NewSingleFlight(source)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := s.QueryRates(ctx, currencies, from, to); err != context.DeadlineExceeded {
+			t.Errorf("Unexpected error %v", err)
+		}
+		select {
+		case <-source.cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("Upstream call not cancelled")
+		}
+
+		close(source.release)
+		if rates, err := s.QueryRates(context.Background(), currencies, from, to); err != nil || len(rates) != 1 {
+			t.Errorf("Later caller got %v (%v)", rates, err)
+		}
+	})
+}
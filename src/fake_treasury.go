@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"wex/src/external/fiscaltest"
+)
+
+// runFakeTreasury serves a stand-in of the Treasury Fiscal Data api, started
+// with `go run . fake-treasury`.
+func runFakeTreasury(args []string) error {
+	flags := flag.NewFlagSet("fake-treasury", flag.ExitOnError)
+	addr := flags.String("addr", ":4444", "address to listen on")
+	fixture := flags.String("fixture", "", "json file with the records served, defaults to the bundled dataset")
+	latency := flags.Duration("latency", 0, "delay added to every response")
+	errorRate := flags.Float64("error-rate", 0, "fraction of requests answered with 503")
+	malformedRate := flags.Float64("malformed-rate", 0, "fraction of requests answered with malformed json")
+	flags.Parse(args)
+
+	records := fiscaltest.DefaultFixture()
+	if *fixture != "" {
+		var err error
+		records, err = fiscaltest.LoadFixture(*fixture)
+		if err != nil {
+			return err
+		}
+	}
+
+	handler := fiscaltest.NewHandler(records)
+	handler.Faults = fiscaltest.Faults{
+		Latency:       *latency,
+		ErrorRate:     *errorRate,
+		MalformedRate: *malformedRate,
+	}
+
+	log.Printf("Fake Treasury api serving %v records on %v", len(records), *addr)
+	return http.ListenAndServe(*addr, handler)
+}
@@ -1,24 +1,30 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sort"
 	"strings"
 	"testing"
 	"time"
 	"wex/src/application"
+	"wex/src/auth"
+	"wex/src/external"
 	"wex/src/persistance"
 )
 
 func TestRegisterBadRequest(t *testing.T) {
-	driver := persistance.StartDriver()
+	driver := persistance.StartDriver(persistance.DefaultStorageFile)
 
 	req := httptest.NewRequest(http.MethodGet, "/registerTransaction", nil)
 	res := httptest.NewRecorder()
 
-	getRegisterTransaction(driver)(res, req)
+	getRegisterTransaction(oneTenant(driver), MockExternalApi{}, MockCatalog{}, testRateSelection)(res, req)
 
 	if res.Code != http.StatusBadRequest {
 		t.Errorf("got status %d but expected %d", res.Code, http.StatusBadRequest)
@@ -26,12 +32,12 @@ func TestRegisterBadRequest(t *testing.T) {
 }
 
 func TestQueryBadRequest(t *testing.T) {
-	driver := persistance.StartDriver()
+	driver := persistance.StartDriver(persistance.DefaultStorageFile)
 
 	req := httptest.NewRequest(http.MethodGet, "/queryTransaction", nil)
 	res := httptest.NewRecorder()
 
-	getQueryTransactionHandler(driver)(res, req)
+	getQueryTransactionHandler(oneTenant(driver))(res, req)
 
 	if res.Code != http.StatusBadRequest {
 		t.Errorf("got status %d but expected %d", res.Code, http.StatusBadRequest)
@@ -39,7 +45,7 @@ func TestQueryBadRequest(t *testing.T) {
 }
 
 func TestRegisterOK(t *testing.T) {
-	driver := persistance.StartDriver()
+	driver := persistance.StartDriver(persistance.DefaultStorageFile)
 	form := url.Values{}
 	form.Add("description", "Sample Transaction")
 	form.Add("date", time.Now().Format(time.RFC3339))
@@ -50,7 +56,7 @@ func TestRegisterOK(t *testing.T) {
 
 	res := httptest.NewRecorder()
 
-	getRegisterTransaction(driver)(res, req)
+	getRegisterTransaction(oneTenant(driver), MockExternalApi{}, MockCatalog{}, testRateSelection)(res, req)
 
 	if res.Code != http.StatusOK {
 		t.Errorf("got status %d but expected %d", res.Code, http.StatusOK)
@@ -65,8 +71,6 @@ func TestRegisterOK(t *testing.T) {
 
 	transactionId := resp["transactionId"]
 
-	time.Sleep(1 * time.Second)
-
 	param := url.Values{}
 	param.Add("transactionId", transactionId)
 
@@ -77,45 +81,312 @@ func TestRegisterOK(t *testing.T) {
 
 	res = httptest.NewRecorder()
 
-	getQueryTransactionHandler(driver)(res, req)
+	getQueryTransactionHandler(oneTenant(driver))(res, req)
 
 	if res.Code != http.StatusOK {
 		t.Errorf("got status %d but expected %d", res.Code, http.StatusOK)
 	}
+	if contentType := res.Result().Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("got content type %q but expected application/json", contentType)
+	}
+}
+
+// registerMockDriver keeps the last transaction registered.
+type registerMockDriver struct {
+	MockDriver
+	registered *application.Transaction
+}
+
+func (m registerMockDriver) RegisterTransaction(ctx context.Context, tran application.Transaction) (string, error) {
+	*m.registered = tran
+	return "182D05C0-DCC8-3EEC-119A-FB708B0A6BB8", nil
+}
+
+// failingMockDriver fails registrations with err, returning uid.
+type failingMockDriver struct {
+	MockDriver
+	uid string
+	err error
+}
+
+func (m failingMockDriver) RegisterTransaction(ctx context.Context, tran application.Transaction) (string, error) {
+	return m.uid, m.err
+}
+
+func TestRegisterStorageUnavailable(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		retryAfter string
+	}{
+		{"queue full", persistance.ErrQueueFull, "1"},
+		{"write failed", errors.New("disk full"), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			form := url.Values{"description": {"Sample Transaction"}, "date": {"2023-06-30"}, "amount": {"99.99"}}
+			req := httptest.NewRequest(http.MethodPost, "/registerTransaction", strings.NewReader(form.Encode()))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			res := httptest.NewRecorder()
+
+			driver := failingMockDriver{err: test.err}
+			getRegisterTransaction(oneTenant(driver), MockExternalApi{}, MockCatalog{}, testRateSelection)(res, req)
+
+			if res.Code != http.StatusServiceUnavailable {
+				t.Errorf("got status %d but expected %d", res.Code, http.StatusServiceUnavailable)
+			}
+			if retryAfter := res.Header().Get("Retry-After"); retryAfter != test.retryAfter {
+				t.Errorf("got Retry-After %q but expected %q", retryAfter, test.retryAfter)
+			}
+			if !strings.Contains(res.Body.String(), test.err.Error()) {
+				t.Errorf("Unexpected body %q", res.Body.String())
+			}
+		})
+	}
+}
+
+func TestRegisterNotDurable(t *testing.T) {
+	form := url.Values{"description": {"Sample Transaction"}, "date": {"2023-06-30"}, "amount": {"99.99"}}
+	req := httptest.NewRequest(http.MethodPost, "/registerTransaction", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	res := httptest.NewRecorder()
+
+	driver := failingMockDriver{uid: "182D05C0-DCC8-3EEC-119A-FB708B0A6BB8",
+		err: fmt.Errorf("%w: %w", persistance.ErrNotPersisted, context.DeadlineExceeded)}
+	getRegisterTransaction(oneTenant(driver), MockExternalApi{}, MockCatalog{}, testRateSelection)(res, req)
+
+	var resp struct {
+		TransactionId string `json:"transactionId"`
+		Durable       *bool  `json:"durable"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != http.StatusAccepted || resp.TransactionId != driver.uid || resp.Durable == nil || *resp.Durable {
+		t.Errorf("got status %d with %+v", res.Code, resp)
+	}
+}
+
+func TestRegisterForeignCurrency(t *testing.T) {
+	tests := []struct {
+		name     string
+		currency string
+		status   int
+		amount   string
+	}{
+		{"iso code", "MXN", http.StatusOK, "20.00"},
+		{"currency name", "Mexico-Peso", http.StatusOK, "20.00"},
+		{"no rate available", "Canada-Dollar", http.StatusBadRequest, ""},
+		{"unknown currency", "atlantis", http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var registered application.Transaction
+			driver := registerMockDriver{registered: &registered}
+
+			form := url.Values{}
+			form.Add("description", "Lunch in Mexico City")
+			form.Add("date", "2023-07-02")
+			form.Add("amount", "341.54")
+			form.Add("currency", test.currency)
+			req := httptest.NewRequest(
+				http.MethodPost, "/registerTransaction", strings.NewReader(form.Encode()))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			req = req.WithContext(auth.WithPrincipal(req.Context(), auth.Principal{KeyId: "k1"}))
+			res := httptest.NewRecorder()
+
+			getRegisterTransaction(oneTenant(driver), MockExternalApi{}, MockCatalog{}, testRateSelection)(res, req)
+
+			if res.Code != test.status {
+				t.Fatalf("got status %d but expected %d", res.Code, test.status)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+
+			var resp map[string]string
+			json.NewDecoder(res.Body).Decode(&resp)
+			if resp["amount"] != test.amount || resp["foreignAmount"] != "341.54" || resp["currency"] != "Mexico-Peso" {
+				t.Errorf("unexpected response %v", resp)
+			}
+			if registered.Amount.ToString() != test.amount || registered.Foreign == nil ||
+				registered.Foreign.Amount.ToString() != "341.54" || registered.Foreign.ExchangeRate.ToString() != "17.077" {
+				t.Errorf("unexpected transaction registered %+v", registered)
+			}
+			if registered.CreatedBy != "k1" {
+				t.Errorf("transaction not recorded with its key, got %q", registered.CreatedBy)
+			}
+		})
+	}
 }
 
 type MockExternalApi struct {
 }
 
-func (m MockExternalApi) QueryRates(
-	country, currency string, date application.Time) ([]map[string]string, error) {
+// QueryRates answers with a rate recorded on the last day of the window
+// requested for each currency, except for Canada-Dollar that has no rates.
+func (m MockExternalApi) QueryRates(ctx context.Context,
+	currencies []string, from, to application.Time) ([]application.ExchangeRate, error) {
+
+	var rates []application.ExchangeRate
+	for _, currency := range currencies {
+		if currency == "Canada-Dollar" {
+			continue
+		}
+		rate, err := application.NewExchangeRate(currency, "17.077", to.ToString())
+		if err != nil {
+			return nil, err
+		}
+		rates = append(rates, rate)
+	}
+	return rates, nil
 
-	mockResponse := []byte(`[{"country_currency_desc":"Mexico-Peso","exchange_rate":"17.077","record_date":"2023-06-30"}]`)
+}
 
-	var response []map[string]string
-	_ = json.Unmarshal(mockResponse, &response)
-	return response, nil
+type MockCatalog struct {
+}
 
+func (m MockCatalog) Currencies(ctx context.Context) ([]application.Currency, error) {
+	return []application.Currency{
+		application.NewCurrency("Mexico", "Peso"),
+		application.NewCurrency("Canada", "Dollar"),
+		application.NewCurrency("Euro Zone", "Euro"),
+	}, nil
+}
+
+func (m MockCatalog) ResolveCurrency(ctx context.Context, query string) (application.Currency, error) {
+	currencies, _ := m.Currencies(context.Background())
+	return application.MatchCurrency(currencies, query)
+}
+
+// unavailableCatalog fails as a catalog that could not be loaded.
+type unavailableCatalog struct {
+}
+
+func (m unavailableCatalog) Currencies(ctx context.Context) ([]application.Currency, error) {
+	return nil, errors.New("Treasury api returned status 503")
+}
+
+func (m unavailableCatalog) ResolveCurrency(ctx context.Context, query string) (application.Currency, error) {
+	return application.Currency{}, errors.New("Treasury api returned status 503")
+}
+
+func TestResolveCurrencyCatalogUnavailable(t *testing.T) {
+	tests := []struct {
+		name     string
+		country  string
+		currency string
+		expected string
+	}{
+		{"country_currency_desc", "", "Mexico-Peso", "Mexico-Peso"},
+		{"country and currency", "Euro Zone", "Euro", "Euro Zone-Euro"},
+		{"iso code", "", "MXN", ""},
+		{"words", "", "mexico peso", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			currency, err := resolveCurrency(context.Background(), unavailableCatalog{}, test.country, test.currency)
+			if test.expected == "" {
+				if err == nil {
+					t.Errorf("Expected an error, got %v", currency)
+				}
+				return
+			}
+			if err != nil || currency.CountryCurrency != test.expected {
+				t.Errorf("Expected %v, got %v %v", test.expected, currency, err)
+			}
+		})
+	}
 }
 
 type MockDriver struct {
 }
 
-func (m MockDriver) QueryTransaction(transactionId string) (application.IdentifiedTransaction, error) {
+func (m MockDriver) QueryTransaction(ctx context.Context, transactionId string) (application.IdentifiedTransaction, error) {
 
 	value, _ := application.NewMoney("10.59")
 	return application.IdentifiedTransaction{
 		Transaction: application.Transaction{
 			Description: "Mocking driver test",
 			Amount:      value,
-			Date:        application.Time{time.Now()},
+			Date:        application.Time{Time: time.Now()},
 		},
 		Uid: transactionId}, nil
 
 }
 
-func (m MockDriver) RegisterTransaction(tran application.Transaction) string {
-	return ""
+func (m MockDriver) RegisterTransaction(ctx context.Context, tran application.Transaction) (string, error) {
+	return "", nil
+}
+
+func (m MockDriver) UpdateTransaction(ctx context.Context, tran application.IdentifiedTransaction) error {
+	return nil
+}
+
+func (m MockDriver) DeleteTransaction(ctx context.Context, transactionId string) error {
+	return nil
+}
+
+func (m MockDriver) RecordConversion(ctx context.Context, conversion application.Conversion) error {
+	return nil
+}
+
+func (m MockDriver) QueryConversions(ctx context.Context, transactionId string) ([]application.Conversion, error) {
+	return nil, nil
+}
+
+func (m MockDriver) ListTransactions(ctx context.Context, filter application.TransactionFilter) ([]application.IdentifiedTransaction, error) {
+	transaction, _ := m.QueryTransaction(context.Background(), "182D05C0-DCC8-3EEC-119A-FB708B0A6BB8")
+	return []application.IdentifiedTransaction{transaction}, nil
+}
+
+// testTenants serves its drivers by tenant, tenants without one get an
+// empty memoryDriver.
+type testTenants struct {
+	drivers  map[string]persistance.PersistanceDriver
+	settings map[string]application.TenantSettings
+}
+
+// oneTenant serves driver to the default tenant.
+func oneTenant(driver persistance.PersistanceDriver) *testTenants {
+	return &testTenants{
+		drivers:  map[string]persistance.PersistanceDriver{auth.DefaultTenant: driver},
+		settings: make(map[string]application.TenantSettings),
+	}
+}
+
+func (t *testTenants) Tenant(name string) (persistance.PersistanceDriver, error) {
+	driver, ok := t.drivers[name]
+	if !ok {
+		driver = newMemoryDriver()
+		t.drivers[name] = driver
+	}
+	return driver, nil
+}
+
+func (t *testTenants) Names() []string {
+	var names []string
+	for name := range t.drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (t *testTenants) Settings(tenant string) (application.TenantSettings, error) {
+	return t.settings[tenant], nil
+}
+
+func (t *testTenants) SaveSettings(tenant string, settings application.TenantSettings) error {
+	t.settings[tenant] = settings
+	return nil
+}
+
+var testRateSelection = application.RateSelection{
+	Policy:       application.LatestRate,
+	WindowMonths: application.DefaultRateWindow,
 }
 
 func TestConversionHandle(t *testing.T) {
@@ -128,7 +399,7 @@ func TestConversionHandle(t *testing.T) {
 	params.Add("currency", "Peso")
 
 	v, _ := url.QueryUnescape(params.Encode())
-	url := "/convertTransaction" + v
+	url := "/convertTransaction?" + v
 
 	req := httptest.NewRequest(
 		http.MethodGet, url, nil)
@@ -136,10 +407,239 @@ func TestConversionHandle(t *testing.T) {
 
 	middleware := MockExternalApi{}
 
-	getConvertTransaction(driver, middleware)(res, req)
+	getConvertTransaction(oneTenant(driver), middleware, MockCatalog{}, testRateSelection)(res, req)
 
 	if res.Code != http.StatusOK {
 		t.Errorf("got status %d but expected %d", res.Code, http.StatusOK)
 	}
 
+	var resp map[string]string
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatalf("Could not parse json response: %v", err)
+	}
+	if resp["rateRecordDate"] != time.Now().Format(time.DateOnly) {
+		t.Errorf("got rate record date %v but expected %v",
+			resp["rateRecordDate"], time.Now().Format(time.DateOnly))
+	}
+	if resp["ratePolicy"] != string(application.LatestRate) {
+		t.Errorf("got rate policy %v but expected %v", resp["ratePolicy"], application.LatestRate)
+	}
+
+}
+
+func TestConversionRateSelection(t *testing.T) {
+
+	var tests = []struct {
+		query        string
+		expectedCode int
+	}{
+		{"policy=nearest&window=3", http.StatusOK},
+		{"policy=average", http.StatusOK},
+		{"recordDate=" + time.Now().Format(time.DateOnly), http.StatusOK},
+
+		{"policy=oldest", http.StatusBadRequest},
+		{"window=0", http.StatusBadRequest},
+		{"window=abc", http.StatusBadRequest},
+		{"policy=recordDate", http.StatusBadRequest},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.query, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet,
+				"/convertTransaction?transactionId=1&country=Mexico&currency=Peso&"+testCase.query, nil)
+			res := httptest.NewRecorder()
+
+			getConvertTransaction(oneTenant(MockDriver{}), MockExternalApi{}, MockCatalog{}, testRateSelection)(res, req)
+
+			if res.Code != testCase.expectedCode {
+				t.Errorf("got status %d but expected %d", res.Code, testCase.expectedCode)
+			}
+		})
+	}
+}
+
+func TestConversionCurrencyMatching(t *testing.T) {
+
+	var tests = []struct {
+		query            string
+		expectedCode     int
+		expectedCurrency string
+	}{
+		{"country=Mexico&currency=Peso", http.StatusOK, "Mexico-Peso"},
+		{"country=mexico&currency=peso", http.StatusOK, "Mexico-Peso"},
+		{"currency=mexico+peso", http.StatusOK, "Mexico-Peso"},
+		{"currency=MXN", http.StatusOK, "Mexico-Peso"},
+		{"currency=euro", http.StatusOK, "Euro Zone-Euro"},
+
+		{"currency=yen", http.StatusBadRequest, ""},
+		{"currency=", http.StatusBadRequest, ""},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.query, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet,
+				"/convertTransaction?transactionId=1&"+testCase.query, nil)
+			res := httptest.NewRecorder()
+
+			getConvertTransaction(oneTenant(MockDriver{}), MockExternalApi{}, MockCatalog{}, testRateSelection)(res, req)
+
+			if res.Code != testCase.expectedCode {
+				t.Fatalf("got status %d but expected %d", res.Code, testCase.expectedCode)
+			}
+			if res.Code != http.StatusOK {
+				return
+			}
+			var resp map[string]string
+			json.NewDecoder(res.Body).Decode(&resp)
+			if resp["currency"] != testCase.expectedCurrency {
+				t.Errorf("got currency %v but expected %v", resp["currency"], testCase.expectedCurrency)
+			}
+		})
+	}
+}
+
+func TestCurrenciesHandle(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/currencies", nil)
+	res := httptest.NewRecorder()
+
+	getCurrencies(MockCatalog{})(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Errorf("got status %d but expected %d", res.Code, http.StatusOK)
+	}
+
+	var resp []map[string]any
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatalf("Could not parse json response: %v", err)
+	}
+	if len(resp) != 3 || resp[0]["countryCurrency"] != "Mexico-Peso" || resp[0]["isoCode"] != "MXN" {
+		t.Errorf("Unexpected currency list %v", resp)
+	}
+}
+
+func TestConversionManyCurrencies(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet,
+		"/convertTransaction?transactionId=1&currency=MXN&currency=euro&currencies=canada,yen", nil)
+	res := httptest.NewRecorder()
+
+	getConvertTransaction(oneTenant(MockDriver{}), MockExternalApi{}, MockCatalog{}, testRateSelection)(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d but expected %d", res.Code, http.StatusOK)
+	}
+
+	var resp struct {
+		Uid         string               `json:"uid"`
+		Conversions []currencyConversion `json:"conversions"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatalf("Could not parse json response: %v", err)
+	}
+
+	expected := []struct {
+		currency string
+		failed   bool
+	}{
+		{"Mexico-Peso", false},
+		{"Euro Zone-Euro", false},
+		{"Canada-Dollar", true},
+		{"yen", true},
+	}
+	if len(resp.Conversions) != len(expected) {
+		t.Fatalf("got %v conversions but expected %v", len(resp.Conversions), len(expected))
+	}
+	for i, e := range expected {
+		conversion := resp.Conversions[i]
+		if conversion.Currency != e.currency {
+			t.Errorf("got currency %v but expected %v", conversion.Currency, e.currency)
+		}
+		if (conversion.Error != "") != e.failed {
+			t.Errorf("unexpected conversion result for %v: %v", e.currency, conversion)
+		}
+		if !e.failed && conversion.ConvertedValue != "180.85" {
+			t.Errorf("got converted value %v but expected 180.85", conversion.ConvertedValue)
+		}
+	}
+}
+
+func TestConversionTooManyCurrencies(t *testing.T) {
+	currencies := strings.Repeat("MXN,", maxTargetCurrencies+1)
+	req := httptest.NewRequest(http.MethodGet,
+		"/convertTransaction?transactionId=1&currencies="+currencies, nil)
+	res := httptest.NewRecorder()
+
+	getConvertTransaction(oneTenant(MockDriver{}), MockExternalApi{}, MockCatalog{}, testRateSelection)(res, req)
+
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("got status %d but expected %d", res.Code, http.StatusBadRequest)
+	}
+}
+
+// historyMockDriver keeps the conversions recorded in memory.
+type historyMockDriver struct {
+	MockDriver
+	conversions *[]application.Conversion
+}
+
+func (m historyMockDriver) RecordConversion(ctx context.Context, conversion application.Conversion) error {
+	*m.conversions = append(*m.conversions, conversion)
+	return nil
+}
+
+func (m historyMockDriver) QueryConversions(ctx context.Context, transactionId string) ([]application.Conversion, error) {
+	return *m.conversions, nil
+}
+
+func TestConversionHistory(t *testing.T) {
+	var conversions []application.Conversion
+	driver := historyMockDriver{conversions: &conversions}
+
+	convert := func(query string) map[string]string {
+		req := httptest.NewRequest(http.MethodGet, "/convertTransaction?transactionId=1&"+query, nil)
+		res := httptest.NewRecorder()
+		getConvertTransaction(oneTenant(driver), MockExternalApi{}, MockCatalog{}, testRateSelection)(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("got status %d but expected %d", res.Code, http.StatusOK)
+		}
+		var resp map[string]string
+		json.NewDecoder(res.Body).Decode(&resp)
+		return resp
+	}
+
+	first := convert("currency=MXN")
+	if len(conversions) != 1 || first["stored"] != "" {
+		t.Fatalf("expected conversion to be recorded, got %v", conversions)
+	}
+	recorded := conversions[0]
+	if recorded.Currency != "Mexico-Peso" || recorded.ConvertedValue.ToString() != first["convertedValue"] ||
+		recorded.Provider != external.TreasuryProvider || recorded.RatePolicy != application.LatestRate {
+		t.Errorf("unexpected conversion recorded %v", recorded)
+	}
+
+	stored := convert("currency=MXN&stored=true")
+	if len(conversions) != 1 {
+		t.Errorf("stored conversion should not be recorded again, got %v", conversions)
+	}
+	if stored["stored"] != "true" || stored["convertedAt"] != first["convertedAt"] {
+		t.Errorf("expected stored conversion, got %v", stored)
+	}
+
+	// a different policy is not answered by the stored conversion
+	convert("currency=MXN&stored=true&policy=nearest")
+	if len(conversions) != 2 {
+		t.Errorf("expected a new conversion to be recorded, got %v", conversions)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/conversions?transactionId=1", nil)
+	res := httptest.NewRecorder()
+	getConversions(oneTenant(driver))(res, req)
+
+	var history []application.Conversion
+	if err := json.NewDecoder(res.Body).Decode(&history); err != nil {
+		t.Fatalf("Could not parse json response: %v", err)
+	}
+	if len(history) != 2 || !history[0].Timestamp.Equal(conversions[0].Timestamp) ||
+		history[0].ConvertedValue.ToString() != conversions[0].ConvertedValue.ToString() {
+		t.Errorf("unexpected conversion history %v", history)
+	}
 }
@@ -0,0 +1,230 @@
+// Package health runs the checks telling whether the server can take
+// traffic and answers the liveness and readiness probes of an orchestrator.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Check returns what it found, e.g. "cache warm", or the error that makes
+// the server not ready. It must return once ctx is done.
+type Check func(ctx context.Context) (string, error)
+
+const (
+	StatusOK       = "ok"
+	StatusFailed   = "fail"
+	StatusReady    = "ready"
+	StatusNotReady = "not ready"
+)
+
+// DefaultTimeout is how long checks are given when none is configured.
+const DefaultTimeout = 2 * time.Second
+
+type Result struct {
+	Status string `json:"status"`
+	// the server is not ready when a required check fails
+	Required  bool    `json:"required"`
+	Message   string  `json:"message,omitempty"`
+	LatencyMs float64 `json:"latencyMs"`
+}
+
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+func (r Report) Ready() bool {
+	return r.Status == StatusReady
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker runs the readiness checks. Every check is run and reported, only
+// the required ones decide whether the server is ready.
+type Checker struct {
+	Timeout time.Duration
+
+	checks   []namedCheck
+	required map[string]bool
+}
+
+func NewChecker() *Checker {
+	return &Checker{Timeout: DefaultTimeout, required: make(map[string]bool)}
+}
+
+// Add adds a check, required until Require says otherwise.
+func (c *Checker) Add(name string, check Check) {
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+	c.required[name] = true
+}
+
+var ErrUnknownCheck = errors.New("Unknown readiness check")
+
+// Require makes the named checks the only ones deciding readiness.
+func (c *Checker) Require(names ...string) error {
+	known := make([]string, 0, len(c.checks))
+	required := make(map[string]bool)
+	for _, check := range c.checks {
+		known = append(known, check.name)
+		required[check.name] = false
+	}
+	for _, name := range names {
+		if _, ok := required[name]; !ok {
+			sort.Strings(known)
+			return fmt.Errorf("%w: %q should be one of %v", ErrUnknownCheck, name, strings.Join(known, ", "))
+		}
+		required[name] = true
+	}
+	c.required = required
+	return nil
+}
+
+// Run runs every check at once, each with Timeout to answer.
+func (c *Checker) Run(ctx context.Context) Report {
+	report := Report{Status: StatusReady, Checks: make(map[string]Result, len(c.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range c.checks {
+		wg.Add(1)
+		go func(check namedCheck) {
+			defer wg.Done()
+			result := c.run(ctx, check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[check.name] = result
+			if result.Required && result.Status != StatusOK {
+				report.Status = StatusNotReady
+			}
+		}(check)
+	}
+	wg.Wait()
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, check namedCheck) Result {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	started := time.Now()
+	message, err := check.check(ctx)
+	result := Result{
+		Status:    StatusOK,
+		Required:  c.required[check.name],
+		Message:   message,
+		LatencyMs: float64(time.Since(started).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = StatusFailed
+		result.Message = err.Error()
+	}
+	return result
+}
+
+// ReadyHandler answers 200 OK when every required check passes and 503
+// Service Unavailable otherwise, with the result of each check.
+func (c *Checker) ReadyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := c.Run(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if !report.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// Live answers 200 OK as long as the process serves requests.
+func Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"status": StatusOK})
+}
+
+// Cached answers with the last result of check for ttl, so that frequent
+// probes do not reach an upstream service every time. Probes arriving while
+// the check runs wait for its result rather than running it again; results
+// of checks cut short by their ctx are not kept.
+func Cached(check Check, ttl time.Duration) Check {
+	c := &cachedCheck{check: check, ttl: ttl}
+	return c.run
+}
+
+type cachedCheck struct {
+	check Check
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	message string
+	err     error
+	// check in progress, nil when none is
+	running *checkRun
+}
+
+type checkRun struct {
+	done    chan struct{}
+	message string
+	err     error
+	// the ctx of the probe that started the check was done before it
+	// returned
+	cutShort bool
+}
+
+func (c *cachedCheck) run(ctx context.Context) (string, error) {
+	for {
+		c.mu.Lock()
+		if !c.checked.IsZero() && time.Since(c.checked) < c.ttl {
+			defer c.mu.Unlock()
+			return c.message, c.err
+		}
+		run := c.running
+		if run == nil {
+			run = &checkRun{done: make(chan struct{})}
+			c.running = run
+			go c.start(ctx, run)
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-run.done:
+			// a check cut short by the probe that started it is run again
+			// for the probes still waiting
+			if !run.cutShort || ctx.Err() != nil {
+				return run.message, run.err
+			}
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+func (c *cachedCheck) start(ctx context.Context, run *checkRun) {
+	run.message, run.err = c.check(ctx)
+	run.cutShort = ctx.Err() != nil
+
+	c.mu.Lock()
+	c.running = nil
+	// a check cut short tells nothing of the service, it is not kept
+	if !run.cutShort && !errors.Is(run.err, context.Canceled) && !errors.Is(run.err, context.DeadlineExceeded) {
+		c.checked, c.message, c.err = time.Now(), run.message, run.err
+	}
+	c.mu.Unlock()
+	close(run.done)
+}
@@ -0,0 +1,164 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func passing(ctx context.Context) (string, error) {
+	return "fine", nil
+}
+
+func failing(ctx context.Context) (string, error) {
+	return "", errors.New("broken")
+}
+
+func blocking(ctx context.Context) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestReadyHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		required []string
+		status   int
+	}{
+		{"every check required", []string{"storage", "rates", "slow"}, http.StatusServiceUnavailable},
+		{"failing check not required", []string{"storage"}, http.StatusOK},
+		{"timed out check required", []string{"storage", "slow"}, http.StatusServiceUnavailable},
+		{"no check required", nil, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checker := NewChecker()
+			checker.Timeout = 10 * time.Millisecond
+			checker.Add("storage", passing)
+			checker.Add("rates", failing)
+			checker.Add("slow", blocking)
+			if err := checker.Require(test.required...); err != nil {
+				t.Fatal(err)
+			}
+
+			res := httptest.NewRecorder()
+			checker.ReadyHandler()(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if res.Code != test.status {
+				t.Errorf("Expected status %v, got %v", test.status, res.Code)
+			}
+
+			var report Report
+			if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Ready() != (test.status == http.StatusOK) {
+				t.Errorf("Unexpected report status %v", report.Status)
+			}
+			if len(report.Checks) != 3 {
+				t.Errorf("Expected every check reported, got %v", report.Checks)
+			}
+			storage := report.Checks["storage"]
+			if storage.Status != StatusOK || storage.Message != "fine" {
+				t.Errorf("Unexpected storage result %+v", storage)
+			}
+			rates := report.Checks["rates"]
+			if rates.Status != StatusFailed || rates.Message != "broken" || rates.Required != (len(test.required) == 3) {
+				t.Errorf("Unexpected rates result %+v", rates)
+			}
+			if slow := report.Checks["slow"]; slow.Status != StatusFailed {
+				t.Errorf("Timed out check passed %+v", slow)
+			}
+		})
+	}
+}
+
+func TestRequireUnknown(t *testing.T) {
+	checker := NewChecker()
+	checker.Add("storage", passing)
+	if err := checker.Require("storage", "disk"); !errors.Is(err, ErrUnknownCheck) {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestCached(t *testing.T) {
+	calls := 0
+	check := Cached(func(ctx context.Context) (string, error) {
+		calls++
+		return "", errors.New("unreachable")
+	}, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if _, err := check(context.Background()); err == nil {
+			t.Error("Cached error not returned")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected a single call, got %v", calls)
+	}
+}
+
+func TestCachedCancelled(t *testing.T) {
+	calls := 0
+	check := Cached(func(ctx context.Context) (string, error) {
+		calls++
+		return "", ctx.Err()
+	}, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	check(ctx)
+	if _, err := check(context.Background()); err != nil || calls != 2 {
+		t.Errorf("Cancelled check cached: %v after %v calls", err, calls)
+	}
+	if _, err := check(context.Background()); err != nil || calls != 2 {
+		t.Errorf("Passing check not cached: %v after %v calls", err, calls)
+	}
+}
+
+func TestCachedConcurrent(t *testing.T) {
+	var calls atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	check := Cached(func(ctx context.Context) (string, error) {
+		calls.Add(1)
+		close(started)
+		<-release
+		return "reachable", nil
+	}, time.Hour)
+
+	result := make(chan string)
+	go func() {
+		message, _ := check(context.Background())
+		result <- message
+	}()
+	<-started
+
+	// a probe arriving meanwhile waits for the same check, and is not held
+	// past its own ctx
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := check(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the probe to give up, got %v", err)
+	}
+
+	close(release)
+	if message := <-result; message != "reachable" {
+		t.Errorf("Unexpected result %q", message)
+	}
+	if message, _ := check(context.Background()); message != "reachable" || calls.Load() != 1 {
+		t.Errorf("Expected a single call, got %v", calls.Load())
+	}
+}
+
+func TestLive(t *testing.T) {
+	res := httptest.NewRecorder()
+	Live(res, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if res.Code != http.StatusOK || res.Body.String() != "{\"status\":\"ok\"}\n" {
+		t.Errorf("Unexpected answer %v %q", res.Code, res.Body.String())
+	}
+}
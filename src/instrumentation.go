@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strconv"
+	"time"
+	"wex/src/external"
+	"wex/src/metrics"
+	"wex/src/persistance"
+	"wex/src/tracing"
+)
+
+// storageMetrics exposes the writes waiting to be persisted and how long
+// they take. It sets the flush observer of tenants, it must be called before
+// the store is used.
+func storageMetrics(registry *metrics.Registry, tenants *persistance.TenantStore) {
+	registry.GaugeFunc("wex_storage_queue_depth",
+		"Writes waiting for the persist goroutines of every tenant.",
+		func() float64 { return float64(tenants.QueueDepth()) })
+	flushes := registry.Histogram("wex_storage_flush_duration_seconds",
+		"Time taken to write a storage file by file.", metrics.DefaultBuckets, "file")
+	tenants.ObserveFlush = func(file string, took time.Duration) {
+		flushes.Observe(took.Seconds(), file)
+	}
+}
+
+// treasuryMetrics returns the observer of the requests sent to the Treasury
+// api, counting their latency by status and their errors.
+func treasuryMetrics(registry *metrics.Registry) func(int, time.Duration, error) {
+	requests := registry.Histogram("wex_treasury_request_duration_seconds",
+		`Time taken by the Treasury api to answer by status, "error" when no response was received.`,
+		metrics.DefaultBuckets, "status")
+	failures := registry.Counter("wex_treasury_request_errors_total",
+		"Requests to the Treasury api that failed, whatever the reason.")
+	// exposed before the first error, so that rates can be computed
+	failures.Add(0)
+
+	return func(status int, took time.Duration, err error) {
+		label := "error"
+		if status != 0 {
+			label = strconv.Itoa(status)
+		}
+		requests.Observe(took.Seconds(), label)
+		if err != nil {
+			failures.Inc()
+		}
+	}
+}
+
+// startTracing makes the spans of the server exported to file or to the
+// collector at endpoint, and exposes how many could not be. The tracer
+// returned is shut down when the server exits, exporting the last spans.
+func startTracing(registry *metrics.Registry, file, endpoint string) (*tracing.Tracer, error) {
+	var exporter tracing.Exporter
+	switch {
+	case file != "":
+		fileExporter, err := tracing.NewFileExporter(file)
+		if err != nil {
+			return nil, err
+		}
+		exporter = fileExporter
+	case endpoint != "":
+		exporter = tracing.CollectorExporter{Endpoint: endpoint}
+	}
+	tracer := tracing.NewTracer("wex", exporter)
+	tracing.SetDefault(tracer)
+
+	registry.CounterFunc("wex_trace_spans_dropped_total",
+		"Spans dropped because the trace exporter could not keep up.",
+		func() float64 { return float64(tracer.Dropped()) })
+	return tracer, nil
+}
+
+// rateCacheMetrics exposes how many currency lookups the rate cache
+// answered.
+func rateCacheMetrics(registry *metrics.Registry, cache *external.RateCache) {
+	registry.CounterFunc("wex_rate_cache_hits_total",
+		"Currency lookups answered from the rate cache.",
+		func() float64 { hits, _ := cache.Stats(); return float64(hits) })
+	registry.CounterFunc("wex_rate_cache_misses_total",
+		"Currency lookups that had to be fetched from the Treasury api.",
+		func() float64 { _, misses := cache.Stats(); return float64(misses) })
+	registry.GaugeFunc("wex_rate_cache_hit_ratio",
+		"Share of the currency lookups answered from the rate cache since start.",
+		func() float64 {
+			hits, misses := cache.Stats()
+			if hits+misses == 0 {
+				return 0
+			}
+			return float64(hits) / float64(hits+misses)
+		})
+}
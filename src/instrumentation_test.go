@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"wex/src/application"
+	"wex/src/auth"
+	"wex/src/external"
+	"wex/src/metrics"
+	"wex/src/persistance"
+	"wex/src/tracing"
+)
+
+func TestInstrumentation(t *testing.T) {
+	registry := metrics.NewRegistry()
+
+	observe := treasuryMetrics(registry)
+	observe(http.StatusOK, 20*time.Millisecond, nil)
+	observe(http.StatusTooManyRequests, 5*time.Millisecond, errors.New("Treasury api returned status 429"))
+	observe(0, time.Second, errors.New("connection refused"))
+
+	cache := external.NewRateCache(MockExternalApi{})
+	rateCacheMetrics(registry, cache)
+	date := application.Time{Time: time.Date(2023, 6, 30, 0, 0, 0, 0, time.UTC)}
+	for i := 0; i < 4; i++ {
+		cache.QueryRates(context.Background(), []string{"Mexico-Peso"}, date, date)
+	}
+
+	res := httptest.NewRecorder()
+	registry.Handler()(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{
+		`wex_treasury_request_duration_seconds_count{status="200"} 1`,
+		`wex_treasury_request_duration_seconds_bucket{status="429",le="0.005"} 1`,
+		`wex_treasury_request_duration_seconds_count{status="error"} 1`,
+		`wex_treasury_request_errors_total 2`,
+		`wex_rate_cache_hits_total 3`,
+		`wex_rate_cache_misses_total 1`,
+		`wex_rate_cache_hit_ratio 0.75`,
+	} {
+		if !strings.Contains(res.Body.String(), line+"\n") {
+			t.Errorf("missing %v in\n%v", line, res.Body.String())
+		}
+	}
+}
+
+func TestStartTracing(t *testing.T) {
+	previous := tracing.Default()
+	defer tracing.SetDefault(previous)
+
+	dir := t.TempDir()
+	registry := metrics.NewRegistry()
+	tracer, err := startTracing(registry, filepath.Join(dir, "spans.json"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := startTracing(metrics.NewRegistry(), filepath.Join(dir, "missing", "spans.json"), ""); err == nil {
+		t.Error("No error received for unwritable trace file")
+	}
+
+	tenants := persistance.OpenTenantStore(filepath.Join(dir, "db.json"))
+	cache := external.NewRateCache(MockExternalApi{})
+	handler := tracing.Middleware("/convertTransaction", func(w http.ResponseWriter, r *http.Request) {
+		driver, _ := tenants.Tenant(auth.DefaultTenant)
+		driver.QueryTransaction(r.Context(), "missing")
+		date := application.Time{Time: time.Date(2023, 6, 30, 0, 0, 0, 0, time.UTC)}
+		cache.QueryRates(r.Context(), []string{"Mexico-Peso"}, date, date)
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/convertTransaction", nil))
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "spans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{`"GET /convertTransaction"`, `"PersistanceDriver.QueryTransaction"`, `"RateCache.QueryRates"`} {
+		if !strings.Contains(string(content), name) {
+			t.Errorf("Span %v not exported in %s", name, content)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"wex/src/auth"
+	"wex/src/config"
+	"wex/src/persistance"
+)
+
+const keysUsage = `usage: keys <command> [flags]
+
+commands:
+  create -name NAME -scopes read,write,convert,admin [-tenant TENANT]
+  list
+  revoke -id ID
+  rotate -id ID`
+
+// runKeys manages the API keys, started with `go run . keys`. Keys are
+// stored next to the transactions of the storage file the server is
+// configured with, read from -config, -storage-file and the environment as
+// the server does; a running server picks up the changes right away.
+func runKeys(args []string, getenv func(string) string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(keysUsage)
+	}
+	command := args[0]
+
+	flags := flag.NewFlagSet("keys "+command, flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.String("config", "", "json config file of the server")
+	flags.String("storage-file", "", "json file the transactions are stored in")
+	name := flags.String("name", "", "name of the client the key is handed to")
+	scopes := flags.String("scopes", "", "comma separated scopes: read, write, convert, admin")
+	tenant := flags.String("tenant", "",
+		"tenant the key is bound to, the default tenant when empty, '*' to choose one per request")
+	id := flags.String("id", "", "id of the key")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	var serverArgs []string
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "storage-file" {
+			serverArgs = append(serverArgs, "-"+f.Name, f.Value.String())
+		}
+	})
+	cfg, err := config.Load("keys", serverArgs, getenv)
+	if err != nil {
+		return err
+	}
+	keys := persistance.OpenKeyFile(cfg.StorageFile)
+
+	switch command {
+	case "create":
+		granted, err := auth.NewScopes(*scopes)
+		if err != nil {
+			return err
+		}
+		key, secret, err := auth.NewAPIKey(*name, granted)
+		if err != nil {
+			return err
+		}
+		if *tenant != "" && *tenant != auth.DefaultTenant {
+			if key.Tenant, err = auth.NewTenant(*tenant); err != nil {
+				return err
+			}
+		}
+		// the server only serves tenants it knows of
+		if key.Tenant != "" && key.Tenant != auth.AnyTenant {
+			if err := persistance.OpenTenantStore(cfg.StorageFile).Create(key.Tenant); err != nil {
+				return err
+			}
+		}
+		if err := keys.SaveKey(key); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Created key %v (%v) for tenant %v with scopes %v\n",
+			key.Id, key.Name, key.TenantName(), joinScopes(key.Scopes))
+		fmt.Fprintf(out, "%v\nThe key is not stored and cannot be shown again.\n", secret)
+	case "list":
+		list, err := keys.ListKeys()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tTENANT\tSCOPES\tCREATED\tSTATUS")
+		for _, key := range list {
+			status := "active"
+			if key.Revoked() {
+				status = "revoked " + key.RevokedAt.Format(time.DateOnly)
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n", key.Id, key.Name, key.TenantName(), joinScopes(key.Scopes),
+				key.CreatedAt.Format(time.DateOnly), status)
+		}
+		return tw.Flush()
+	case "revoke", "rotate":
+		key, err := keys.QueryKey(*id)
+		if err != nil {
+			return fmt.Errorf("%v: %w", *id, err)
+		}
+		if key.Revoked() {
+			return fmt.Errorf("key %v is already revoked", key.Id)
+		}
+		secret := ""
+		if command == "revoke" {
+			now := time.Now().UTC()
+			key.RevokedAt = &now
+		} else if key, secret, err = key.Rotate(); err != nil {
+			return err
+		}
+		if err := keys.SaveKey(key); err != nil {
+			return err
+		}
+		if command == "revoke" {
+			fmt.Fprintf(out, "Revoked key %v (%v)\n", key.Id, key.Name)
+		} else {
+			fmt.Fprintf(out, "Rotated key %v (%v), the previous key no longer works\n", key.Id, key.Name)
+			fmt.Fprintf(out, "%v\nThe key is not stored and cannot be shown again.\n", secret)
+		}
+	default:
+		return fmt.Errorf("unknown command %v\n%v", command, keysUsage)
+	}
+	return nil
+}
+
+func joinScopes(scopes []auth.Scope) string {
+	list := make([]string, len(scopes))
+	for i, scope := range scopes {
+		list[i] = string(scope)
+	}
+	return strings.Join(list, ",")
+}
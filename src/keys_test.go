@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"wex/src/auth"
+	"wex/src/config"
+	"wex/src/persistance"
+)
+
+func TestKeysCommand(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "db.json")
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := runKeys(append(args, "-storage-file", storage), noEnv, &out)
+		return out.String(), err
+	}
+	secretPattern := regexp.MustCompile(`wex_[0-9a-f]+_\S+`)
+	authenticator := auth.Authenticator{Keys: persistance.OpenKeyFile(storage)}
+
+	out, err := run("create", "-name", "ci", "-scopes", "read,convert")
+	if err != nil {
+		t.Fatalf("Could not create key: %v", err)
+	}
+	secret := secretPattern.FindString(out)
+	principal, err := authenticator.Check(secret)
+	if err != nil || principal.Name != "ci" || !principal.Has(auth.ScopeConvert) || principal.Tenant != auth.DefaultTenant {
+		t.Fatalf("Created key does not authenticate: %+v (%v)", principal, err)
+	}
+
+	out, err = run("create", "-name", "acme", "-scopes", "read", "-tenant", "acme")
+	if acme, checkErr := authenticator.Check(secretPattern.FindString(out)); err != nil || checkErr != nil || acme.Tenant != "acme" {
+		t.Errorf("Tenant key does not authenticate for its tenant: %+v (%v, %v)", acme, err, checkErr)
+	}
+	if _, err := persistance.OpenTenantStore(storage).Tenant("acme"); err != nil {
+		t.Errorf("Tenant of the key not served: %v", err)
+	}
+
+	out, _ = run("list")
+	if !strings.Contains(out, principal.KeyId) || !strings.Contains(out, "read,convert") || strings.Contains(out, secret) {
+		t.Errorf("Unexpected key list %v", out)
+	}
+
+	out, err = run("rotate", "-id", principal.KeyId)
+	rotated := secretPattern.FindString(out)
+	if err != nil || rotated == "" || rotated == secret {
+		t.Fatalf("Could not rotate key: %v (%v)", out, err)
+	}
+	if _, err := authenticator.Check(rotated); err != nil {
+		t.Errorf("Rotated key does not authenticate: %v", err)
+	}
+
+	if _, err := run("revoke", "-id", principal.KeyId); err != nil {
+		t.Fatalf("Could not revoke key: %v", err)
+	}
+	if out, _ := run("list"); !strings.Contains(out, "revoked") {
+		t.Errorf("Revoked key listed as active: %v", out)
+	}
+
+	for _, args := range [][]string{
+		{"create", "-name", "ci", "-scopes", "everything"},
+		{"create", "-scopes", "read"},
+		{"create", "-name", "ci", "-scopes", "read", "-tenant", "../acme"},
+		{"revoke", "-id", principal.KeyId},
+		{"rotate", "-id", "missing"},
+		{"delete"},
+	} {
+		if _, err := run(args...); err == nil {
+			t.Errorf("No error received for keys %v", args)
+		}
+	}
+}
+
+func noEnv(string) string {
+	return ""
+}
+
+func TestKeysCommandConfig(t *testing.T) {
+	dir := t.TempDir()
+	storage := filepath.Join(dir, "server", "db.json")
+	configFile := filepath.Join(dir, "wex.json")
+	if err := os.WriteFile(configFile, []byte(`{"storage-file": "`+storage+`"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		args   []string
+		getenv func(string) string
+	}{
+		{"config flag", []string{"-config", configFile}, noEnv},
+		{"config environment", nil, func(name string) string {
+			if name == config.EnvName("config") {
+				return configFile
+			}
+			return ""
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			args := append([]string{"create", "-name", test.name, "-scopes", "read"}, test.args...)
+			if err := runKeys(args, test.getenv, &out); err != nil {
+				t.Fatalf("Could not create key: %v", err)
+			}
+			authenticator := auth.Authenticator{Keys: persistance.OpenKeyFile(storage)}
+			if _, err := authenticator.Check(regexp.MustCompile(`wex_[0-9a-f]+_\S+`).FindString(out.String())); err != nil {
+				t.Errorf("Key not stored next to the configured storage file: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"wex/src/auth"
+	"wex/src/config"
+	"wex/src/logging"
+	"wex/src/ratelimit"
+)
+
+// clientLimits limits the requests of each client to each route: by client
+// address before authentication, so that floods are refused before any key
+// is checked, and by API key after it. Routes without a limit of their own
+// use the default one, but still get their own buckets.
+type clientLimits struct {
+	key       ratelimit.Limit
+	keyRoutes map[string]ratelimit.Limit
+	ip        ratelimit.Limit
+	ipRoutes  map[string]ratelimit.Limit
+	// header holding the client address, empty to use the peer address
+	ipHeader string
+}
+
+func newClientLimits(cfg config.Config) (clientLimits, error) {
+	limits := clientLimits{
+		key:      ratelimit.Limit{Rate: cfg.ClientRate, Burst: cfg.ClientBurst},
+		ip:       ratelimit.Limit{Rate: cfg.IPRate, Burst: cfg.IPBurst},
+		ipHeader: cfg.ClientIPHeader,
+	}
+	var err error
+	if limits.keyRoutes, err = ratelimit.ParseRouteLimits(cfg.ClientRouteLimits); err != nil {
+		return limits, err
+	}
+	limits.ipRoutes, err = ratelimit.ParseRouteLimits(cfg.IPRouteLimits)
+	return limits, err
+}
+
+func routeLimit(route string, fallback ratelimit.Limit, routes map[string]ratelimit.Limit) ratelimit.Limit {
+	if limit, ok := routes[route]; ok {
+		return limit
+	}
+	return fallback
+}
+
+// clientAddress returns the address of the client of a request.
+func (l clientLimits) clientAddress(r *http.Request) string {
+	if values := r.Header.Values(l.ipHeader); l.ipHeader != "" && len(values) > 0 {
+		// proxies append to X-Forwarded-For, the last address is the one our
+		// proxy saw, the ones before it are sent by the client and can be
+		// anything
+		entries := strings.Split(values[len(values)-1], ",")
+		if forwarded := strings.TrimSpace(entries[len(entries)-1]); forwarded != "" {
+			return forwarded
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// byAddress limits the requests of each client address to route.
+func (l clientLimits) byAddress(route string, next http.HandlerFunc) http.HandlerFunc {
+	limit := routeLimit(route, l.ip, l.ipRoutes)
+	if limit.Disabled() {
+		return next
+	}
+	buckets := ratelimit.NewKeyed(limit)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rateLimited(w, r, buckets.Take(l.clientAddress(r)), limit) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// byKey limits the requests of each API key or token subject to route, it
+// wraps handlers that require authentication.
+func (l clientLimits) byKey(route string, next http.HandlerFunc) http.HandlerFunc {
+	limit := routeLimit(route, l.key, l.keyRoutes)
+	if limit.Disabled() {
+		return next
+	}
+	buckets := ratelimit.NewKeyed(limit)
+	return func(w http.ResponseWriter, r *http.Request) {
+		// requests let through with authentication disabled are only
+		// limited by address
+		if p, ok := auth.PrincipalFrom(r.Context()); ok && p.KeyId != "" &&
+			rateLimited(w, r, buckets.Take(p.KeyId), limit) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// setRateLimitHeaders reports the limit closest to be reached, when a
+// request goes through several limits.
+func setRateLimitHeaders(h http.Header, result ratelimit.Result, limit ratelimit.Limit) {
+	if current := h.Get("RateLimit-Remaining"); current != "" {
+		if remaining, err := strconv.Atoi(current); err == nil && remaining <= result.Remaining {
+			return
+		}
+	}
+	h.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%v;w=%v", limit.Burst,
+		int(math.Ceil(float64(limit.Burst)/limit.Rate))))
+}
+
+// rateLimited sets the rate limit headers of the response and answers
+// 429 Too Many Requests when the request was refused.
+func rateLimited(w http.ResponseWriter, r *http.Request, result ratelimit.Result, limit ratelimit.Limit) bool {
+	setRateLimitHeaders(w.Header(), result, limit)
+	if result.Allowed {
+		return false
+	}
+	retry := max(ceilSeconds(result.RetryAfter), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	message := fmt.Sprintf("%v: rate limit of %v requests per second exceeded on %v, retry in %vs",
+		http.StatusText(http.StatusTooManyRequests), limit.Rate, r.URL.Path, retry)
+	writeError(w, http.StatusTooManyRequests, message)
+	logging.FromContext(r.Context()).Info("Rate limit exceeded", "route", r.URL.Path, "retryAfter", retry)
+	return true
+}
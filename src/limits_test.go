@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"wex/src/auth"
+	"wex/src/ratelimit"
+)
+
+func TestClientLimits(t *testing.T) {
+	limits := clientLimits{
+		key:       ratelimit.Limit{Rate: 0.001, Burst: 3},
+		keyRoutes: map[string]ratelimit.Limit{"/convertTransaction": {Rate: 0.001, Burst: 1}},
+		ip:        ratelimit.Limit{Rate: 0.001, Burst: 5},
+		ipHeader:  "X-Forwarded-For",
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	handler := func(route string) http.HandlerFunc {
+		return limits.byAddress(route, limits.byKey(route, ok))
+	}
+	convert, query := handler("/convertTransaction"), handler("/queryTransaction")
+
+	request := func(handler http.HandlerFunc, key, address string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		// the client sends any address it likes before the one of the proxy,
+		// counting it would put every request in the same bucket
+		req.Header.Set("X-Forwarded-For", "203.0.113.7, 203.0.113.8, "+address)
+		if key != "" {
+			req = req.WithContext(auth.WithPrincipal(req.Context(), auth.Principal{KeyId: key}))
+		}
+		res := httptest.NewRecorder()
+		handler(res, req)
+		return res
+	}
+
+	if res := request(convert, "k1", "192.0.2.1"); res.Code != http.StatusOK ||
+		res.Header().Get("RateLimit-Limit") != "1" || res.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("got status %d with headers %v", res.Code, res.Header())
+	}
+	res := request(convert, "k1", "192.0.2.2")
+	if res.Code != http.StatusTooManyRequests || res.Header().Get("Retry-After") == "" ||
+		!strings.HasPrefix(res.Body.String(), "Too Many Requests: ") ||
+		!strings.HasPrefix(res.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("key over its route limit got status %d with headers %v", res.Code, res.Header())
+	}
+
+	// routes and keys have buckets of their own
+	if res := request(query, "k1", "192.0.2.1"); res.Code != http.StatusOK ||
+		res.Header().Get("RateLimit-Limit") != "3" || res.Header().Get("RateLimit-Remaining") != "2" {
+		t.Errorf("got status %d with headers %v on another route", res.Code, res.Header())
+	}
+	if res := request(convert, "k2", "192.0.2.1"); res.Code != http.StatusOK {
+		t.Errorf("got status %d for another key", res.Code)
+	}
+
+	// the address is limited whatever the key, unauthenticated requests included
+	for i := 0; i < 3; i++ {
+		request(query, "", "198.51.100.1")
+	}
+	request(query, "k3", "198.51.100.1")
+	request(query, "k4", "198.51.100.1")
+	if res := request(query, "k5", "198.51.100.1"); res.Code != http.StatusTooManyRequests {
+		t.Errorf("address over its limit got status %d", res.Code)
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		ipHeader string
+		headers  []string
+		expected string
+	}{
+		{"peer address", "", []string{"198.51.100.7"}, "192.0.2.1"},
+		{"no header sent", "X-Forwarded-For", nil, "192.0.2.1"},
+		{"single proxy", "X-Forwarded-For", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"address sent by the client", "X-Forwarded-For", []string{"203.0.113.9, 198.51.100.7"}, "198.51.100.7"},
+		{"header repeated", "X-Forwarded-For", []string{"203.0.113.9", "198.51.100.7"}, "198.51.100.7"},
+		{"empty entry", "X-Forwarded-For", []string{"198.51.100.7, "}, "192.0.2.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			for _, header := range test.headers {
+				req.Header.Add("X-Forwarded-For", header)
+			}
+			limits := clientLimits{ipHeader: test.ipHeader}
+			if address := limits.clientAddress(req); address != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, address)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+// Package logging writes structured logs with log/slog and carries the
+// logger of each request, tagged with its request id, through its context so
+// that storage and upstream calls log under the request that caused them.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"wex/src/response"
+)
+
+// RequestIDHeader carries the request id, it is accepted from clients and
+// proxies and set on every response and upstream request.
+const RequestIDHeader = "X-Request-ID"
+
+// longest request id accepted from a client
+const maxRequestIDLength = 128
+
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
+var ErrFormat = errors.New("Invalid log format")
+
+// NewLogger returns a logger writing records of level or above to w, as
+// key=value text or as one json object per line.
+func NewLogger(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: level}
+	switch format {
+	case TextFormat:
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case JSONFormat:
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("%w: %q should be %v or %v", ErrFormat, format, TextFormat, JSONFormat)
+}
+
+// ParseLevel parses a level name: debug, info, warn or error.
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(name))
+	return level, err
+}
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+// WithLogger returns a copy of ctx carrying logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// FromContext returns the logger carried by ctx, the default logger when
+// there is none, e.g. in background jobs.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// WithRequestID returns a copy of ctx carrying the request id and a logger
+// tagging every record with it.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey, id)
+	return WithLogger(ctx, FromContext(ctx).With("requestId", id))
+}
+
+// RequestID returns the id of the request ctx belongs to, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts the ids of other services, uuids and the like, but
+// nothing that could break a log line or a header.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c > '~' || c <= ' ' || strings.ContainsRune(`"\`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware logs every request to route once answered, with its method,
+// status, latency, size and request id. The id is taken from the
+// X-Request-ID header when the client sent a valid one and generated
+// otherwise; it is echoed in the response and carried by the request context
+// along with a logger tagging records with it.
+func Middleware(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := WithRequestID(r.Context(), id)
+
+		recorder := response.NewRecorder(w)
+		next(recorder, r.WithContext(ctx))
+
+		status := recorder.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+		FromContext(ctx).LogAttrs(ctx, level, "Request served",
+			slog.String("method", r.Method),
+			slog.String("route", route),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("latencyMs", float64(time.Since(started).Microseconds())/1000),
+			slog.Int("bytes", recorder.Bytes()),
+		)
+	}
+}
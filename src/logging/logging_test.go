@@ -0,0 +1,130 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs sends the default logger to a buffer of json records for the
+// duration of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buffer bytes.Buffer
+	logger, err := NewLogger(&buffer, JSONFormat, slog.LevelDebug)
+	if err != nil {
+		t.Fatalf("Could not create logger: %v", err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buffer
+}
+
+func records(t *testing.T, buffer *bytes.Buffer) []map[string]any {
+	var parsed []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		record := make(map[string]any)
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Could not parse log record %q: %v", line, err)
+		}
+		parsed = append(parsed, record)
+	}
+	return parsed
+}
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		received string
+		kept     bool
+	}{
+		{"generated", "", false},
+		{"accepted", "gateway-7f3a.42", true},
+		{"with spaces", "id with spaces", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buffer := captureLogs(t)
+			var handlerID string
+			handler := Middleware("/queryTransaction", func(w http.ResponseWriter, r *http.Request) {
+				handlerID = RequestID(r.Context())
+				FromContext(r.Context()).Info("Transaction queried")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Bad request: missing id"))
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/queryTransaction?transactionId=1", nil)
+			if test.received != "" {
+				req.Header.Set(RequestIDHeader, test.received)
+			}
+			res := httptest.NewRecorder()
+			handler(res, req)
+
+			id := res.Header().Get(RequestIDHeader)
+			if id == "" || id != handlerID || (id == test.received) != test.kept {
+				t.Fatalf("got request id %q in response and %q in handler for %q", id, handlerID, test.received)
+			}
+
+			logged := records(t, buffer)
+			if len(logged) != 2 {
+				t.Fatalf("expected the handler record and the request record, got %v", logged)
+			}
+			for _, record := range logged {
+				if record["requestId"] != id {
+					t.Errorf("record not tagged with the request id: %v", record)
+				}
+			}
+			access := logged[1]
+			if access["method"] != "GET" || access["route"] != "/queryTransaction" || access["status"] != float64(400) ||
+				access["bytes"] != float64(len("Bad request: missing id")) || access["level"] != "WARN" ||
+				access["latencyMs"] == nil {
+				t.Errorf("unexpected request record %v", access)
+			}
+		})
+	}
+}
+
+func TestMiddlewareFlush(t *testing.T) {
+	captureLogs(t)
+	flushed := false
+	handler := Middleware("/bulkConvert", func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		flushed = true
+	})
+	res := httptest.NewRecorder()
+	handler(res, httptest.NewRequest(http.MethodPost, "/bulkConvert", nil))
+	if !flushed || !res.Flushed || res.Code != http.StatusOK {
+		t.Errorf("streamed response not flushed through the middleware")
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	buffer := captureLogs(t)
+	ctx := WithRequestID(httptest.NewRequest(http.MethodGet, "/", nil).Context(), "abc")
+	FromContext(ctx).Debug("Transaction queued", "transactionId", "1")
+	if record := records(t, buffer)[0]; record["requestId"] != "abc" || record["transactionId"] != "1" {
+		t.Errorf("unexpected record %v", record)
+	}
+	if FromContext(httptest.NewRequest(http.MethodGet, "/", nil).Context()) != slog.Default() {
+		t.Error("default logger not used without a request")
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	if _, err := NewLogger(&bytes.Buffer{}, "xml", slog.LevelInfo); err == nil {
+		t.Error("No error received for an unknown format")
+	}
+	var buffer bytes.Buffer
+	logger, _ := NewLogger(&buffer, TextFormat, slog.LevelWarn)
+	logger.Info("hidden")
+	logger.Warn("shown")
+	if strings.Contains(buffer.String(), "hidden") || !strings.Contains(buffer.String(), "msg=shown") {
+		t.Errorf("unexpected text logs %q", buffer.String())
+	}
+}
@@ -1,60 +1,84 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 	"wex/src/application"
+	"wex/src/auth"
+	"wex/src/config"
 	"wex/src/external"
+	"wex/src/health"
+	"wex/src/logging"
+	"wex/src/metrics"
 	"wex/src/persistance"
+	"wex/src/ratelimit"
+	"wex/src/tracing"
 )
 
-func getRoot(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		http.ServeFile(w, r, "./../ui/form.html")
-	default:
-		badRequest(w, "Unsupported Method")
-	}
+// writeError answers a request with status and the plain text message of
+// every error of the api.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(message))
+}
 
+func badRequest(w http.ResponseWriter, r *http.Request, reason string) {
+	writeError(w, http.StatusBadRequest, fmt.Sprintf("Bad request: %v", reason))
+	logging.FromContext(r.Context()).Info("Bad request", "reason", reason)
 }
 
-func badRequest(w http.ResponseWriter, reason string) {
-	errorMessage := fmt.Sprintf("Bad request: %v", reason)
-	w.WriteHeader(http.StatusBadRequest)
-	w.Write([]byte(errorMessage))
-	log.Printf("(%v) %v", http.StatusBadRequest, errorMessage)
+// storageUnavailable answers requests whose storage call failed, e.g. a
+// registration refused while the persist goroutine is behind.
+func storageUnavailable(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, persistance.ErrQueueFull) {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("Storage unavailable: %v", err))
+	logging.FromContext(r.Context()).Warn("Storage unavailable", "error", err)
 }
 
-func getQueryTransactionHandler(driver persistance.PersistanceDriver) func(http.ResponseWriter, *http.Request) {
+func getQueryTransactionHandler(tenants persistance.Tenants) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET":
 			queryId := r.URL.Query().Get("transactionId")
-			transaction, err := driver.QueryTransaction(queryId)
+			transaction, err := tenantDriver(tenants, r).QueryTransaction(r.Context(), queryId)
 			if err != nil {
-				badRequest(w, err.Error())
+				badRequest(w, r, err.Error())
 				return
 			}
-			w.WriteHeader(http.StatusOK)
+			logging.FromContext(r.Context()).Info("Transaction queried", "transactionId", transaction.Uid)
 			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
 			json.NewEncoder(w).Encode(transaction)
-			logMessage := fmt.Sprintf("Transaction queried: %v", transaction.Uid)
-			log.Printf("(%v) %v", http.StatusOK, logMessage)
 		default:
-			badRequest(w, "Unsupported method")
+			badRequest(w, r, "Unsupported method")
 
 		}
 	}
 }
 
-func getRegisterTransaction(driver persistance.PersistanceDriver) func(http.ResponseWriter, *http.Request) {
+func getRegisterTransaction(tenants persistance.Tenants,
+	middleware external.FiscalDataInterface,
+	catalog external.CurrencyCatalogInterface,
+	defaults application.RateSelection) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "POST":
 			if err := r.ParseForm(); err != nil {
-				badRequest(w, "Could not parse form")
+				badRequest(w, r, "Could not parse form")
 				return
 			}
 			description := r.FormValue("description")
@@ -66,77 +90,606 @@ func getRegisterTransaction(driver persistance.PersistanceDriver) func(http.Resp
 			)
 
 			if err != nil {
-				badRequest(w,
+				badRequest(w, r,
 					fmt.Sprintf("Could not create transaction: %v", err))
 				return
 			}
 
-			newUid := driver.RegisterTransaction(newTransaction)
+			if r.FormValue("currency") != "" || r.FormValue("country") != "" {
+				_, selection := tenantSettings(tenants, r, defaults)
+				newTransaction, err = foreignTransaction(r, newTransaction, middleware, catalog, selection)
+				if err != nil {
+					badRequest(w, r,
+						fmt.Sprintf("Could not create transaction: %v", err))
+					return
+				}
+			}
+
+			if principal, ok := auth.PrincipalFrom(r.Context()); ok {
+				newTransaction.CreatedBy = principal.KeyId
+			}
+
+			newUid, err := tenantDriver(tenants, r).RegisterTransaction(r.Context(), newTransaction)
+			status := http.StatusOK
+			if errors.Is(err, persistance.ErrNotPersisted) {
+				// the transaction is stored and written with the next write,
+				// a client retrying would register it twice
+				logging.FromContext(r.Context()).Warn("Transaction registered but not yet durable",
+					"transactionId", newUid, "error", err)
+				status = http.StatusAccepted
+			} else if err != nil {
+				storageUnavailable(w, r, err)
+				return
+			}
 			w.Header().Set("Content-Type", "application/json")
-			resp := make(map[string]string)
+			resp := make(map[string]any)
 			resp["transactionId"] = newUid
+			if status == http.StatusAccepted {
+				resp["durable"] = false
+			}
+			if foreign := newTransaction.Foreign; foreign != nil {
+				resp["amount"] = newTransaction.Amount.ToString()
+				resp["currency"] = foreign.Currency
+				resp["foreignAmount"] = foreign.Amount.ToString()
+				resp["exchangeRate"] = foreign.ExchangeRate.ToString()
+				resp["rateRecordDate"] = foreign.RateRecordDate.ToString()
+			}
+			w.WriteHeader(status)
 			json.NewEncoder(w).Encode(resp)
-			logMessage := fmt.Sprintf("Transaction registered: %v", newUid)
-			log.Printf("(%v) %v", http.StatusOK, logMessage)
+			logging.FromContext(r.Context()).Info("Transaction registered", "transactionId", newUid)
 		default:
-			badRequest(w, "Unsupported method")
+			badRequest(w, r, "Unsupported method")
 		}
 	}
 }
 
-func getConvertTransaction(driver persistance.PersistanceDriver,
-	middleware external.FiscalDataInterface) func(http.ResponseWriter, *http.Request) {
+// foreignTransaction reads the currency the purchase was made in from the
+// form and converts its amount to USD with the applicable rate.
+func foreignTransaction(r *http.Request, transaction application.Transaction,
+	middleware external.FiscalDataInterface,
+	catalog external.CurrencyCatalogInterface,
+	defaults application.RateSelection) (application.Transaction, error) {
+
+	currency, err := resolveCurrency(r.Context(), catalog, r.FormValue("country"), r.FormValue("currency"))
+	if err != nil {
+		return transaction, err
+	}
+	selection, err := newRateSelection(r.FormValue("policy"), r.FormValue("window"),
+		r.FormValue("recordDate"), defaults)
+	if err != nil {
+		return transaction, err
+	}
+
+	from, to := selection.Window(transaction.Date)
+	rates, err := middleware.QueryRates(r.Context(), []string{currency.CountryCurrency}, from, to)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Could not query rates",
+			"currencies", []string{currency.CountryCurrency}, "error", err)
+		return transaction, errors.New("error getting conversion rate")
+	}
+	rate, err := selection.Select(rates, transaction.Date)
+	if err != nil {
+		return transaction, fmt.Errorf("no conversion rate is available between %v and %v (%v policy)",
+			from.ToString(), to.ToString(), selection.Policy)
+	}
+	return application.NewForeignTransaction(transaction, rate, selection.Policy, external.TreasuryProvider)
+}
+
+// rateSelection reads the rate policy, lookback window and record date from
+// the request, falling back to the deployment defaults.
+func rateSelection(r *http.Request, defaults application.RateSelection) (application.RateSelection, error) {
+	query := r.URL.Query()
+	return newRateSelection(query.Get("policy"), query.Get("window"), query.Get("recordDate"), defaults)
+}
+
+func newRateSelection(policy, window, recordDate string,
+	defaults application.RateSelection) (application.RateSelection, error) {
+	selection := defaults
+	var err error
+
+	if policy != "" {
+		selection.Policy, err = application.NewRatePolicy(policy)
+		if err != nil {
+			return selection, err
+		}
+	}
+
+	if window != "" {
+		selection.WindowMonths, err = application.NewRateWindow(window)
+		if err != nil {
+			return selection, err
+		}
+	}
+
+	if recordDate != "" {
+		selection.RecordDate, err = application.NewTime(recordDate)
+		if err != nil {
+			return selection, err
+		}
+		// a record date alone is enough to choose the policy
+		if policy == "" {
+			selection.Policy = application.RecordDateRate
+		}
+	}
+
+	if selection.Policy == application.RecordDateRate && selection.RecordDate.IsZero() {
+		return selection, fmt.Errorf("recordDate is required by the %v policy", selection.Policy)
+	}
+
+	return selection, nil
+}
+
+// resolveCurrency finds the catalog currency for the country and currency
+// given by the user. Country may be empty when currency alone identifies it,
+// e.g. "mexico peso" or "MXN". When the catalog cannot be loaded a
+// country_currency_desc, e.g. "Mexico-Peso" or country "Mexico" and currency
+// "Peso", is used as given, so that rates already cached are still served.
+func resolveCurrency(ctx context.Context, catalog external.CurrencyCatalogInterface,
+	country, currency string) (application.Currency, error) {
+
+	query := strings.TrimSpace(country + " " + currency)
+	target, err := catalog.ResolveCurrency(ctx, query)
+	if err == nil || errors.Is(err, application.ErrUnknownCurrency) ||
+		errors.Is(err, application.ErrAmbiguousCurrency) {
+		return target, err
+	}
+	if desc, ok := countryCurrencyDesc(country, currency); ok {
+		logging.FromContext(ctx).Warn("Currency catalog unavailable, using the currency as given",
+			"currency", desc.CountryCurrency, "error", err)
+		return desc, nil
+	}
+	return target, fmt.Errorf("could not load currency catalog: %w", err)
+}
+
+// countryCurrencyDesc reads the country and currency as the Treasury names
+// them, without the catalog.
+func countryCurrencyDesc(country, currency string) (application.Currency, bool) {
+	country, currency = strings.TrimSpace(country), strings.TrimSpace(currency)
+	if country == "" {
+		country, currency, _ = strings.Cut(currency, "-")
+	}
+	if country == "" || currency == "" {
+		return application.Currency{}, false
+	}
+	return application.NewCurrency(country, currency), true
+}
+
+func getCurrencies(catalog external.CurrencyCatalogInterface) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			currencies, err := catalog.Currencies(r.Context())
+			if err != nil {
+				badRequest(w, r, "error getting currency catalog")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(currencies)
+		default:
+			badRequest(w, r, "Unsupported method")
+		}
+	}
+}
+
+// most currencies accepted by a single conversion request
+const maxTargetCurrencies = 20
+
+type currencyConversion struct {
+	Currency       string `json:"currency"`
+	ConvertedValue string `json:"convertedValue,omitempty"`
+	ExchangeRate   string `json:"exchangeRate,omitempty"`
+	RateRecordDate string `json:"rateRecordDate,omitempty"`
+	ConvertedAt    string `json:"convertedAt,omitempty"`
+	Stored         bool   `json:"stored,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+func newCurrencyConversion(conversion application.Conversion, stored bool) currencyConversion {
+	return currencyConversion{
+		Currency:       conversion.Currency,
+		ConvertedValue: conversion.ConvertedValue.ToString(),
+		ExchangeRate:   conversion.ExchangeRate.ToString(),
+		RateRecordDate: conversion.RateRecordDate.ToString(),
+		ConvertedAt:    conversion.Timestamp.Format(time.RFC3339),
+		Stored:         stored,
+	}
+}
+
+// storedConversion returns the most recent conversion of the transaction that
+// matches the currency and rate selection.
+func storedConversion(ctx context.Context, driver persistance.PersistanceDriver, transactionId, currency string,
+	selection application.RateSelection) (application.Conversion, bool) {
+
+	conversions, err := driver.QueryConversions(ctx, transactionId)
+	if err != nil {
+		return application.Conversion{}, false
+	}
+	for i := len(conversions) - 1; i >= 0; i-- {
+		if conversions[i].Matches(currency, selection) {
+			return conversions[i], true
+		}
+	}
+	return application.Conversion{}, false
+}
+
+// recordConversion keeps the conversion in the transaction history. A
+// failure is logged and does not prevent the conversion from being answered.
+func recordConversion(ctx context.Context, driver persistance.PersistanceDriver, conversion application.Conversion) {
+	if err := driver.RecordConversion(ctx, conversion); err != nil {
+		logging.FromContext(ctx).Warn("Could not record conversion", "transactionId", conversion.TransactionUid,
+			"currency", conversion.Currency, "error", err)
+	}
+}
+
+// targetCurrencies lists the currencies requested for a conversion: either a
+// country and currency pair, one or more currency parameters or a comma
+// separated currencies parameter.
+func targetCurrencies(r *http.Request) []string {
+	query := r.URL.Query()
+
+	var targets []string
+	if country := query.Get("country"); country != "" {
+		targets = append(targets, country+" "+query.Get("currency"))
+	} else {
+		for _, currency := range query["currency"] {
+			if strings.TrimSpace(currency) != "" {
+				targets = append(targets, currency)
+			}
+		}
+	}
+	for _, list := range query["currencies"] {
+		for _, currency := range strings.Split(list, ",") {
+			if strings.TrimSpace(currency) != "" {
+				targets = append(targets, currency)
+			}
+		}
+	}
+	return targets
+}
+
+// convertToCurrencies converts the transaction to every target currency,
+// fetching the rates of all of them with a single upstream query, and records
+// the conversions. When useStored is set, conversions already recorded are
+// answered instead. Failures are reported per currency; the error returned
+// means no conversion could be attempted at all.
+func convertToCurrencies(ctx context.Context, driver persistance.PersistanceDriver,
+	transaction application.IdentifiedTransaction, targets []string,
+	selection application.RateSelection, useStored bool,
+	middleware external.FiscalDataInterface,
+	catalog external.CurrencyCatalogInterface) ([]currencyConversion, error) {
+
+	conversions := make([]currencyConversion, len(targets))
+	resolved := make([]application.Currency, len(targets))
+
+	var descs []string
+	seen := make(map[string]bool)
+	for i, target := range targets {
+		conversions[i].Currency = target
+		currency, err := resolveCurrency(ctx, catalog, "", target)
+		if err != nil {
+			conversions[i].Error = err.Error()
+			continue
+		}
+		resolved[i] = currency
+		conversions[i].Currency = currency.CountryCurrency
+		if useStored {
+			if stored, ok := storedConversion(ctx, driver, transaction.Uid, currency.CountryCurrency, selection); ok {
+				conversions[i] = newCurrencyConversion(stored, true)
+				continue
+			}
+		}
+		if !seen[currency.CountryCurrency] {
+			seen[currency.CountryCurrency] = true
+			descs = append(descs, currency.CountryCurrency)
+		}
+	}
+
+	if len(descs) == 0 {
+		return conversions, nil
+	}
+
+	from, to := selection.Window(transaction.Date)
+	rates, err := middleware.QueryRates(ctx, descs, from, to)
+	if err != nil {
+		logging.FromContext(ctx).Warn("Could not query rates", "currencies", descs, "error", err)
+		return nil, errors.New("error getting conversion rate")
+	}
+
+	ratesByCurrency := make(map[string][]application.ExchangeRate)
+	for _, rate := range rates {
+		ratesByCurrency[rate.CountryCurrency] = append(ratesByCurrency[rate.CountryCurrency], rate)
+	}
+
+	for i := range conversions {
+		if conversions[i].Error != "" || conversions[i].Stored {
+			continue
+		}
+		rate, err := selection.Select(ratesByCurrency[resolved[i].CountryCurrency], transaction.Date)
+		if err != nil {
+			conversions[i].Error = fmt.Sprintf("no conversion rate is available between %v and %v (%v policy); transaction cannot be converted to the target currency",
+				from.ToString(), to.ToString(), selection.Policy)
+			continue
+		}
+		conversion := application.NewConversion(transaction, rate, selection.Policy, external.TreasuryProvider)
+		recordConversion(ctx, driver, conversion)
+		conversions[i] = newCurrencyConversion(conversion, false)
+	}
+	return conversions, nil
+}
+
+func getConvertTransaction(tenants persistance.Tenants,
+	middleware external.FiscalDataInterface,
+	catalog external.CurrencyCatalogInterface,
+	defaults application.RateSelection) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		driver := tenantDriver(tenants, r)
+		settings, tenantDefaults := tenantSettings(tenants, r, defaults)
 		transactionId := r.URL.Query().Get("transactionId")
-		country := r.URL.Query().Get("country")
-		currency := r.URL.Query().Get("currency")
-		transaction, err := driver.QueryTransaction(transactionId)
+		transaction, err := driver.QueryTransaction(r.Context(), transactionId)
 		if err != nil {
-			badRequest(w, err.Error())
+			badRequest(w, r, err.Error())
 			return
 		}
 
-		rates, err := middleware.QueryRates(country, currency, transaction.Date)
+		targets := targetCurrencies(r)
+		if len(targets) == 0 && settings.Currency != "" {
+			targets = []string{settings.Currency}
+		}
+		if len(targets) == 0 {
+			badRequest(w, r, "currency is required")
+			return
+		}
+		if len(targets) > maxTargetCurrencies {
+			badRequest(w, r, fmt.Sprintf("at most %v currencies can be converted at once", maxTargetCurrencies))
+			return
+		}
+
+		selection, err := rateSelection(r, tenantDefaults)
 		if err != nil {
-			badRequest(w, "error getting conversion rate")
+			badRequest(w, r, err.Error())
 			return
 		}
 
-		if len(rates) == 0 {
-			badRequest(w, "no conversion rate is available within 6 months to purchase date; transaction cannot be converted to the target currency")
+		useStored := r.URL.Query().Get("stored") == "true"
+		conversions, err := convertToCurrencies(r.Context(), driver, transaction, targets, selection, useStored,
+			middleware, catalog)
+		if err != nil {
+			badRequest(w, r, err.Error())
 			return
 		}
 
-		// use first rate
-		rate, err := application.NewMoney(rates[0]["exchange_rate"])
+		multiple := len(targets) > 1 || r.URL.Query().Has("currencies")
+		if !multiple && conversions[0].Error != "" {
+			badRequest(w, r, conversions[0].Error)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
 
-		converted := transaction.Amount.PreciseConvert(rate)
+		if multiple {
+			json.NewEncoder(w).Encode(struct {
+				Uid             string               `json:"uid"`
+				TransactionDate string               `json:"transactionDate"`
+				Description     string               `json:"description"`
+				OriginalValue   string               `json:"originalValue"`
+				RatePolicy      string               `json:"ratePolicy"`
+				Conversions     []currencyConversion `json:"conversions"`
+			}{
+				Uid:             transaction.Uid,
+				TransactionDate: transaction.Date.ToString(),
+				Description:     transaction.Description,
+				OriginalValue:   transaction.Amount.ToString(),
+				RatePolicy:      string(selection.Policy),
+				Conversions:     conversions,
+			})
+			return
+		}
 
+		conversion := conversions[0]
 		resp := make(map[string]string)
 		resp["uid"] = transaction.Uid
 		resp["transactionDate"] = transaction.Date.ToString()
 		resp["description"] = transaction.Description
 		resp["originalValue"] = transaction.Amount.ToString()
-		resp["convertedValue"] = converted.ToString()
-		resp["exchangeRate"] = rate.ToString()
+		resp["convertedValue"] = conversion.ConvertedValue
+		resp["currency"] = conversion.Currency
+		resp["exchangeRate"] = conversion.ExchangeRate
+		resp["rateRecordDate"] = conversion.RateRecordDate
+		resp["ratePolicy"] = string(selection.Policy)
+		resp["convertedAt"] = conversion.ConvertedAt
+		if conversion.Stored {
+			resp["stored"] = "true"
+		}
 
-		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	}
 }
 
+func getConversions(tenants persistance.Tenants) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			transactionId := r.URL.Query().Get("transactionId")
+			conversions, err := tenantDriver(tenants, r).QueryConversions(r.Context(), transactionId)
+			if err != nil {
+				badRequest(w, r, err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(conversions)
+		default:
+			badRequest(w, r, "Unsupported method")
+		}
+	}
+}
+
 func main() {
-	driver := persistance.StartDriver()
+	if len(os.Args) > 1 && os.Args[1] == "fake-treasury" {
+		if err := runFakeTreasury(os.Args[2:]); err != nil {
+			log.Fatalf("Fake Treasury api stopped: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		if err := runKeys(os.Args[2:], os.Getenv, os.Stdout); err != nil {
+			log.Fatalf("keys: %v", err)
+		}
+		return
+	}
+
+	cfg, err := config.Load(os.Args[0], os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Could not load configuration: %v", err)
+	}
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	logger, _ := logging.NewLogger(os.Stderr, cfg.LogFormat, level)
+	// the log package, still used for fatal errors, writes through it too
+	slog.SetDefault(logger)
+	defaultSelection, _ := cfg.RateSelection()
+
+	registry := metrics.NewRegistry()
+	requests := metrics.NewRequests(registry)
+	tracer, err := startTracing(registry, cfg.TraceFile, cfg.TraceEndpoint)
+	if err != nil {
+		log.Fatalf("Could not start tracing: %v", err)
+	}
+
+	tenants := persistance.OpenTenantStore(cfg.StorageFile)
+	tenants.Writes = persistance.WriteOptions{QueueSize: cfg.StorageQueue, Durable: cfg.DurableWrites}
+	tenants.Configured, _ = cfg.TenantNames()
+	tenants.MaxOpen = cfg.MaxTenants
+	storageMetrics(registry, tenants)
+
+	f := external.FiscalDataMiddleware{ExternalApi: cfg.TreasuryApi, ObserveRequest: treasuryMetrics(registry)}
+	if cfg.TreasuryRate > 0 {
+		f.Limiter = ratelimit.NewBucket(cfg.TreasuryRate, cfg.TreasuryBurst)
+	}
+	catalog := external.NewCurrencyCatalog(f)
+	cache := external.NewRateCache(external.NewSingleFlight(f))
+	cache.TTL = cfg.RateCacheTTL
+	rateCacheMetrics(registry, cache)
+
+	prefetcher := &external.Prefetcher{
+		Cache:      cache,
+		Currencies: prefetchCurrencies(tenants, catalog, cfg.PrefetchCurrencies),
+		Interval:   cfg.PrefetchInterval,
+		Months:     cfg.PrefetchMonths,
+	}
+	prefetcher.Start()
+
+	checker, err := readinessChecks(tenants, f, cache, cfg.ReadyChecks, cfg.ReadyTimeout)
+	if err != nil {
+		log.Fatalf("Could not configure readiness checks: %v", err)
+	}
 
-	f := external.FiscalDataMiddleware{ExternalApi: external.TreasuryApi}
+	assets := uiAssets(cfg.UIDir)
+	templates, err := newWebTemplates(assets, cfg.UIDir != "")
+	if err != nil {
+		log.Fatalf("Could not load UI templates: %v", err)
+	}
+	authenticator := auth.Authenticator{Keys: persistance.OpenKeyFile(cfg.StorageFile),
+		Sessions: auth.NewSessions(), Disabled: !cfg.Auth}
+	if cfg.JWKSFile != "" {
+		jwks := auth.OpenJWKSFile(cfg.JWKSFile)
+		if err := jwks.Load(); err != nil {
+			log.Fatalf("Could not load JWKS file %v: %v", cfg.JWKSFile, err)
+		}
+		authenticator.Tokens = &auth.TokenVerifier{
+			Keys:        jwks,
+			Issuer:      cfg.JWTIssuer,
+			Audience:    cfg.JWTAudience,
+			TenantClaim: cfg.JWTTenantClaim,
+			ScopeClaim:  cfg.JWTScopeClaim,
+			Leeway:      cfg.JWTLeeway,
+		}
+	}
+	if !cfg.Auth {
+		slog.Warn("Authentication is disabled, every request is let through")
+	}
+	ui := webUI{templates: templates, csrf: newCSRFProtection(), auth: authenticator}
+	limits, err := newClientLimits(cfg)
+	if err != nil {
+		log.Fatalf("Could not load rate limits: %v", err)
+	}
+	public := func(route string, next http.HandlerFunc) {
+		http.HandleFunc(route, tracing.Middleware(route,
+			logging.Middleware(route, requests.Middleware(route, limits.byAddress(route, next)))))
+	}
+	api := func(route string, scope auth.Scope, next http.HandlerFunc) {
+		public(route, authenticator.Require(scope, limits.byKey(route, tenantStorage(tenants, next))))
+	}
+	page := func(route string, scope auth.Scope, next http.HandlerFunc) {
+		public(route, authenticator.RequireLogin(scope, "/login", limits.byKey(route, tenantStorage(tenants, next))))
+	}
 
-	http.HandleFunc("/", getRoot)
-	http.HandleFunc("/queryTransaction", getQueryTransactionHandler(driver))
-	http.HandleFunc("/registerTransaction", getRegisterTransaction(driver))
-	http.HandleFunc("/convertTransaction", getConvertTransaction(driver, f))
+	public("/", getRoot)
+	public("/static/", getStatic(assets))
+	public("/login", getWebLogin(ui))
+	public("/logout", getWebLogout(ui))
+	public("/metrics", registry.Handler())
+	public("/healthz", health.Live)
+	public("/readyz", checker.ReadyHandler())
+	page("/transactions", auth.ScopeRead, getWebList(ui, tenants))
+	page("/transactions/new", auth.ScopeWrite, getWebNew(ui, tenants, cache, catalog, defaultSelection))
+	page("/transactions/view", auth.ScopeRead, getWebView(ui, tenants, cache, catalog, defaultSelection))
+	page("/transactions/edit", auth.ScopeWrite, getWebEdit(ui, tenants, cache, catalog, defaultSelection))
+	page("/transactions/delete", auth.ScopeWrite, getWebDelete(ui, tenants))
+	api("/queryTransaction", auth.ScopeRead, getQueryTransactionHandler(tenants))
+	api("/registerTransaction", auth.ScopeWrite, getRegisterTransaction(tenants, cache, catalog, defaultSelection))
+	api("/convertTransaction", auth.ScopeConvert, getConvertTransaction(tenants, cache, catalog, defaultSelection))
+	api("/bulkConvert", auth.ScopeConvert, getBulkConvert(tenants, cache, catalog, defaultSelection))
+	api("/conversions", auth.ScopeRead, getConversions(tenants))
+	api("/currencies", auth.ScopeRead, getCurrencies(catalog))
+	api("/rates", auth.ScopeRead, getRates(cache, catalog, cfg.RateSeriesYears))
+	api("/admin/prefetch", auth.ScopeAdmin, getAdminPrefetch(prefetcher))
+	api("/admin/settings", auth.ScopeAdmin, getAdminSettings(tenants, catalog, defaultSelection))
 
-	err := http.ListenAndServe(":3333", nil)
+	slog.Info("Listening", "addr", cfg.Addr)
+	err = serve(&http.Server{Addr: cfg.Addr}, prefetcher, tenants, tracer)
 	if err != nil {
 		log.Fatalf("Server stopped: %v", err)
 	}
 }
+
+// time given to the requests in progress, and to the last writes and spans,
+// on shutdown
+const shutdownTimeout = 10 * time.Second
+
+// serve runs server until SIGINT or SIGTERM, letting the requests in
+// progress end, then stops prefetcher, saves the last writes of tenants,
+// exports the last spans of tracer and closes its exporter. It returns the error that stopped the server otherwise.
+func serve(server *http.Server, prefetcher *external.Prefetcher,
+	tenants *persistance.TenantStore, tracer *tracing.Tracer) error {
+
+	signals, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+	var err error
+	select {
+	case err = <-served:
+	case <-signals.Done():
+		slog.Info("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err = server.Shutdown(ctx)
+	}
+
+	// the prefetch job reads the tenants, it is stopped before they close
+	prefetcher.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if storageErr := tenants.Close(ctx); storageErr != nil {
+		slog.Error("Could not save the last writes", "error", storageErr)
+	}
+	if traceErr := tracer.Shutdown(ctx); traceErr != nil {
+		slog.Warn("Could not export the last spans", "error", traceErr)
+	}
+	return err
+}
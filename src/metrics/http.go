@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+	"wex/src/response"
+)
+
+// Requests counts the requests served and their latency by route, method
+// and status.
+type Requests struct {
+	count    *CounterVec
+	duration *HistogramVec
+}
+
+func NewRequests(r *Registry) *Requests {
+	return &Requests{
+		count: r.Counter("wex_http_requests_total",
+			"Requests served by route, method and status.", "route", "method", "status"),
+		duration: r.Histogram("wex_http_request_duration_seconds",
+			"Time taken to serve requests by route, method and status.", DefaultBuckets,
+			"route", "method", "status"),
+	}
+}
+
+// Middleware measures the requests of route. The route is the pattern the
+// handler is registered with rather than the path, so that the series stay
+// bounded whatever paths clients request.
+func (m *Requests) Middleware(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := response.NewRecorder(w)
+		next(recorder, r)
+
+		status := recorder.Status()
+		method := r.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch, http.MethodOptions:
+		default:
+			// arbitrary methods would add series of their own
+			method = "other"
+		}
+		labels := []string{route, method, strconv.Itoa(status)}
+		m.count.Inc(labels...)
+		m.duration.Observe(time.Since(started).Seconds(), labels...)
+	}
+}
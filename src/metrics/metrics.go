@@ -0,0 +1,284 @@
+// Package metrics keeps counters, gauges and histograms and exposes them in
+// the Prometheus text exposition format, without depending on the
+// Prometheus client.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the latency histograms,
+// the same as the Prometheus client defaults.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type family interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metrics exposed by a Handler, written in the order they
+// were registered.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+	names    map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// register panics when a name is used twice: metrics are registered on
+// start, a duplicate is a programming error.
+func (r *Registry) register(name string, f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metric %v registered twice", name))
+	}
+	r.names[name] = true
+	r.families = append(r.families, f)
+}
+
+// Counter registers a counter with the given label names.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec[float64](name, help, labels)}
+	r.register(name, c)
+	return c
+}
+
+// Histogram registers a histogram with the given bucket upper bounds and
+// label names.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{vec: newVec[*histogram](name, help, labels), buckets: append([]float64{}, buckets...)}
+	sort.Float64s(h.buckets)
+	r.register(name, h)
+	return h
+}
+
+// GaugeFunc registers a gauge whose value is read when the metrics are
+// scraped.
+func (r *Registry) GaugeFunc(name, help string, value func() float64) {
+	r.register(name, funcFamily{name: name, help: help, kind: "gauge", value: value})
+}
+
+// CounterFunc registers a counter whose value is read when the metrics are
+// scraped, for counts kept by another component.
+func (r *Registry) CounterFunc(name, help string, value func() float64) {
+	r.register(name, funcFamily{name: name, help: help, kind: "counter", value: value})
+}
+
+// Write writes every metric in the text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]family{}, r.families...)
+	r.mu.Unlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+// Handler serves the metrics to Prometheus.
+func (r *Registry) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		r.Write(w)
+	}
+}
+
+// vec keeps the series of a metric by label values.
+type vec[T any] struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*series[T]
+}
+
+type series[T any] struct {
+	labelValues []string
+	value       T
+}
+
+func newVec[T any](name, help string, labels []string) vec[T] {
+	return vec[T]{name: name, help: help, labels: labels, series: make(map[string]*series[T])}
+}
+
+// with returns the series of the label values, creating it with value
+// fresh. Must be called holding v.mu.
+func (v *vec[T]) with(labelValues []string, fresh func() T) *series[T] {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %v takes %v label values, got %v", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series[T]{labelValues: append([]string{}, labelValues...), value: fresh()}
+		v.series[key] = s
+	}
+	return s
+}
+
+// sorted returns the series ordered by label values, so that scrapes are
+// stable. Must be called holding v.mu.
+func (v *vec[T]) sorted() []*series[T] {
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	sorted := make([]*series[T], len(keys))
+	for i, key := range keys {
+		sorted[i] = v.series[key]
+	}
+	return sorted
+}
+
+func (v *vec[T]) header(w *bufio.Writer, kind string) {
+	writeHeader(w, v.name, v.help, kind)
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, helpEscaper.Replace(help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, kind)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// writeSample writes a line of the exposition, extra is an additional label
+// such as the le of histogram buckets.
+func writeSample(w *bufio.Writer, name string, labels, values []string, extra [2]string, value float64) {
+	w.WriteString(name)
+	pairs := 0
+	writePair := func(label, value string) {
+		if pairs == 0 {
+			w.WriteByte('{')
+		} else {
+			w.WriteByte(',')
+		}
+		pairs++
+		fmt.Fprintf(w, `%v="%v"`, label, labelEscaper.Replace(value))
+	}
+	for i, label := range labels {
+		writePair(label, values[i])
+	}
+	if extra[0] != "" {
+		writePair(extra[0], extra[1])
+	}
+	if pairs > 0 {
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatValue(value))
+	w.WriteByte('\n')
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// CounterVec counts events by label values.
+type CounterVec struct {
+	vec[float64]
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds a positive amount to the counter of the label values.
+func (c *CounterVec) Add(amount float64, labelValues ...string) {
+	if amount < 0 {
+		panic(fmt.Sprintf("counter %v cannot decrease", c.name))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.with(labelValues, func() float64 { return 0 }).value += amount
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w, "counter")
+	for _, s := range c.sorted() {
+		writeSample(w, c.name, c.labels, s.labelValues, [2]string{}, s.value)
+	}
+}
+
+type histogram struct {
+	counts []uint64 // by bucket, not cumulated
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec counts observations, e.g. latencies, in buckets by label
+// values.
+type HistogramVec struct {
+	vec[*histogram]
+	buckets []float64
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.with(labelValues, func() *histogram {
+		return &histogram{counts: make([]uint64, len(h.buckets))}
+	})
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.value.counts[i]++
+	}
+	s.value.count++
+	s.value.sum += value
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	for _, s := range h.sorted() {
+		var cumulated uint64
+		for i, bound := range h.buckets {
+			cumulated += s.value.counts[i]
+			writeSample(w, h.name+"_bucket", h.labels, s.labelValues,
+				[2]string{"le", formatValue(bound)}, float64(cumulated))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, s.labelValues,
+			[2]string{"le", "+Inf"}, float64(s.value.count))
+		writeSample(w, h.name+"_sum", h.labels, s.labelValues, [2]string{}, s.value.sum)
+		writeSample(w, h.name+"_count", h.labels, s.labelValues, [2]string{}, float64(s.value.count))
+	}
+}
+
+type funcFamily struct {
+	name, help, kind string
+	value            func() float64
+}
+
+func (f funcFamily) write(w *bufio.Writer) {
+	writeHeader(w, f.name, f.help, f.kind)
+	writeSample(w, f.name, nil, nil, [2]string{}, f.value())
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("requests_total", "Requests served.", "route", "status")
+	requests.Inc("/b", "200")
+	requests.Add(2, "/a", "400")
+	requests.Inc("/a", "400")
+	r.Counter("quoted_total", "Label \"values\" and help\\text\nescaped.", "path").Inc("/a\"b\\c\nd")
+	latency := r.Histogram("latency_seconds", "Latency.", []float64{1, 0.1}, "route")
+	latency.Observe(0.05, "/a")
+	latency.Observe(0.1, "/a")
+	latency.Observe(0.5, "/a")
+	latency.Observe(3, "/a")
+	r.GaugeFunc("queue_depth", "Queue depth.", func() float64 { return 3 })
+
+	var out strings.Builder
+	if err := r.Write(&out); err != nil {
+		t.Fatalf("Could not write metrics: %v", err)
+	}
+	expected := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="/a",status="400"} 3
+requests_total{route="/b",status="200"} 1
+# HELP quoted_total Label "values" and help\\text\nescaped.
+# TYPE quoted_total counter
+quoted_total{path="/a\"b\\c\nd"} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/a",le="0.1"} 2
+latency_seconds_bucket{route="/a",le="1"} 3
+latency_seconds_bucket{route="/a",le="+Inf"} 4
+latency_seconds_sum{route="/a"} 3.65
+latency_seconds_count{route="/a"} 4
+# HELP queue_depth Queue depth.
+# TYPE queue_depth gauge
+queue_depth 3
+`
+	if out.String() != expected {
+		t.Errorf("got metrics\n%v\nexpected\n%v", out.String(), expected)
+	}
+}
+
+func TestRegistryMisuse(t *testing.T) {
+	tests := []struct {
+		name   string
+		misuse func(r *Registry)
+	}{
+		{"duplicate name", func(r *Registry) { r.Counter("a_total", ""); r.GaugeFunc("a_total", "", nil) }},
+		{"missing label", func(r *Registry) { r.Counter("a_total", "", "route").Inc() }},
+		{"negative counter", func(r *Registry) { r.Counter("a_total", "").Add(-1) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected a panic")
+				}
+			}()
+			test.misuse(NewRegistry())
+		})
+	}
+}
+
+func TestRequests(t *testing.T) {
+	r := NewRegistry()
+	requests := NewRequests(r)
+	handler := requests.Middleware("/queryTransaction", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("transactionId") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("{}"))
+	})
+	for _, url := range []string{"/queryTransaction?transactionId=1", "/queryTransaction", "/queryTransaction"} {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, url, nil))
+	}
+	handler(httptest.NewRecorder(), httptest.NewRequest("BREW", "/queryTransaction?transactionId=1", nil))
+
+	res := httptest.NewRecorder()
+	r.Handler()(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if res.Header().Get("Content-Type") != ContentType {
+		t.Errorf("unexpected content type %q", res.Header().Get("Content-Type"))
+	}
+	for _, line := range []string{
+		`wex_http_requests_total{route="/queryTransaction",method="GET",status="200"} 1`,
+		`wex_http_requests_total{route="/queryTransaction",method="GET",status="400"} 2`,
+		`wex_http_requests_total{route="/queryTransaction",method="other",status="200"} 1`,
+		`wex_http_request_duration_seconds_count{route="/queryTransaction",method="GET",status="400"} 2`,
+	} {
+		if !strings.Contains(res.Body.String(), line+"\n") {
+			t.Errorf("missing %v in\n%v", line, res.Body.String())
+		}
+	}
+}
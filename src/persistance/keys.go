@@ -0,0 +1,102 @@
+package persistance
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"wex/src/auth"
+)
+
+var KeyNotFoundError = errors.New("API key not found")
+
+// KeyFile keeps the API keys in a json file next to the transactions, e.g.
+// localdb_keys.json. Keys are managed by the keys command while the server
+// runs, so the file is read again whenever it changes.
+type KeyFile struct {
+	file string
+
+	mu      sync.Mutex
+	keys    map[string]auth.APIKey
+	modTime time.Time
+}
+
+func OpenKeyFile(storageFile string) *KeyFile {
+	return &KeyFile{file: siblingFileName(storageFile, "keys"), keys: make(map[string]auth.APIKey)}
+}
+
+// reload must be called holding k.mu.
+func (k *KeyFile) reload() error {
+	info, err := os.Stat(k.file)
+	if errors.Is(err, os.ErrNotExist) {
+		k.keys = make(map[string]auth.APIKey)
+		k.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(k.modTime) {
+		return nil
+	}
+
+	keys := make(map[string]auth.APIKey)
+	if err := loadFile(k.file, &keys); err != nil {
+		return err
+	}
+	k.keys = keys
+	k.modTime = info.ModTime()
+	return nil
+}
+
+func (k *KeyFile) QueryKey(id string) (auth.APIKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.reload(); err != nil {
+		return auth.APIKey{}, err
+	}
+	key, ok := k.keys[id]
+	if !ok {
+		return key, KeyNotFoundError
+	}
+	return key, nil
+}
+
+// ListKeys returns every key, revoked ones included, oldest first.
+func (k *KeyFile) ListKeys() ([]auth.APIKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	keys := make([]auth.APIKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+// SaveKey stores a new key or replaces one, writing the file right away.
+func (k *KeyFile) SaveKey(key auth.APIKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.reload(); err != nil {
+		return err
+	}
+	k.keys[key.Id] = key
+
+	if err := writeFileAtomic(k.file, k.keys, 0600); err != nil {
+		return err
+	}
+	if info, err := os.Stat(k.file); err == nil {
+		k.modTime = info.ModTime()
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package persistance
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+	"wex/src/auth"
+)
+
+func TestKeyFile(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "db.json")
+	server := OpenKeyFile(storage)
+
+	if _, err := server.QueryKey("missing"); err != KeyNotFoundError {
+		t.Errorf("Error differs from expected: received (%v); expected (%v)", err, KeyNotFoundError)
+	}
+
+	// keys saved by the keys command are seen by the running server
+	command := OpenKeyFile(storage)
+	first, _, _ := auth.NewAPIKey("first", []auth.Scope{auth.ScopeRead})
+	second, _, _ := auth.NewAPIKey("second", []auth.Scope{auth.ScopeAdmin})
+	second.CreatedAt = first.CreatedAt.Add(time.Second)
+	if err := command.SaveKey(first); err != nil {
+		t.Fatalf("Could not save key: %v", err)
+	}
+	command.SaveKey(second)
+
+	key, err := server.QueryKey(first.Id)
+	if err != nil || key.Hash != first.Hash || key.Name != "first" {
+		t.Errorf("Unexpected key %+v (%v)", key, err)
+	}
+
+	now := time.Now().UTC()
+	first.RevokedAt = &now
+	command.SaveKey(first)
+	// the modification time has to change for the file to be read again
+	time.Sleep(10 * time.Millisecond)
+	if key, _ := server.QueryKey(first.Id); !key.Revoked() {
+		t.Error("Revocation not seen by the server")
+	}
+
+	keys, err := server.ListKeys()
+	if err != nil || len(keys) != 2 || keys[0].Id != first.Id || keys[1].Id != second.Id {
+		t.Errorf("Unexpected keys %v (%v)", keys, err)
+	}
+}
@@ -1,48 +1,145 @@
 package persistance
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 	"wex/src/application"
+	"wex/src/logging"
+	"wex/src/tracing"
 )
 
+// PersistanceDriver stores the transactions and conversions of a tenant. The
+// context is the one of the request the call is made for, storage logs are
+// written with its logger. Calls that would wait give up once it is done,
+// returning its error.
 type PersistanceDriver interface {
-	RegisterTransaction(application.Transaction) string
-	QueryTransaction(string) (application.IdentifiedTransaction, error)
+	RegisterTransaction(context.Context, application.Transaction) (string, error)
+	QueryTransaction(context.Context, string) (application.IdentifiedTransaction, error)
+	ListTransactions(context.Context, application.TransactionFilter) ([]application.IdentifiedTransaction, error)
+	UpdateTransaction(context.Context, application.IdentifiedTransaction) error
+	DeleteTransaction(context.Context, string) error
+	RecordConversion(context.Context, application.Conversion) error
+	QueryConversions(context.Context, string) ([]application.Conversion, error)
 }
 
 type Driver struct {
-	mu           *sync.Mutex
+	// read locked by queries, which never wait for a file write as files
+	// are written from a copy of the maps
+	mu           *sync.RWMutex
 	transactions map[string]application.IdentifiedTransaction
 	internalFile string
-	transChannel chan application.IdentifiedTransaction
+	// registrations waiting for the persist goroutine, already visible in
+	// transactions
+	registrations chan registration
+	// registrations answer once written to the file rather than once queued
+	durable bool
+	// signals that transactions were edited and the file has to be saved
+	transDirty chan struct{}
+
+	// conversions by transaction id, kept in their own file
+	conversions      map[string][]application.Conversion
+	conversionsFile  string
+	conversionsDirty chan struct{}
+
+	// answered by the persist goroutine, to tell it is running
+	ping chan chan struct{}
+	// answered by the persist goroutine once every pending write is saved
+	flush chan chan error
+	// answered like flush by the persist goroutine, which then returns
+	stop chan chan error
+	// error reading a file that exists, the driver started without its
+	// content
+	loadErr error
+	// told how long each write of the transactions or conversions file took
+	observeFlush func(file string, took time.Duration)
 }
 
+// files told to flush observers
+const (
+	TransactionsFile = "transactions"
+	ConversionsFile  = "conversions"
+)
+
 func pseudo_uuid() (uuid string) {
 	b := make([]byte, 16)
 	rand.Read(b)
 	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
 
-const (
-	localFileName = "./../storage/localdb.json"
-)
+// DefaultStorageFile is where transactions are stored when no other file is
+// configured, relative to the directory of the executable.
+const DefaultStorageFile = "./../storage/localdb.json"
+
+// conversionsFileName returns the file that keeps the conversions of the
+// transactions stored in storageFile, e.g. localdb_conversions.json.
+func conversionsFileName(storageFile string) string {
+	return siblingFileName(storageFile, "conversions")
+}
+
+func siblingFileName(storageFile, suffix string) string {
+	ext := filepath.Ext(storageFile)
+	return strings.TrimSuffix(storageFile, ext) + "_" + suffix + ext
+}
+
+// WriteOptions tell how registrations are handed to the persist goroutine.
+type WriteOptions struct {
+	// registrations waiting to be written beyond which new ones are refused
+	// with ErrQueueFull, DefaultQueueSize when 0
+	QueueSize int
+	// registrations answer once written to the storage file rather than
+	// once visible in memory
+	Durable bool
+}
+
+const DefaultQueueSize = 1024
 
 func startDriver(storageFile string) *Driver {
+	return openDriver(storageFile, WriteOptions{})
+}
+
+func openDriver(storageFile string, options WriteOptions) *Driver {
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultQueueSize
+	}
 	d := Driver{
-		internalFile: storageFile,
-		transChannel: make(chan application.IdentifiedTransaction),
-		mu:           &sync.Mutex{}}
+		internalFile:     storageFile,
+		registrations:    make(chan registration, options.QueueSize),
+		durable:          options.Durable,
+		transDirty:       make(chan struct{}, 1),
+		conversionsFile:  conversionsFileName(storageFile),
+		conversionsDirty: make(chan struct{}, 1),
+		ping:             make(chan chan struct{}),
+		flush:            make(chan chan error),
+		stop:             make(chan chan error),
+		mu:               &sync.RWMutex{}}
 
 	var err error
 	d.transactions, err = d.loadLocalContent()
-	if err != nil {
-		log.Printf("Internal db (%v) not found", storageFile)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Info("Internal db not found, starting empty", "file", storageFile)
+	} else if err != nil {
+		slog.Error("Could not read internal db, starting empty", "file", storageFile, "error", err)
+		d.loadErr = fmt.Errorf("could not read %v: %w", storageFile, err)
+	}
+
+	d.conversions = make(map[string][]application.Conversion)
+	err = loadFile(d.conversionsFile, &d.conversions)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Info("Conversions db not found, starting empty", "file", d.conversionsFile)
+	} else if err != nil {
+		slog.Error("Could not read conversions db, starting empty", "file", d.conversionsFile, "error", err)
+		d.loadErr = errors.Join(d.loadErr, fmt.Errorf("could not read %v: %w", d.conversionsFile, err))
 	}
 
 	go d.monitorPersistQueue()
@@ -50,89 +147,426 @@ func startDriver(storageFile string) *Driver {
 	return &d
 }
 
-func StartDriver() *Driver {
-	return startDriver(localFileName)
+// StartDriver loads the transactions stored in storageFile and starts
+// persisting new ones to it.
+func StartDriver(storageFile string) *Driver {
+	return startDriver(storageFile)
 }
 
-func (d *Driver) RegisterTransaction(tran application.Transaction) string {
+// registration is answered by the persist goroutine once the transactions
+// file holding it is written.
+type registration struct {
+	persisted chan error
+}
 
-	var newUid string
-	d.mu.Lock()
-	defer d.mu.Unlock()
+var (
+	ErrQueueFull    = errors.New("Storage queue full, retry later")
+	ErrNotPersisted = errors.New("Transaction not persisted yet")
+)
+
+// RegisterTransaction stores the transaction and returns its id. The
+// transaction can be queried as soon as it returns; it is written to the file
+// by the persist goroutine, which the call waits for when the driver is
+// durable. A durable registration whose write fails or is given up returns
+// its id along with ErrNotPersisted: the transaction stays stored and is
+// written with the next write. Registrations are refused with ErrQueueFull
+// while the goroutine is too far behind.
+func (d *Driver) RegisterTransaction(ctx context.Context, tran application.Transaction) (string, error) {
+	span := d.startSpan(ctx, "RegisterTransaction")
+	defer span.End()
 
+	persisted := make(chan error, 1)
+	d.mu.Lock()
+	var newUid string
 	for {
 		newUid = pseudo_uuid()
 		if _, ok := d.transactions[newUid]; !ok {
 			break
 		}
 	}
-	d.transChannel <- application.IdentifiedTransaction{Transaction: tran, Uid: newUid}
-	return newUid
+	// queued holding the lock, so that the goroutine writes the file with
+	// the transaction in it
+	select {
+	case d.registrations <- registration{persisted: persisted}:
+	default:
+		d.mu.Unlock()
+		span.Fail(ErrQueueFull)
+		return "", ErrQueueFull
+	}
+	d.transactions[newUid] = application.IdentifiedTransaction{Transaction: tran, Uid: newUid}
+	d.mu.Unlock()
+	logging.FromContext(ctx).Debug("Transaction queued for storage", "transactionId", newUid, "file", d.internalFile)
+
+	if !d.durable {
+		return newUid, nil
+	}
+	var err error
+	select {
+	case err = <-persisted:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		span.Fail(err)
+		return newUid, fmt.Errorf("%w: %v: %w", ErrNotPersisted, newUid, err)
+	}
+	return newUid, nil
 }
 
-func (d *Driver) registerTransaction(tran application.IdentifiedTransaction) {
+var QueryNotFoundError = errors.New("Transaction not found")
+
+func (d *Driver) QueryTransaction(ctx context.Context, transactionId string) (application.IdentifiedTransaction, error) {
+	span := d.startSpan(ctx, "QueryTransaction")
+	defer span.End()
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if transaction, ok := d.transactions[transactionId]; ok {
+		return transaction, nil
+	} else {
+		return transaction, QueryNotFoundError
+	}
+
+}
+
+// UpdateTransaction replaces a stored transaction. Conversions recorded for
+// it are dropped when its amount or date change, as they no longer apply.
+func (d *Driver) UpdateTransaction(ctx context.Context, tran application.IdentifiedTransaction) error {
+	span := d.startSpan(ctx, "UpdateTransaction")
+	defer span.End()
 
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if _, ok := d.transactions[tran.Uid]; ok {
-		log.Fatalf("Transaction %v already existed", tran.Uid)
-	} else {
-		d.transactions[tran.Uid] = tran
+	previous, ok := d.transactions[tran.Uid]
+	if !ok {
+		return QueryNotFoundError
+	}
+	d.transactions[tran.Uid] = tran
+	signal(d.transDirty)
+	logging.FromContext(ctx).Debug("Transaction updated in storage", "transactionId", tran.Uid, "file", d.internalFile)
+
+	if previous.Amount != tran.Amount || !previous.Date.Equal(tran.Date.Time) {
+		if _, ok := d.conversions[tran.Uid]; ok {
+			delete(d.conversions, tran.Uid)
+			signal(d.conversionsDirty)
+		}
 	}
+	return nil
 }
 
-var QueryNotFoundError = errors.New("Transaction not found")
+// DeleteTransaction removes a transaction and its conversions.
+func (d *Driver) DeleteTransaction(ctx context.Context, transactionId string) error {
+	span := d.startSpan(ctx, "DeleteTransaction")
+	defer span.End()
 
-func (d *Driver) QueryTransaction(transactionId string) (application.IdentifiedTransaction, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if transaction, ok := d.transactions[transactionId]; ok {
-		return transaction, nil
-	} else {
-		return transaction, QueryNotFoundError
+	if _, ok := d.transactions[transactionId]; !ok {
+		return QueryNotFoundError
+	}
+	delete(d.transactions, transactionId)
+	signal(d.transDirty)
+	logging.FromContext(ctx).Debug("Transaction deleted from storage", "transactionId", transactionId, "file", d.internalFile)
+
+	if _, ok := d.conversions[transactionId]; ok {
+		delete(d.conversions, transactionId)
+		signal(d.conversionsDirty)
+	}
+	return nil
+}
+
+// signal wakes the persist goroutine, pending signals are merged.
+func signal(dirty chan struct{}) {
+	select {
+	case dirty <- struct{}{}:
+	default:
+	}
+}
+
+// ListTransactions returns the transactions matching filter ordered by
+// purchase date.
+func (d *Driver) ListTransactions(ctx context.Context,
+	filter application.TransactionFilter) ([]application.IdentifiedTransaction, error) {
+
+	span := d.startSpan(ctx, "ListTransactions")
+	defer span.End()
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	// the request may have been given up while waiting for the lock
+	if err := ctx.Err(); err != nil {
+		span.Fail(err)
+		return nil, err
 	}
+	transactions := []application.IdentifiedTransaction{}
+	for _, transaction := range d.transactions {
+		if filter.Matches(transaction) {
+			transactions = append(transactions, transaction)
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		if transactions[i].Date.Equal(transactions[j].Date.Time) {
+			return transactions[i].Uid < transactions[j].Uid
+		}
+		return transactions[i].Date.Before(transactions[j].Date.Time)
+	})
+	return transactions, nil
+}
+
+// RecordConversion keeps the conversion in the history of its transaction.
+func (d *Driver) RecordConversion(ctx context.Context, conversion application.Conversion) error {
+	span := d.startSpan(ctx, "RecordConversion")
+	defer span.End()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.transactions[conversion.TransactionUid]; !ok {
+		return QueryNotFoundError
+	}
+	d.conversions[conversion.TransactionUid] = append(
+		d.conversions[conversion.TransactionUid], conversion)
+
+	signal(d.conversionsDirty)
+	logging.FromContext(ctx).Debug("Conversion recorded in storage", "transactionId", conversion.TransactionUid,
+		"currency", conversion.Currency, "file", d.conversionsFile)
+	return nil
+}
+
+// QueryConversions returns the conversions of a transaction, oldest first.
+func (d *Driver) QueryConversions(ctx context.Context, transactionId string) ([]application.Conversion, error) {
+	span := d.startSpan(ctx, "QueryConversions")
+	defer span.End()
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if _, ok := d.transactions[transactionId]; !ok {
+		return nil, QueryNotFoundError
+	}
+	conversions := make([]application.Conversion, len(d.conversions[transactionId]))
+	copy(conversions, d.conversions[transactionId])
+	return conversions, nil
+}
 
+// startSpan starts the span of a call to the driver, a storage call the
+// request waits for.
+func (d *Driver) startSpan(ctx context.Context, method string) *tracing.Span {
+	_, span := tracing.Start(ctx, "PersistanceDriver."+method, tracing.KindInternal)
+	span.Set("storage.file", d.internalFile)
+	return span
+}
+
+// QueueDepth returns the number of writes waiting for the persist
+// goroutine: transactions being registered and files to save again.
+func (d *Driver) QueueDepth() int {
+	return len(d.registrations) + len(d.transDirty) + len(d.conversionsDirty)
 }
 
 func (d *Driver) monitorPersistQueue() {
 	for {
 		select {
-		case newTransaction := <-d.transChannel:
-			d.registerTransaction(newTransaction)
+		case r := <-d.registrations:
+			d.persistRegistrations(r)
+		case <-d.transDirty:
 			d.persistToFile()
+		case <-d.conversionsDirty:
+			d.persistConversions()
+		case reply := <-d.ping:
+			close(reply)
+		case reply := <-d.flush:
+			reply <- d.persistPending()
+		case reply := <-d.stop:
+			reply <- d.persistPending()
+			return
 		}
 	}
+}
 
+// persistRegistrations writes the transactions file once for every
+// registration queued so far and tells each of them.
+func (d *Driver) persistRegistrations(first registration) error {
+	queued := []registration{first}
+	for pending := len(d.registrations); pending > 0; pending-- {
+		queued = append(queued, <-d.registrations)
+	}
+	err := d.persistToFile()
+	for _, r := range queued {
+		r.persisted <- err
+	}
+	return err
 }
 
-func (d *Driver) loadLocalContent() (map[string]application.IdentifiedTransaction, error) {
+// persistPending writes the files with writes waiting for the persist
+// goroutine, it must be called from the goroutine.
+func (d *Driver) persistPending() error {
+	var errs []error
+	select {
+	case r := <-d.registrations:
+		// the file written holds the edits signalled so far too
+		errs = append(errs, d.persistRegistrations(r))
+	case <-d.transDirty:
+		errs = append(errs, d.persistToFile())
+	default:
+	}
+	select {
+	case <-d.conversionsDirty:
+		errs = append(errs, d.persistConversions())
+	default:
+	}
+	return errors.Join(errs...)
+}
 
-	k := make(map[string]application.IdentifiedTransaction)
+// Flush waits until every write made so far is saved to the storage files.
+func (d *Driver) Flush(ctx context.Context) error {
+	reply := make(chan error, 1)
+	select {
+	case d.flush <- reply:
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", ErrPersistStalled, d.internalFile)
+	}
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close saves the writes made so far and stops the persist goroutine, the
+// driver must not be used afterwards.
+func (d *Driver) Close(ctx context.Context) error {
+	reply := make(chan error, 1)
+	select {
+	case d.stop <- reply:
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", ErrPersistStalled, d.internalFile)
+	}
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	content, err := os.ReadFile(d.internalFile)
+var ErrPersistStalled = errors.New("Persist goroutine not answering")
+
+// Ping tells whether the persist goroutine is running and free to take new
+// writes before ctx is done.
+func (d *Driver) Ping(ctx context.Context) error {
+	reply := make(chan struct{})
+	select {
+	case d.ping <- reply:
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", ErrPersistStalled, d.internalFile)
+	}
+	<-reply
+	return nil
+}
+
+// CheckStorage tells whether the files of the driver were read and whether
+// their directory can be written.
+func (d *Driver) CheckStorage() error {
+	if d.loadErr != nil {
+		return d.loadErr
+	}
+	dir := filepath.Dir(d.internalFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".probe-*")
 	if err != nil {
-		return k, err
+		return err
 	}
-	err = json.Unmarshal(content, &k)
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+func loadFile(fileName string, v any) error {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+func (d *Driver) loadLocalContent() (map[string]application.IdentifiedTransaction, error) {
+
+	k := make(map[string]application.IdentifiedTransaction)
+
+	err := loadFile(d.internalFile, &k)
 	if err != nil {
 		return k, err
 	}
 	return k, nil
 }
 
-func (d *Driver) persistToFile() {
-
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	content, err := json.Marshal(d.transactions)
+func writeFile(fileName string, v any) error {
+	content, err := json.Marshal(v)
 	if err != nil {
-		log.Fatalf("Could not parse internal map in memory: %v", err)
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
 	}
+	return os.WriteFile(fileName, content, 0644)
+}
 
-	err = os.WriteFile(d.internalFile, content, 0644)
+// writeFileAtomic writes v aside and renames it over fileName, so that
+// readers, a running server included, never read half of the file.
+func writeFileAtomic(fileName string, v any, perm os.FileMode) error {
+	content, err := json.Marshal(v)
 	if err != nil {
-		log.Fatalf("Could not save internal db: %v", err)
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+	tmp := fileName + ".tmp"
+	if err = os.WriteFile(tmp, content, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fileName)
+}
+
+// persistToFile and persistConversions marshal a copy of the map taken under
+// the read lock, so that neither queries nor edits wait for the write. Only
+// the persist goroutine writes, so copies are saved in the order they are
+// taken.
+func (d *Driver) persistToFile() error {
+	d.mu.RLock()
+	transactions := maps.Clone(d.transactions)
+	d.mu.RUnlock()
+	started := time.Now()
+	if err := writeFile(d.internalFile, transactions); err != nil {
+		slog.Error("Could not save internal db, it is kept in memory until the next write", "file", d.internalFile, "error", err)
+		return err
+	}
+	d.flushed(TransactionsFile, started)
+	return nil
+}
+
+func (d *Driver) persistConversions() error {
+	// the slices are shared, RecordConversion only appends past their length
+	d.mu.RLock()
+	conversions := maps.Clone(d.conversions)
+	d.mu.RUnlock()
+	started := time.Now()
+	if err := writeFile(d.conversionsFile, conversions); err != nil {
+		slog.Error("Could not save conversions db, it is kept in memory until the next write", "file", d.conversionsFile, "error", err)
+		return err
+	}
+	d.flushed(ConversionsFile, started)
+	return nil
+}
+
+func (d *Driver) flushed(file string, started time.Time) {
+	if d.observeFlush != nil {
+		d.observeFlush(file, time.Since(started))
 	}
 }
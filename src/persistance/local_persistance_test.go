@@ -1,8 +1,13 @@
 package persistance
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 	"wex/src/application"
@@ -18,17 +23,32 @@ const testFileName = "storage_test.json"
 
 func TestMain(m *testing.M) {
 	os.Remove(testFileName)
+	os.Remove(conversionsFileName(testFileName))
 	code := m.Run()
 	os.Remove(testFileName)
+	os.Remove(conversionsFileName(testFileName))
 	os.Exit(code)
 }
 
+// registerTransaction stores tran with its own uid, as if loaded from the
+// file.
+func registerTransaction(t testing.TB, d *Driver, tran application.IdentifiedTransaction) {
+	t.Helper()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.transactions[tran.Uid]; ok {
+		t.Fatalf("Transaction %v already existed", tran.Uid)
+	}
+	d.transactions[tran.Uid] = tran
+}
+
 func TestPersist(t *testing.T) {
-	d := startDriver(testFileName)
+	d := openDriver(testFileName, WriteOptions{Durable: true})
 	tran := application.GetSampleTransaction()
-	uid := d.RegisterTransaction(tran)
-
-	time.Sleep(500 * time.Millisecond)
+	uid, err := d.RegisterTransaction(context.Background(), tran)
+	if err != nil {
+		t.Fatalf("Could not register transaction: %v", err)
+	}
 
 	content, err := os.ReadFile(testFileName)
 	if err != nil {
@@ -57,3 +77,336 @@ func TestPersist(t *testing.T) {
 	}
 
 }
+
+func TestListTransactions(t *testing.T) {
+	d := startDriver(testFileName)
+
+	var uids []string
+	for _, date := range []string{"2023-03-01", "2023-01-01", "2023-02-01"} {
+		tran, _ := application.NewTransaction("list "+date, date, "1.00")
+		uid := pseudo_uuid()
+		registerTransaction(t, d, application.IdentifiedTransaction{Transaction: tran, Uid: uid})
+		uids = append(uids, uid)
+	}
+
+	all, err := d.ListTransactions(context.Background(), application.TransactionFilter{Description: "LIST"})
+	if err != nil || len(all) != 3 {
+		t.Fatalf("Expected 3 transactions, got %v", len(all))
+	}
+	if all[0].Uid != uids[1] || all[1].Uid != uids[2] || all[2].Uid != uids[0] {
+		t.Errorf("Transactions not ordered by date: %v", all)
+	}
+
+	filter, _ := application.NewTransactionFilter("2023-02-01", "2023-03-01", "list")
+	filtered, _ := d.ListTransactions(context.Background(), filter)
+	if len(filtered) != 2 {
+		t.Errorf("Expected 2 transactions, got %v", filtered)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.ListTransactions(ctx, filter); !errors.Is(err, context.Canceled) {
+		t.Errorf("Listing not given up with its context: %v", err)
+	}
+}
+
+func TestRecordConversion(t *testing.T) {
+	d := startDriver(testFileName)
+	tran := application.GetSampleIdentifiedTransaction()
+	tran.Uid = pseudo_uuid()
+	registerTransaction(t, d, tran)
+	d.persistToFile()
+
+	rate, _ := application.NewExchangeRate("Mexico-Peso", "17.077", "1997-12-31")
+	conversion := application.NewConversion(tran, rate, application.LatestRate, "test")
+
+	if err := d.RecordConversion(context.Background(), conversion); err != nil {
+		t.Fatalf("Could not record conversion: %v", err)
+	}
+	missing := conversion
+	missing.TransactionUid = "missing"
+	if err := d.RecordConversion(context.Background(), missing); err != QueryNotFoundError {
+		t.Errorf("Error differs from expected: received (%v); expected (%v)", err, QueryNotFoundError)
+	}
+
+	conversions, err := d.QueryConversions(context.Background(), tran.Uid)
+	if err != nil || len(conversions) != 1 || conversions[0] != conversion {
+		t.Errorf("Unexpected conversions %v (%v)", conversions, err)
+	}
+
+	if err := d.Flush(context.Background()); err != nil {
+		t.Fatalf("Could not flush writes: %v", err)
+	}
+
+	reloaded := startDriver(testFileName)
+	conversions, err = reloaded.QueryConversions(context.Background(), tran.Uid)
+	if err != nil || len(conversions) != 1 {
+		t.Fatalf("Conversion not persisted: %v (%v)", conversions, err)
+	}
+	if !conversions[0].Timestamp.Equal(conversion.Timestamp) ||
+		conversions[0].ConvertedValue.ToString() != conversion.ConvertedValue.ToString() {
+		t.Errorf("Conversion persisted %v different from expected %v", conversions[0], conversion)
+	}
+}
+
+func TestPersistForeignTransaction(t *testing.T) {
+	d := startDriver(testFileName)
+	tran, _ := application.NewTransaction("Lunch in Mexico City", "2023-07-02", "341.54")
+	rate, _ := application.NewExchangeRate("Mexico-Peso", "17.077", "2023-06-30")
+	tran, _ = application.NewForeignTransaction(tran, rate, application.LatestRate, "test")
+
+	uid := pseudo_uuid()
+	registerTransaction(t, d, application.IdentifiedTransaction{Transaction: tran, Uid: uid})
+	d.persistToFile()
+
+	reloaded := startDriver(testFileName)
+	recorded, err := reloaded.QueryTransaction(context.Background(), uid)
+	if err != nil {
+		t.Fatalf("Transaction not persisted: %v", err)
+	}
+	if recorded.Amount.ToString() != "20.00" || recorded.Foreign == nil ||
+		recorded.Foreign.Amount.ToString() != "341.54" || recorded.Foreign.Currency != "Mexico-Peso" ||
+		recorded.Foreign.RateRecordDate.ToString() != "2023-06-30" {
+		t.Errorf("Foreign transaction recorded %+v differs from expected %+v", recorded, tran)
+	}
+}
+
+func TestUpdateDeleteTransaction(t *testing.T) {
+	d := startDriver(testFileName)
+	tran := application.GetSampleIdentifiedTransaction()
+	tran.Uid = pseudo_uuid()
+	registerTransaction(t, d, tran)
+
+	rate, _ := application.NewExchangeRate("Mexico-Peso", "17.077", "1997-12-31")
+	d.RecordConversion(context.Background(), application.NewConversion(tran, rate, application.LatestRate, "test"))
+
+	renamed := tran
+	renamed.Description = "renamed"
+	if err := d.UpdateTransaction(context.Background(), renamed); err != nil {
+		t.Fatalf("Could not update transaction: %v", err)
+	}
+	if conversions, _ := d.QueryConversions(context.Background(), tran.Uid); len(conversions) != 1 {
+		t.Errorf("Conversions dropped on description change: %v", conversions)
+	}
+
+	repriced := renamed
+	repriced.Amount, _ = application.NewMoney("2.00")
+	d.UpdateTransaction(context.Background(), repriced)
+	if conversions, _ := d.QueryConversions(context.Background(), tran.Uid); len(conversions) != 0 {
+		t.Errorf("Conversions kept on amount change: %v", conversions)
+	}
+
+	if err := d.Flush(context.Background()); err != nil {
+		t.Fatalf("Could not flush writes: %v", err)
+	}
+	recorded, err := startDriver(testFileName).QueryTransaction(context.Background(), tran.Uid)
+	if err != nil || recorded.Description != "renamed" || recorded.Amount.ToString() != "2.00" {
+		t.Errorf("Update not persisted: %v (%v)", recorded, err)
+	}
+
+	if err := d.DeleteTransaction(context.Background(), tran.Uid); err != nil {
+		t.Fatalf("Could not delete transaction: %v", err)
+	}
+	if _, err := d.QueryTransaction(context.Background(), tran.Uid); err != QueryNotFoundError {
+		t.Errorf("Error differs from expected: received (%v); expected (%v)", err, QueryNotFoundError)
+	}
+	if err := d.DeleteTransaction(context.Background(), tran.Uid); err != QueryNotFoundError {
+		t.Errorf("Error differs from expected: received (%v); expected (%v)", err, QueryNotFoundError)
+	}
+	if err := d.UpdateTransaction(context.Background(), tran); err != QueryNotFoundError {
+		t.Errorf("Error differs from expected: received (%v); expected (%v)", err, QueryNotFoundError)
+	}
+
+	if err := d.Flush(context.Background()); err != nil {
+		t.Fatalf("Could not flush writes: %v", err)
+	}
+	if _, err := startDriver(testFileName).QueryTransaction(context.Background(), tran.Uid); err != QueryNotFoundError {
+		t.Errorf("Delete not persisted: %v", err)
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	dir := t.TempDir()
+	d := startDriver(filepath.Join(dir, "db.json"))
+	if err := d.CheckStorage(); err != nil {
+		t.Errorf("Storage check failed: %v", err)
+	}
+	if err := d.Ping(context.Background()); err != nil {
+		t.Errorf("Persist goroutine not answering: %v", err)
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corrupt, []byte(`{"uid": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := startDriver(corrupt).CheckStorage(); err == nil {
+		t.Error("Storage check passed with an unreadable file")
+	}
+
+	// no persist goroutine reads the ping channel
+	stalled := &Driver{internalFile: "stalled.json", ping: make(chan chan struct{})}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := stalled.Ping(ctx); !errors.Is(err, ErrPersistStalled) {
+		t.Errorf("Unexpected ping error %v", err)
+	}
+}
+
+func TestRegisterTransactionQueue(t *testing.T) {
+	// no persist goroutine takes the registrations
+	stalled := &Driver{
+		mu:            &sync.RWMutex{},
+		transactions:  make(map[string]application.IdentifiedTransaction),
+		registrations: make(chan registration, 1),
+	}
+
+	uid, err := stalled.RegisterTransaction(context.Background(), application.GetSampleTransaction())
+	if err != nil {
+		t.Fatalf("Could not register transaction: %v", err)
+	}
+	if _, err := stalled.QueryTransaction(context.Background(), uid); err != nil {
+		t.Errorf("Transaction not visible once registered: %v", err)
+	}
+	if _, err := stalled.RegisterTransaction(context.Background(), application.GetSampleTransaction()); err != ErrQueueFull {
+		t.Errorf("Expected the queue to be full, got %v", err)
+	}
+	if depth := stalled.QueueDepth(); depth != 1 {
+		t.Errorf("Unexpected queue depth %v", depth)
+	}
+	if list, _ := stalled.ListTransactions(context.Background(), application.TransactionFilter{}); len(list) != 1 {
+		t.Errorf("Refused registration stored: %v", list)
+	}
+
+	<-stalled.registrations
+	stalled.durable = true
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	uid, err = stalled.RegisterTransaction(ctx, application.GetSampleTransaction())
+	if !errors.Is(err, ErrNotPersisted) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, err := stalled.QueryTransaction(context.Background(), uid); err != nil {
+		t.Errorf("Transaction waiting to be persisted not visible: %v", err)
+	}
+}
+
+func TestRegisterTransactionBatch(t *testing.T) {
+	// registrations queue until the persist goroutine, run by hand, takes them
+	d := &Driver{
+		mu:            &sync.RWMutex{},
+		transactions:  make(map[string]application.IdentifiedTransaction),
+		internalFile:  filepath.Join(t.TempDir(), "db.json"),
+		registrations: make(chan registration, 10),
+	}
+	flushes := 0
+	d.observeFlush = func(file string, took time.Duration) {
+		flushes++
+	}
+
+	var uids []string
+	for i := 0; i < 10; i++ {
+		uid, err := d.RegisterTransaction(context.Background(), application.GetSampleTransaction())
+		if err != nil {
+			t.Fatalf("Could not register transaction: %v", err)
+		}
+		uids = append(uids, uid)
+	}
+	if err := d.persistRegistrations(<-d.registrations); err != nil {
+		t.Fatalf("Could not persist registrations: %v", err)
+	}
+	if flushes != 1 || d.QueueDepth() != 0 {
+		t.Errorf("Expected a single write for every registration, got %v with %v left", flushes, d.QueueDepth())
+	}
+
+	reloaded := startDriver(d.internalFile)
+	for _, uid := range uids {
+		if _, err := reloaded.QueryTransaction(context.Background(), uid); err != nil {
+			t.Errorf("Transaction %v not persisted: %v", uid, err)
+		}
+	}
+}
+
+// benchmarkDriver returns a driver holding size transactions, whose file is
+// saved again on every update.
+func benchmarkDriver(b *testing.B, size int) (*Driver, []string) {
+	d := openDriver(filepath.Join(b.TempDir(), "db.json"), WriteOptions{})
+	uids := make([]string, size)
+	for i := range uids {
+		uids[i] = pseudo_uuid()
+		registerTransaction(b, d, application.IdentifiedTransaction{
+			Transaction: application.GetSampleTransaction(), Uid: uids[i]})
+	}
+	return d, uids
+}
+
+// writeContinuously updates transactions of d, waiting for each file write,
+// until the returned function is called. It returns the number of writes.
+func writeContinuously(d *Driver, uids []string) func() int {
+	done := make(chan struct{})
+	writes := make(chan int)
+	go func() {
+		count := 0
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				writes <- count
+				return
+			default:
+			}
+			tran, _ := d.QueryTransaction(context.Background(), uids[i%len(uids)])
+			d.UpdateTransaction(context.Background(), tran)
+			d.Flush(context.Background())
+			count++
+		}
+	}()
+	return func() int {
+		close(done)
+		return <-writes
+	}
+}
+
+// BenchmarkQueryTransaction reads transactions from parallel goroutines,
+// with the file idle and while it is saved over and over.
+func BenchmarkQueryTransaction(b *testing.B) {
+	for _, size := range []int{1000, 10000} {
+		for _, writing := range []bool{false, true} {
+			b.Run(fmt.Sprintf("transactions=%v/writing=%v", size, writing), func(b *testing.B) {
+				d, uids := benchmarkDriver(b, size)
+				var stop func() int
+				if writing {
+					stop = writeContinuously(d, uids)
+				}
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for i := 0; pb.Next(); i++ {
+						if _, err := d.QueryTransaction(context.Background(), uids[i%len(uids)]); err != nil {
+							b.Error(err)
+						}
+					}
+				})
+				b.StopTimer()
+				if stop != nil {
+					b.ReportMetric(float64(stop())/b.Elapsed().Seconds(), "writes/s")
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkListTransactions searches every transaction by description while
+// the file is saved over and over.
+func BenchmarkListTransactions(b *testing.B) {
+	d, uids := benchmarkDriver(b, 10000)
+	stop := writeContinuously(d, uids)
+	filter := application.TransactionFilter{Description: "not registered"}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := d.ListTransactions(context.Background(), filter); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+	b.StopTimer()
+	b.ReportMetric(float64(stop())/b.Elapsed().Seconds(), "writes/s")
+}
@@ -0,0 +1,233 @@
+package persistance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+	"wex/src/application"
+	"wex/src/auth"
+)
+
+// Tenants gives the storage of each tenant. The driver of a tenant only
+// sees the transactions and conversions registered through it.
+type Tenants interface {
+	// Tenant fails with ErrUnknownTenant for tenants neither configured nor
+	// stored, and with ErrTooManyTenants once too many are loaded
+	Tenant(name string) (PersistanceDriver, error)
+	// Names lists the tenants configured or with stored data
+	Names() []string
+	Settings(tenant string) (application.TenantSettings, error)
+	SaveSettings(tenant string, settings application.TenantSettings) error
+}
+
+// TenantStore keeps every tenant in its own files. The default tenant uses
+// the storage file itself, so that data stored before tenants were
+// introduced stays where it was; any other one gets a directory under
+// tenants/, e.g. ../storage/tenants/acme/localdb.json.
+type TenantStore struct {
+	storageFile string
+	// ObserveFlush is told how long each write of a storage file took, it
+	// has to be set before the store is used
+	ObserveFlush func(file string, took time.Duration)
+	// Writes tells how registrations are persisted, it has to be set before
+	// the store is used
+	Writes WriteOptions
+	// Configured are served before anything is stored for them, other
+	// tenants only once they have a directory under tenants/; it has to be
+	// set before the store is used
+	Configured []string
+	// MaxOpen is the number of tenants loaded at once beyond which new ones
+	// are refused, DefaultMaxTenants when 0
+	MaxOpen int
+
+	mu      sync.Mutex
+	drivers map[string]*Driver
+}
+
+const DefaultMaxTenants = 100
+
+var (
+	ErrUnknownTenant  = errors.New("Unknown tenant")
+	ErrTooManyTenants = errors.New("Too many tenants loaded")
+)
+
+func OpenTenantStore(storageFile string) *TenantStore {
+	return &TenantStore{storageFile: storageFile, drivers: make(map[string]*Driver)}
+}
+
+func (s *TenantStore) tenantsDir() string {
+	return filepath.Join(filepath.Dir(s.storageFile), "tenants")
+}
+
+// tenantFile returns the file the transactions of a tenant are stored in.
+// Tenant names are validated by auth.NewTenant, they cannot leave the
+// tenants directory.
+func (s *TenantStore) tenantFile(tenant string) string {
+	if tenant == auth.DefaultTenant {
+		return s.storageFile
+	}
+	return filepath.Join(s.tenantsDir(), tenant, filepath.Base(s.storageFile))
+}
+
+// known tells whether a tenant is configured or has stored data, so that
+// the names requests come with do not create storage.
+func (s *TenantStore) known(tenant string) bool {
+	if tenant == auth.DefaultTenant || slices.Contains(s.Configured, tenant) {
+		return true
+	}
+	info, err := os.Stat(filepath.Dir(s.tenantFile(tenant)))
+	return err == nil && info.IsDir()
+}
+
+// Tenant returns the driver of a tenant, loading its files the first time.
+func (s *TenantStore) Tenant(name string) (PersistanceDriver, error) {
+	return s.driver(name)
+}
+
+func (s *TenantStore) driver(name string) (*Driver, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d, ok := s.drivers[name]; ok {
+		return d, nil
+	}
+	if !s.known(name) {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownTenant, name)
+	}
+	maxOpen := s.MaxOpen
+	if maxOpen <= 0 {
+		maxOpen = DefaultMaxTenants
+	}
+	// the default tenant is always served, it is loaded first by the checks
+	if name != auth.DefaultTenant && len(s.drivers) >= maxOpen {
+		return nil, fmt.Errorf("%w: %v", ErrTooManyTenants, maxOpen)
+	}
+	d := openDriver(s.tenantFile(name), s.Writes)
+	d.observeFlush = s.ObserveFlush
+	s.drivers[name] = d
+	return d, nil
+}
+
+// Create makes a tenant known, so that it is served before anything is
+// stored for it.
+func (s *TenantStore) Create(tenant string) error {
+	return os.MkdirAll(filepath.Dir(s.tenantFile(tenant)), 0755)
+}
+
+// Close saves the writes of every tenant loaded and stops their persist
+// goroutines.
+func (s *TenantStore) Close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for name, d := range s.drivers {
+		errs = append(errs, d.Close(ctx))
+		delete(s.drivers, name)
+	}
+	return errors.Join(errs...)
+}
+
+// QueueDepth returns the number of writes waiting to be persisted, over
+// every tenant loaded.
+func (s *TenantStore) QueueDepth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	depth := 0
+	for _, d := range s.drivers {
+		depth += d.QueueDepth()
+	}
+	return depth
+}
+
+// loaded returns the drivers of the tenants loaded so far.
+func (s *TenantStore) loaded() []*Driver {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	drivers := make([]*Driver, 0, len(s.drivers))
+	for _, d := range s.drivers {
+		drivers = append(drivers, d)
+	}
+	return drivers
+}
+
+// CheckStorage tells whether the files of every tenant loaded were read and
+// can be written. The default tenant is loaded first, so that its storage
+// is checked before any request needs it.
+func (s *TenantStore) CheckStorage() error {
+	s.driver(auth.DefaultTenant)
+	var errs []error
+	for _, d := range s.loaded() {
+		errs = append(errs, d.CheckStorage())
+	}
+	return errors.Join(errs...)
+}
+
+// Ping tells whether the persist goroutine of every tenant loaded is
+// running.
+func (s *TenantStore) Ping(ctx context.Context) error {
+	s.driver(auth.DefaultTenant)
+	var errs []error
+	for _, d := range s.loaded() {
+		errs = append(errs, d.Ping(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *TenantStore) Names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := map[string]bool{auth.DefaultTenant: true}
+	for _, name := range s.Configured {
+		seen[name] = true
+	}
+	for name := range s.drivers {
+		seen[name] = true
+	}
+	entries, _ := os.ReadDir(s.tenantsDir())
+	for _, entry := range entries {
+		if entry.IsDir() {
+			seen[entry.Name()] = true
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// settingsFileName returns the file keeping the settings of the tenant
+// stored in tenantFile, e.g. localdb_settings.json.
+func settingsFileName(tenantFile string) string {
+	return siblingFileName(tenantFile, "settings")
+}
+
+// Settings returns the settings of a tenant, empty when none were saved.
+func (s *TenantStore) Settings(tenant string) (application.TenantSettings, error) {
+	var settings application.TenantSettings
+	err := loadFile(settingsFileName(s.tenantFile(tenant)), &settings)
+	if errors.Is(err, os.ErrNotExist) {
+		return settings, nil
+	}
+	return settings, err
+}
+
+// SaveSettings replaces the settings of a tenant.
+func (s *TenantStore) SaveSettings(tenant string, settings application.TenantSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return writeFileAtomic(settingsFileName(s.tenantFile(tenant)), settings, 0644)
+}
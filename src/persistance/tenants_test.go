@@ -0,0 +1,160 @@
+package persistance
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"wex/src/application"
+	"wex/src/auth"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "db.json")
+	store := OpenTenantStore(storage)
+	store.Configured = []string{"acme"}
+
+	acme, _ := store.driver("acme")
+	tran := application.GetSampleIdentifiedTransaction()
+	tran.Uid = pseudo_uuid()
+	registerTransaction(t, acme, tran)
+	acme.persistToFile()
+
+	if again, _ := store.driver("acme"); again != acme {
+		t.Error("Tenant driver started twice")
+	}
+	other, _ := store.driver(auth.DefaultTenant)
+	if _, err := other.QueryTransaction(context.Background(), tran.Uid); err != QueryNotFoundError {
+		t.Errorf("Transaction visible from another tenant: %v", err)
+	}
+	if list, _ := other.ListTransactions(context.Background(), application.TransactionFilter{}); len(list) != 0 {
+		t.Errorf("Transactions listed from another tenant: %v", list)
+	}
+	if err := other.DeleteTransaction(context.Background(), tran.Uid); err != QueryNotFoundError {
+		t.Errorf("Transaction deleted from another tenant: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(storage), "tenants", "acme", "db.json")); err != nil {
+		t.Errorf("Tenant file not written: %v", err)
+	}
+	// tenants with stored data are served without being configured
+	reloaded := OpenTenantStore(storage)
+	if acme, err := reloaded.driver("acme"); err != nil {
+		t.Errorf("Stored tenant refused: %v", err)
+	} else if _, err := acme.QueryTransaction(context.Background(), tran.Uid); err != nil {
+		t.Errorf("Tenant transaction not persisted: %v", err)
+	}
+	if names := reloaded.Names(); !reflect.DeepEqual(names, []string{"acme", auth.DefaultTenant}) {
+		t.Errorf("Unexpected tenants %v", names)
+	}
+}
+
+func TestTenantQueue(t *testing.T) {
+	store := OpenTenantStore(filepath.Join(t.TempDir(), "db.json"))
+	var flushed []string
+	store.ObserveFlush = func(file string, took time.Duration) {
+		flushed = append(flushed, file)
+	}
+
+	store.Configured = []string{"acme"}
+	acme, _ := store.driver("acme")
+	acme.persistToFile()
+	acme.persistConversions()
+	if !reflect.DeepEqual(flushed, []string{TransactionsFile, ConversionsFile}) {
+		t.Errorf("Unexpected flushes %v", flushed)
+	}
+
+	// a driver without persist goroutine keeps its writes queued
+	idle := &Driver{
+		registrations:    make(chan registration, 1),
+		transDirty:       make(chan struct{}, 1),
+		conversionsDirty: make(chan struct{}, 1),
+	}
+	store.drivers["idle"] = idle
+	signal(idle.transDirty)
+	signal(idle.transDirty)
+	signal(idle.conversionsDirty)
+	idle.registrations <- registration{}
+	if depth := store.QueueDepth(); depth != 3 {
+		t.Errorf("Unexpected queue depth %v", depth)
+	}
+}
+
+func TestTenantUnknown(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "db.json")
+	store := OpenTenantStore(storage)
+	store.MaxOpen = 2
+
+	if _, err := store.Tenant("ghost"); !errors.Is(err, ErrUnknownTenant) {
+		t.Errorf("Expected ErrUnknownTenant, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(storage), "tenants", "ghost")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Storage created for an unknown tenant: %v", err)
+	}
+
+	for _, name := range []string{"acme", "globex"} {
+		if err := store.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Tenant("acme"); err != nil {
+		t.Errorf("Created tenant refused: %v", err)
+	}
+	if _, err := store.Tenant(auth.DefaultTenant); err != nil {
+		t.Errorf("Default tenant refused: %v", err)
+	}
+	if _, err := store.Tenant("globex"); !errors.Is(err, ErrTooManyTenants) {
+		t.Errorf("Expected ErrTooManyTenants, got %v", err)
+	}
+	if names := store.Names(); !reflect.DeepEqual(names, []string{"acme", auth.DefaultTenant, "globex"}) {
+		t.Errorf("Unexpected tenants %v", names)
+	}
+}
+
+func TestTenantClose(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "db.json")
+	store := OpenTenantStore(storage)
+
+	driver, _ := store.driver(auth.DefaultTenant)
+	uid, err := driver.RegisterTransaction(context.Background(), application.GetSampleTransaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := store.Close(ctx); err != nil {
+		t.Fatalf("Could not close the tenants: %v", err)
+	}
+	pingCtx, cancelPing := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelPing()
+	if err := driver.Ping(pingCtx); !errors.Is(err, ErrPersistStalled) {
+		t.Errorf("Persist goroutine still running: %v", err)
+	}
+	reloaded := startDriver(storage)
+	if _, err := reloaded.QueryTransaction(context.Background(), uid); err != nil {
+		t.Errorf("Transaction not saved on close: %v", err)
+	}
+}
+
+func TestTenantSettings(t *testing.T) {
+	store := OpenTenantStore(filepath.Join(t.TempDir(), "db.json"))
+
+	if settings, err := store.Settings("acme"); err != nil || settings != (application.TenantSettings{}) {
+		t.Errorf("Unexpected settings %+v (%v)", settings, err)
+	}
+
+	saved := application.TenantSettings{Currency: "Euro Zone-Euro", RatePolicy: application.AverageRate, RateWindow: 12}
+	if err := store.SaveSettings("acme", saved); err != nil {
+		t.Fatalf("Could not save settings: %v", err)
+	}
+	if settings, err := store.Settings("acme"); err != nil || settings != saved {
+		t.Errorf("Settings %+v (%v) differ from saved %+v", settings, err, saved)
+	}
+	if settings, _ := store.Settings(auth.DefaultTenant); settings != (application.TenantSettings{}) {
+		t.Errorf("Settings shared between tenants: %+v", settings)
+	}
+}
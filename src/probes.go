@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"wex/src/external"
+	"wex/src/health"
+	"wex/src/persistance"
+)
+
+// names of the readiness checks, as given to -ready-checks
+const (
+	storageCheck = "storage"
+	persistCheck = "persist"
+	ratesCheck   = "rates"
+)
+
+// how long the answer of the Treasury api is trusted by readiness probes
+const upstreamCheckTTL = 30 * time.Second
+
+// readinessChecks checks that the storage was read and can be written, that
+// the persist goroutines take writes and that conversions can be answered:
+// from the rate cache when it is warm, from the Treasury api otherwise.
+// Only the checks listed in required decide whether the server is ready.
+func readinessChecks(tenants *persistance.TenantStore, upstream external.FiscalDataMiddleware,
+	cache *external.RateCache, required string, timeout time.Duration) (*health.Checker, error) {
+
+	checker := health.NewChecker()
+	checker.Timeout = timeout
+	checker.Add(storageCheck, func(ctx context.Context) (string, error) {
+		return "storage files read and writable", tenants.CheckStorage()
+	})
+	checker.Add(persistCheck, func(ctx context.Context) (string, error) {
+		return "persist goroutines running", tenants.Ping(ctx)
+	})
+	reachable := health.Cached(func(ctx context.Context) (string, error) {
+		return "Treasury api reachable", upstream.Ping(ctx)
+	}, upstreamCheckTTL)
+	checker.Add(ratesCheck, func(ctx context.Context) (string, error) {
+		if cache.Warm() {
+			return "rate cache warm", nil
+		}
+		message, err := reachable(ctx)
+		if err != nil {
+			return "", fmt.Errorf("rate cache cold and Treasury api unreachable: %w", err)
+		}
+		return message, nil
+	})
+
+	var names []string
+	for _, name := range strings.Split(required, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return checker, checker.Require(names...)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+	"wex/src/application"
+	"wex/src/external"
+	"wex/src/persistance"
+)
+
+func TestReadinessChecks(t *testing.T) {
+	tenants := persistance.OpenTenantStore(filepath.Join(t.TempDir(), "db.json"))
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	unreachable := external.FiscalDataMiddleware{ExternalApi: server.URL}
+	cache := external.NewRateCache(MockExternalApi{})
+
+	if _, err := readinessChecks(tenants, unreachable, cache, "storage,disk", time.Second); err == nil {
+		t.Error("No error received for unknown check")
+	}
+
+	checker, err := readinessChecks(tenants, unreachable, cache, " storage, persist ,rates", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := checker.Run(context.Background())
+	if report.Ready() {
+		t.Errorf("Ready with a cold cache and an unreachable api: %+v", report)
+	}
+	for _, name := range []string{storageCheck, persistCheck} {
+		if result := report.Checks[name]; result.Status != "ok" || !result.Required {
+			t.Errorf("Unexpected %v result %+v", name, result)
+		}
+	}
+
+	date := application.Time{Time: time.Date(2023, 6, 30, 0, 0, 0, 0, time.UTC)}
+	cache.QueryRates(context.Background(), []string{"Mexico-Peso"}, date, date)
+	if report = checker.Run(context.Background()); !report.Ready() {
+		t.Errorf("Not ready with a warm cache: %+v", report)
+	}
+
+	checker, _ = readinessChecks(tenants, unreachable, external.NewRateCache(MockExternalApi{}), "storage,persist", time.Second)
+	if report = checker.Run(context.Background()); !report.Ready() || report.Checks[ratesCheck].Required {
+		t.Errorf("Optional rates check gated readiness: %+v", report)
+	}
+}
@@ -0,0 +1,120 @@
+// Package ratelimit implements a token bucket limiter.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Bucket holds up to Burst tokens and refills Rate tokens per second. Each
+// request takes one token.
+type Bucket struct {
+	Rate  float64
+	Burst int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewBucket returns a full bucket.
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{Rate: rate, Burst: burst, tokens: float64(burst), now: time.Now}
+}
+
+// refill must be called holding b.mu.
+func (b *Bucket) refill() time.Time {
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.Rate
+		if b.tokens > float64(b.Burst) {
+			b.tokens = float64(b.Burst)
+		}
+	}
+	b.last = now
+	return now
+}
+
+// Reserve takes a token and returns how long the caller has to wait before
+// using it. Tokens are handed out in the order they are reserved.
+func (b *Bucket) Reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	b.tokens--
+	if b.tokens >= 0 || b.Rate <= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.Rate * float64(time.Second))
+}
+
+// Wait blocks until a token is available and takes it. When ctx is done
+// first the token is given back, without filling the bucket over Burst, and
+// the error of ctx returned.
+func (b *Bucket) Wait(ctx context.Context) error {
+	delay := b.Reserve()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens = min(b.tokens+1, float64(b.Burst))
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Result tells whether a request was let through and the state of the
+// bucket afterwards.
+type Result struct {
+	Allowed bool
+	// tokens left
+	Remaining int
+	// time until a token is available, when the request was refused
+	RetryAfter time.Duration
+	// time until the bucket is full again
+	Reset time.Duration
+}
+
+// Take takes a token if one is available right now.
+func (b *Bucket) Take() Result {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	result := Result{Allowed: b.tokens >= 1}
+	if result.Allowed {
+		b.tokens--
+	} else if b.Rate > 0 {
+		result.RetryAfter = time.Duration((1 - b.tokens) / b.Rate * float64(time.Second))
+	}
+	result.Remaining = int(max(b.tokens, 0))
+	if b.Rate > 0 {
+		result.Reset = time.Duration((float64(b.Burst) - b.tokens) / b.Rate * float64(time.Second))
+	}
+	return result
+}
+
+// Allow takes a token if one is available right now.
+func (b *Bucket) Allow() bool {
+	return b.Take().Allowed
+}
+
+// full reports whether the bucket would be full at now, dropping it loses
+// nothing then.
+func (b *Bucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.Rate >= float64(b.Burst)
+}
@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestBucket(rate float64, burst int) (*Bucket, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := NewBucket(rate, burst)
+	b.now = clock.Now
+	return b, clock
+}
+
+func TestAllow(t *testing.T) {
+	b, clock := newTestBucket(2, 3)
+
+	for i := 0; i < 3; i++ {
+		if !b.Allow() {
+			t.Fatalf("request %v within burst was refused", i)
+		}
+	}
+	if b.Allow() {
+		t.Error("request over burst was allowed")
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if !b.Allow() {
+		t.Error("refilled token was refused")
+	}
+	if b.Allow() {
+		t.Error("request over refill was allowed")
+	}
+
+	// the bucket never holds more than burst tokens
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		b.Allow()
+	}
+	if b.Allow() {
+		t.Error("bucket refilled over burst")
+	}
+}
+
+func TestReserve(t *testing.T) {
+	b, clock := newTestBucket(4, 2)
+
+	tests := []struct {
+		name     string
+		expected time.Duration
+	}{
+		{"first token of burst", 0},
+		{"second token of burst", 0},
+		{"first wait", 250 * time.Millisecond},
+		{"queued behind first wait", 500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if delay := b.Reserve(); delay != test.expected {
+				t.Errorf("got delay %v but expected %v", delay, test.expected)
+			}
+		})
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if delay := b.Reserve(); delay != 250*time.Millisecond {
+		t.Errorf("got delay %v after refill but expected %v", delay, 250*time.Millisecond)
+	}
+}
+
+func TestWait(t *testing.T) {
+	b := NewBucket(100, 1)
+	start := time.Now()
+	b.Wait(context.Background())
+	b.Wait(context.Background())
+	if elapsed := time.Since(start); elapsed < 5*time.Millisecond {
+		t.Errorf("second request was not delayed, took %v", elapsed)
+	}
+}
+
+func TestWaitCancelled(t *testing.T) {
+	b, _ := newTestBucket(1, 1)
+	b.Allow()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.Wait(ctx); err != context.Canceled {
+		t.Errorf("Expected the wait to be cancelled, got %v", err)
+	}
+	if delay := b.Reserve(); delay != time.Second {
+		t.Errorf("Token of the cancelled wait not given back, next one in %v", delay)
+	}
+}
+
+func TestWaitCancelledAfterRefill(t *testing.T) {
+	b, clock := newTestBucket(1, 1)
+	b.Allow()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waited := make(chan error)
+	go func() {
+		waited <- b.Wait(ctx)
+	}()
+	for reserved := false; !reserved; {
+		b.mu.Lock()
+		reserved = b.tokens < 0
+		b.mu.Unlock()
+	}
+	// the bucket fills up again while the wait goes on
+	clock.Advance(10 * time.Second)
+	b.mu.Lock()
+	b.refill()
+	b.mu.Unlock()
+
+	cancel()
+	if err := <-waited; err != context.Canceled {
+		t.Errorf("Expected the wait to be cancelled, got %v", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens != float64(b.Burst) {
+		t.Errorf("Token given back over the burst, %v tokens held", b.tokens)
+	}
+}
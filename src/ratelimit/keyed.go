@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is the rate and burst of a bucket.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l Limit) Disabled() bool {
+	return l.Rate <= 0
+}
+
+// minimum number of buckets kept before idle ones are dropped
+const minSweep = 1024
+
+// Keyed limits every key, e.g. a client, with a bucket of its own.
+type Keyed struct {
+	Limit Limit
+
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+	// size of the map that triggers the next sweep of idle buckets
+	sweepAt int
+	now     func() time.Time
+}
+
+func NewKeyed(limit Limit) *Keyed {
+	return &Keyed{Limit: limit, buckets: make(map[string]*Bucket), sweepAt: minSweep, now: time.Now}
+}
+
+// Take takes a token from the bucket of key.
+func (k *Keyed) Take(key string) Result {
+	k.mu.Lock()
+	b, ok := k.buckets[key]
+	if !ok {
+		if len(k.buckets) >= k.sweepAt {
+			k.sweep()
+		}
+		b = NewBucket(k.Limit.Rate, k.Limit.Burst)
+		b.now = k.now
+		k.buckets[key] = b
+	}
+	k.mu.Unlock()
+	return b.Take()
+}
+
+// sweep drops the buckets that refilled completely, a new one is just as
+// full. Must be called holding k.mu.
+func (k *Keyed) sweep() {
+	now := k.now()
+	for key, b := range k.buckets {
+		if b.full(now) {
+			delete(k.buckets, key)
+		}
+	}
+	k.sweepAt = max(minSweep, 2*len(k.buckets))
+}
+
+var ErrLimits = errors.New("Invalid rate limits")
+
+// ParseLimit parses a limit written rate:burst, e.g. 0.5:2.
+func ParseLimit(limit string) (Limit, error) {
+	rate, burst, ok := strings.Cut(strings.TrimSpace(limit), ":")
+	parsed := Limit{}
+	var err error
+	if parsed.Rate, err = strconv.ParseFloat(rate, 64); !ok || err != nil || parsed.Rate < 0 {
+		return parsed, fmt.Errorf("%w: %q should be rate:burst", ErrLimits, limit)
+	}
+	if parsed.Burst, err = strconv.Atoi(burst); err != nil || parsed.Burst < 1 {
+		return parsed, fmt.Errorf("%w: burst of %q should be at least 1", ErrLimits, limit)
+	}
+	return parsed, nil
+}
+
+// ParseRouteLimits parses a comma separated list of route=rate:burst, e.g.
+// /convertTransaction=2:10,/bulkConvert=0.1:2.
+func ParseRouteLimits(limits string) (map[string]Limit, error) {
+	parsed := make(map[string]Limit)
+	if strings.TrimSpace(limits) == "" {
+		return parsed, nil
+	}
+	for _, entry := range strings.Split(limits, ",") {
+		route, limit, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || !strings.HasPrefix(route, "/") {
+			return nil, fmt.Errorf("%w: %q should be route=rate:burst", ErrLimits, entry)
+		}
+		l, err := ParseLimit(limit)
+		if err != nil {
+			return nil, err
+		}
+		parsed[route] = l
+	}
+	return parsed, nil
+}
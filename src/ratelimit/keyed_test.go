@@ -0,0 +1,77 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTake(t *testing.T) {
+	b, clock := newTestBucket(2, 3)
+
+	tests := []struct {
+		allowed   bool
+		remaining int
+		retry     time.Duration
+		reset     time.Duration
+	}{
+		{true, 2, 0, 500 * time.Millisecond},
+		{true, 1, 0, time.Second},
+		{true, 0, 0, 1500 * time.Millisecond},
+		{false, 0, 500 * time.Millisecond, 1500 * time.Millisecond},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			result := b.Take()
+			if result.Allowed != test.allowed || result.Remaining != test.remaining ||
+				result.RetryAfter != test.retry || result.Reset != test.reset {
+				t.Errorf("got %+v but expected %+v", result, test)
+			}
+		})
+	}
+
+	clock.Advance(250 * time.Millisecond)
+	if result := b.Take(); result.Allowed || result.RetryAfter != 250*time.Millisecond {
+		t.Errorf("unexpected result after partial refill %+v", result)
+	}
+}
+
+func TestKeyed(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	k := NewKeyed(Limit{Rate: 1, Burst: 1})
+	k.now = clock.Now
+
+	if !k.Take("a").Allowed || k.Take("a").Allowed {
+		t.Error("bucket of a not limited to its burst")
+	}
+	if !k.Take("b").Allowed {
+		t.Error("bucket shared between keys")
+	}
+
+	// idle buckets are dropped once enough keys were seen
+	for i := len(k.buckets); i < minSweep; i++ {
+		k.Take(fmt.Sprint("client", i))
+	}
+	clock.Advance(time.Second)
+	k.Take("new")
+	if len(k.buckets) != 1 {
+		t.Errorf("idle buckets kept: %v", len(k.buckets))
+	}
+}
+
+func TestParseRouteLimits(t *testing.T) {
+	limits, err := ParseRouteLimits(" /convertTransaction=2:10, /bulkConvert=0.1:2")
+	if err != nil || len(limits) != 2 || limits["/bulkConvert"] != (Limit{Rate: 0.1, Burst: 2}) {
+		t.Errorf("Unexpected limits %v (%v)", limits, err)
+	}
+	if limits, err := ParseRouteLimits(""); err != nil || len(limits) != 0 {
+		t.Errorf("Unexpected limits %v (%v)", limits, err)
+	}
+
+	for _, invalid := range []string{"/a", "a=1:1", "/a=1", "/a=x:1", "/a=1:0", "/a=-1:1", "/a=1:1,"} {
+		if _, err := ParseRouteLimits(invalid); !errors.Is(err, ErrLimits) {
+			t.Errorf("Error differs from expected for %q: received (%v); expected (%v)", invalid, err, ErrLimits)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	"wex/src/application"
+	"wex/src/external"
+	"wex/src/logging"
+)
+
+const (
+	// years of rates returned when no from date is given
+	defaultRateSeriesYears = 1
+	defaultRatePageSize    = 100
+	maxRatePageSize        = 1000
+)
+
+type rateSeriesMeta struct {
+	Page       int `json:"page"`
+	PageSize   int `json:"pageSize"`
+	TotalCount int `json:"totalCount"`
+	TotalPages int `json:"totalPages"`
+}
+
+type rateSeries struct {
+	Currency string                     `json:"currency"`
+	IsoCode  string                     `json:"isoCode,omitempty"`
+	From     application.Time           `json:"from"`
+	To       application.Time           `json:"to"`
+	Order    string                     `json:"order"`
+	Provider string                     `json:"provider"`
+	Rates    []application.ExchangeRate `json:"rates"`
+	Meta     rateSeriesMeta             `json:"meta"`
+}
+
+// positiveParam parses an optional positive integer query parameter.
+func positiveParam(r *http.Request, name string, fallback, max int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > max {
+		return 0, fmt.Errorf("%v should be between 1 and %v", name, max)
+	}
+	return n, nil
+}
+
+// rateSeriesRange reads the from and to dates, to defaulting to today and
+// from to a year before to. Ranges longer than maxYears are refused, the
+// whole range is read from the Treasury api before a page is answered.
+func rateSeriesRange(r *http.Request, maxYears int) (application.Time, application.Time, error) {
+	var from, to application.Time
+	var err error
+
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = application.NewTime(value); err != nil {
+			return from, to, err
+		}
+	} else {
+		now := time.Now().UTC()
+		to = application.Time{Time: time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)}
+	}
+
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = application.NewTime(value); err != nil {
+			return from, to, err
+		}
+	} else {
+		from = application.Time{Time: to.AddDate(-defaultRateSeriesYears, 0, 0)}
+	}
+
+	if from.After(to.Time) {
+		return from, to, fmt.Errorf("from date %v is after to date %v", from.ToString(), to.ToString())
+	}
+	if from.Before(to.AddDate(-maxYears, 0, 0)) {
+		return from, to, fmt.Errorf("from %v to %v spans more than %v years", from.ToString(), to.ToString(), maxYears)
+	}
+	return from, to, nil
+}
+
+func getRates(middleware external.FiscalDataInterface,
+	catalog external.CurrencyCatalogInterface, maxYears int) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			badRequest(w, r, "Unsupported method")
+			return
+		}
+
+		currency, err := resolveCurrency(r.Context(), catalog, "", r.URL.Query().Get("currency"))
+		if err != nil {
+			badRequest(w, r, err.Error())
+			return
+		}
+		from, to, err := rateSeriesRange(r, maxYears)
+		if err != nil {
+			badRequest(w, r, err.Error())
+			return
+		}
+		order := r.URL.Query().Get("order")
+		if order == "" {
+			order = "asc"
+		}
+		if order != "asc" && order != "desc" {
+			badRequest(w, r, "order should be asc or desc")
+			return
+		}
+		page, err := positiveParam(r, "page", 1, math.MaxInt32)
+		if err != nil {
+			badRequest(w, r, err.Error())
+			return
+		}
+		pageSize, err := positiveParam(r, "pageSize", defaultRatePageSize, maxRatePageSize)
+		if err != nil {
+			badRequest(w, r, err.Error())
+			return
+		}
+
+		rates, err := middleware.QueryRates(r.Context(), []string{currency.CountryCurrency}, from, to)
+		if err != nil {
+			logging.FromContext(r.Context()).Warn("Could not query rates",
+				"currencies", []string{currency.CountryCurrency}, "error", err)
+			badRequest(w, r, "error getting conversion rates")
+			return
+		}
+
+		sort.SliceStable(rates, func(i, j int) bool {
+			if order == "desc" {
+				return rates[i].RecordDate.After(rates[j].RecordDate.Time)
+			}
+			return rates[i].RecordDate.Before(rates[j].RecordDate.Time)
+		})
+
+		start := min((page-1)*pageSize, len(rates))
+		end := min(start+pageSize, len(rates))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rateSeries{
+			Currency: currency.CountryCurrency,
+			IsoCode:  currency.IsoCode,
+			From:     from,
+			To:       to,
+			Order:    order,
+			Provider: external.TreasuryProvider,
+			Rates:    append([]application.ExchangeRate{}, rates[start:end]...),
+			Meta: rateSeriesMeta{
+				Page:       page,
+				PageSize:   pageSize,
+				TotalCount: len(rates),
+				TotalPages: (len(rates) + pageSize - 1) / pageSize,
+			},
+		})
+	}
+}
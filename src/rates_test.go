@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"wex/src/external"
+	"wex/src/external/fiscaltest"
+)
+
+func TestRatesHandle(t *testing.T) {
+	server := fiscaltest.NewServer(fiscaltest.NewHandler(fiscaltest.DefaultFixture()))
+	defer server.Close()
+	handler := getRates(external.FiscalDataMiddleware{ExternalApi: server.URL}, MockCatalog{}, 10)
+
+	tests := []struct {
+		name       string
+		query      string
+		count      int
+		totalCount int
+		first      string
+	}{
+		{"whole series", "currency=MXN&from=2020-01-01&to=2023-12-31", 16, 16, "2020-03-31"},
+		{"descending", "currency=MXN&from=2020-01-01&to=2023-12-31&order=desc", 16, 16, "2023-12-31"},
+		{"second page", "currency=mexico&from=2020-01-01&to=2023-12-31&pageSize=5&page=2", 5, 16, "2021-06-30"},
+		{"past last page", "currency=MXN&from=2020-01-01&to=2023-12-31&pageSize=5&page=5", 0, 16, ""},
+		{"single year", "currency=Euro Zone-Euro&from=2022-01-01&to=2022-12-31", 4, 4, "2022-03-31"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/rates", nil)
+			req.URL.RawQuery = test.query
+			req.URL.RawQuery = req.URL.Query().Encode()
+			res := httptest.NewRecorder()
+			handler(res, req)
+
+			if res.Code != http.StatusOK {
+				t.Fatalf("got status %d but expected %d", res.Code, http.StatusOK)
+			}
+			var series rateSeries
+			if err := json.NewDecoder(res.Body).Decode(&series); err != nil {
+				t.Fatalf("Could not parse json response: %v", err)
+			}
+			if len(series.Rates) != test.count || series.Meta.TotalCount != test.totalCount {
+				t.Errorf("got %v of %v rates but expected %v of %v",
+					len(series.Rates), series.Meta.TotalCount, test.count, test.totalCount)
+			}
+			if test.count > 0 && series.Rates[0].RecordDate.ToString() != test.first {
+				t.Errorf("got first rate %v but expected %v", series.Rates[0].RecordDate.ToString(), test.first)
+			}
+		})
+	}
+}
+
+func TestRatesBadRequest(t *testing.T) {
+	handler := getRates(MockExternalApi{}, MockCatalog{}, 10)
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"missing currency", "from=2020-01-01"},
+		{"unknown currency", "currency=atlantis"},
+		{"invalid date", "currency=MXN&from=yesterday"},
+		{"reversed range", "currency=MXN&from=2023-01-01&to=2022-01-01"},
+		{"range too long", "currency=MXN&from=2000-01-01&to=2022-01-01"},
+		{"invalid order", "currency=MXN&order=up"},
+		{"invalid page", "currency=MXN&page=0"},
+		{"page size too large", "currency=MXN&pageSize=5000"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/rates?"+test.query, nil)
+			res := httptest.NewRecorder()
+			handler(res, req)
+			if res.Code != http.StatusBadRequest {
+				t.Errorf("got status %d but expected %d", res.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// Package response records what handlers answer, for the middlewares that
+// log, measure and trace the requests they serve.
+package response
+
+import "net/http"
+
+// Recorder keeps the status and the size of a response. It forwards
+// flushes, so that streamed responses, e.g. bulk conversions, get through
+// every middleware recording them.
+type Recorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func NewRecorder(w http.ResponseWriter) *Recorder {
+	return &Recorder{ResponseWriter: w}
+}
+
+// Status returns the status answered, 200 when the handler wrote nothing.
+func (r *Recorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// Bytes returns the size of the body written.
+func (r *Recorder) Bytes() int {
+	return r.bytes
+}
+
+func (r *Recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *Recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func (r *Recorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		if r.status == 0 {
+			r.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+func (r *Recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
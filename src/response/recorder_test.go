@@ -0,0 +1,53 @@
+package response
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	tests := []struct {
+		name   string
+		handle func(w http.ResponseWriter)
+		status int
+		bytes  int
+	}{
+		{"nothing written", func(w http.ResponseWriter) {}, http.StatusOK, 0},
+		{"body only", func(w http.ResponseWriter) { w.Write([]byte("ok")) }, http.StatusOK, 2},
+		{"first status kept", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusAccepted)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("queued"))
+		}, http.StatusAccepted, 6},
+		{"flushed", func(w http.ResponseWriter) { w.(http.Flusher).Flush() }, http.StatusOK, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := NewRecorder(httptest.NewRecorder())
+			test.handle(recorder)
+			if recorder.Status() != test.status || recorder.Bytes() != test.bytes {
+				t.Errorf("recorded %d and %d bytes but expected %d and %d bytes",
+					recorder.Status(), recorder.Bytes(), test.status, test.bytes)
+			}
+		})
+	}
+}
+
+func TestRecorderFlush(t *testing.T) {
+	res := httptest.NewRecorder()
+	// each middleware records the response written through the next ones
+	var w http.ResponseWriter = res
+	for i := 0; i < 3; i++ {
+		w = NewRecorder(w)
+	}
+	w.Write([]byte("{}\n"))
+	w.(http.Flusher).Flush()
+	if !res.Flushed || res.Body.String() != "{}\n" {
+		t.Error("flush not forwarded through the recorders")
+	}
+	if controller := http.NewResponseController(w); controller.Flush() != nil {
+		t.Error("recorders cannot be unwrapped")
+	}
+}
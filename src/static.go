@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"wex/ui"
+)
+
+// uiAssets returns the embedded UI, or the files of dir when one is given so
+// that the UI can be edited without rebuilding.
+func uiAssets(dir string) fs.FS {
+	if dir == "" {
+		return ui.FS()
+	}
+	return os.DirFS(dir)
+}
+
+// getRoot sends browsers to the transaction list.
+func getRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		http.Redirect(w, r, "/transactions", http.StatusFound)
+	default:
+		badRequest(w, r, "Unsupported Method")
+	}
+}
+
+// getStatic serves the static UI assets under /static/. Responses carry an
+// ETag derived from the content and must be revalidated, so that browsers
+// pick up a new UI as soon as it is deployed without downloading it again
+// otherwise.
+func getStatic(assets fs.FS) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			badRequest(w, r, "Unsupported Method")
+			return
+		}
+
+		name, ok := strings.CutPrefix(path.Clean(r.URL.Path), "/static/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		content, err := fs.ReadFile(assets, "static/"+name)
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not read UI asset", http.StatusInternalServerError)
+			return
+		}
+
+		sum := sha256.Sum256(content)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(content))
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestStaticHandle(t *testing.T) {
+	assets := fstest.MapFS{
+		"static/style.css":      {Data: []byte("body {}")},
+		"templates/layout.html": {Data: []byte("{{define \"layout\"}}{{end}}")},
+	}
+	handler := getStatic(assets)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{"asset", http.MethodGet, "/static/style.css", http.StatusOK, "body {}"},
+		{"head", http.MethodHead, "/static/style.css", http.StatusOK, ""},
+		{"missing asset", http.MethodGet, "/static/missing.js", http.StatusNotFound, ""},
+		{"template", http.MethodGet, "/static/../templates/layout.html", http.StatusNotFound, ""},
+		{"outside assets", http.MethodGet, "/static/../../main.go", http.StatusNotFound, ""},
+		{"unsupported method", http.MethodPost, "/static/style.css", http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "/", nil)
+			req.URL.Path = test.path
+			res := httptest.NewRecorder()
+			handler(res, req)
+
+			if res.Code != test.status {
+				t.Fatalf("got status %d but expected %d", res.Code, test.status)
+			}
+			if test.body != "" && res.Body.String() != test.body {
+				t.Errorf("got body %q but expected %q", res.Body.String(), test.body)
+			}
+			if test.status == http.StatusOK &&
+				(res.Header().Get("ETag") == "" || res.Header().Get("Cache-Control") != "no-cache") {
+				t.Errorf("missing caching headers %v", res.Header())
+			}
+		})
+	}
+}
+
+func TestStaticRevalidation(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "static"), 0755)
+	style := filepath.Join(dir, "static", "style.css")
+	os.WriteFile(style, []byte("body { color: red }"), 0644)
+	handler := getStatic(uiAssets(dir))
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/static/style.css", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		res := httptest.NewRecorder()
+		handler(res, req)
+		return res
+	}
+
+	etag := get("").Header().Get("ETag")
+	if res := get(etag); res.Code != http.StatusNotModified {
+		t.Errorf("got status %d but expected %d", res.Code, http.StatusNotModified)
+	}
+
+	// edits on disk are served right away
+	os.WriteFile(style, []byte("body { color: blue }"), 0644)
+	res := get(etag)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "blue") {
+		t.Errorf("edited UI not served, got %d %q", res.Code, res.Body.String())
+	}
+}
+
+func TestRootHandle(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	res := httptest.NewRecorder()
+	getRoot(res, req)
+	if res.Code != http.StatusFound || res.Header().Get("Location") != "/transactions" {
+		t.Errorf("got status %d to %v but expected redirect to /transactions", res.Code, res.Header().Get("Location"))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/missing", nil)
+	res = httptest.NewRecorder()
+	getRoot(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("got status %d but expected %d", res.Code, http.StatusNotFound)
+	}
+}
+
+func TestEmbeddedUI(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/static/style.css", nil)
+	res := httptest.NewRecorder()
+	getStatic(uiAssets(""))(res, req)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "font-family") {
+		t.Errorf("embedded assets not served, got %d %q", res.Code, res.Body.String())
+	}
+	if _, err := newWebTemplates(uiAssets(""), false); err != nil {
+		t.Errorf("embedded templates do not parse: %v", err)
+	}
+}
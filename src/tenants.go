@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"wex/src/application"
+	"wex/src/auth"
+	"wex/src/external"
+	"wex/src/logging"
+	"wex/src/persistance"
+)
+
+// tenantName returns the tenant a request is made for, chosen by the
+// authenticator from the API key and the X-Tenant header.
+func tenantName(r *http.Request) string {
+	if p, ok := auth.PrincipalFrom(r.Context()); ok && p.Tenant != "" && p.Tenant != auth.AnyTenant {
+		return p.Tenant
+	}
+	return auth.DefaultTenant
+}
+
+type tenantDriverKey struct{}
+
+// tenantStorage loads the storage of the tenant of a request for the
+// handlers after it, and refuses requests for tenants that are neither
+// configured nor stored so that their names do not create storage.
+func tenantStorage(tenants persistance.Tenants, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		driver, err := tenants.Tenant(tenantName(r))
+		if errors.Is(err, persistance.ErrUnknownTenant) {
+			writeError(w, http.StatusNotFound, err.Error())
+			logging.FromContext(r.Context()).Info("Unknown tenant", "tenant", tenantName(r))
+			return
+		}
+		if err != nil {
+			storageUnavailable(w, r, err)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), tenantDriverKey{}, driver)))
+	}
+}
+
+// tenantDriver returns the storage of the tenant of a request, handlers
+// never reach the transactions of another tenant. Handlers served without
+// tenantStorage, as in tests, load it themselves.
+func tenantDriver(tenants persistance.Tenants, r *http.Request) persistance.PersistanceDriver {
+	if driver, ok := r.Context().Value(tenantDriverKey{}).(persistance.PersistanceDriver); ok {
+		return driver
+	}
+	driver, _ := tenants.Tenant(tenantName(r))
+	return driver
+}
+
+// tenantSettings returns the settings of the tenant of a request along with
+// the rate selection it applies by default. Settings that cannot be read are
+// logged and the deployment defaults are used.
+func tenantSettings(tenants persistance.Tenants, r *http.Request,
+	defaults application.RateSelection) (application.TenantSettings, application.RateSelection) {
+
+	tenant := tenantName(r)
+	settings, err := tenants.Settings(tenant)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Could not read tenant settings", "tenant", tenant, "error", err)
+		return application.TenantSettings{}, defaults
+	}
+	return settings, settings.RateSelection(defaults)
+}
+
+type tenantSettingsResponse struct {
+	Tenant string `json:"tenant"`
+	application.TenantSettings
+	// rate selection applied when a conversion does not choose one
+	EffectivePolicy application.RatePolicy `json:"effectivePolicy"`
+	EffectiveWindow int                    `json:"effectiveWindow"`
+}
+
+// getAdminSettings reads and replaces the settings of the tenant the request
+// is made for.
+func getAdminSettings(tenants persistance.Tenants,
+	catalog external.CurrencyCatalogInterface,
+	defaults application.RateSelection) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant := tenantName(r)
+		switch r.Method {
+		case "GET":
+		case "PUT":
+			var settings application.TenantSettings
+			if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+				badRequest(w, r, "Could not parse request body")
+				return
+			}
+			if err := settings.Validate(); err != nil {
+				badRequest(w, r, err.Error())
+				return
+			}
+			if settings.Currency != "" {
+				currency, err := resolveCurrency(r.Context(), catalog, "", settings.Currency)
+				if err != nil {
+					badRequest(w, r, err.Error())
+					return
+				}
+				settings.Currency = currency.CountryCurrency
+			}
+			if err := tenants.SaveSettings(tenant, settings); err != nil {
+				logging.FromContext(r.Context()).Error("Could not save tenant settings", "tenant", tenant, "error", err)
+				badRequest(w, r, "error saving settings")
+				return
+			}
+			logging.FromContext(r.Context()).Info("Tenant settings saved", "tenant", tenant)
+		default:
+			badRequest(w, r, "Unsupported method")
+			return
+		}
+
+		settings, selection := tenantSettings(tenants, r, defaults)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tenantSettingsResponse{
+			Tenant:          tenant,
+			TenantSettings:  settings,
+			EffectivePolicy: selection.Policy,
+			EffectiveWindow: selection.WindowMonths,
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"wex/src/application"
+	"wex/src/auth"
+	"wex/src/persistance"
+)
+
+// asTenant makes the request on behalf of a key bound to tenant.
+func asTenant(req *http.Request, tenant string) *http.Request {
+	principal := testPrincipal
+	principal.Tenant = tenant
+	return req.WithContext(auth.WithPrincipal(req.Context(), principal))
+}
+
+func TestTenantIsolation(t *testing.T) {
+	tenants := oneTenant(newMemoryDriver())
+
+	form := url.Values{"description": {"Acme lunch"}, "date": {"2023-07-02"}, "amount": {"20.00"}}
+	req := httptest.NewRequest(http.MethodPost, "/registerTransaction", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := httptest.NewRecorder()
+	getRegisterTransaction(tenants, MockExternalApi{}, MockCatalog{}, testRateSelection)(res, asTenant(req, "acme"))
+	var registered map[string]string
+	json.NewDecoder(res.Body).Decode(&registered)
+	uid := registered["transactionId"]
+
+	tests := []struct {
+		tenant string
+		status int
+	}{
+		{"acme", http.StatusOK},
+		{"globex", http.StatusBadRequest},
+		{auth.DefaultTenant, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.tenant, func(t *testing.T) {
+			handlers := map[string]http.HandlerFunc{
+				"/queryTransaction":   getQueryTransactionHandler(tenants),
+				"/conversions":        getConversions(tenants),
+				"/convertTransaction": getConvertTransaction(tenants, MockExternalApi{}, MockCatalog{}, testRateSelection),
+			}
+			for path, handler := range handlers {
+				req := httptest.NewRequest(http.MethodGet, path+"?currency=Mexico-Peso&transactionId="+uid, nil)
+				res := httptest.NewRecorder()
+				handler(res, asTenant(req, test.tenant))
+				if res.Code != test.status {
+					t.Errorf("%v: got status %d but expected %d", path, res.Code, test.status)
+				}
+			}
+
+			res := getPage(getWebList(newTestWebUI(t), tenants), "/transactions")
+			if test.tenant != auth.DefaultTenant {
+				req := httptest.NewRequest(http.MethodGet, "/transactions", nil)
+				res = httptest.NewRecorder()
+				getWebList(newTestWebUI(t), tenants)(res, asTenant(req, test.tenant))
+			}
+			if listed := strings.Contains(res.Body.String(), "Acme lunch"); listed != (test.tenant == "acme") {
+				t.Errorf("transaction listed %v for tenant %v", listed, test.tenant)
+			}
+		})
+	}
+}
+
+func TestTenantSettings(t *testing.T) {
+	tenants := oneTenant(MockDriver{})
+	tenants.drivers["acme"] = MockDriver{}
+	tenants.drivers["globex"] = MockDriver{}
+	handler := getAdminSettings(tenants, MockCatalog{}, testRateSelection)
+
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/admin/settings", strings.NewReader(body))
+		res := httptest.NewRecorder()
+		handler(res, asTenant(req, "acme"))
+		return res
+	}
+
+	for _, invalid := range []string{`{"currency":"Atlantis"}`, `{"ratePolicy":"recordDate"}`, `{"rateWindow":200}`, `[]`} {
+		if res := put(invalid); res.Code != http.StatusBadRequest {
+			t.Errorf("settings %v: got status %d but expected %d", invalid, res.Code, http.StatusBadRequest)
+		}
+	}
+
+	res := put(`{"currency":"euro","ratePolicy":"average","rateWindow":12}`)
+	var saved tenantSettingsResponse
+	if err := json.NewDecoder(res.Body).Decode(&saved); err != nil || res.Code != http.StatusOK {
+		t.Fatalf("Could not save settings: %d %v", res.Code, err)
+	}
+	if saved.Tenant != "acme" || saved.Currency != "Euro Zone-Euro" || saved.EffectivePolicy != application.AverageRate ||
+		saved.EffectiveWindow != 12 {
+		t.Errorf("unexpected settings %+v", saved)
+	}
+	if settings := tenants.settings[auth.DefaultTenant]; settings != (application.TenantSettings{}) {
+		t.Errorf("settings saved for another tenant %+v", settings)
+	}
+
+	// conversions of the tenant default to its currency and policy
+	req := httptest.NewRequest(http.MethodGet, "/convertTransaction?transactionId=1", nil)
+	res = httptest.NewRecorder()
+	getConvertTransaction(tenants, MockExternalApi{}, MockCatalog{}, testRateSelection)(res, asTenant(req, "acme"))
+	var conversion map[string]string
+	json.NewDecoder(res.Body).Decode(&conversion)
+	if res.Code != http.StatusOK || conversion["currency"] != "Euro Zone-Euro" ||
+		conversion["ratePolicy"] != string(application.AverageRate) {
+		t.Errorf("tenant defaults not applied: %d %v", res.Code, conversion)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/convertTransaction?transactionId=1", nil)
+	res = httptest.NewRecorder()
+	getConvertTransaction(tenants, MockExternalApi{}, MockCatalog{}, testRateSelection)(res, asTenant(req, "globex"))
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("got status %d but expected %d without a default currency", res.Code, http.StatusBadRequest)
+	}
+}
+
+func TestTenantStorage(t *testing.T) {
+	tenants := persistance.OpenTenantStore(filepath.Join(t.TempDir(), "db.json"))
+	tenants.Configured = []string{"acme"}
+	tenants.MaxOpen = 2
+	handler := tenantStorage(tenants, getQueryTransactionHandler(tenants))
+
+	tests := []struct {
+		tenant string
+		status int
+	}{
+		{auth.DefaultTenant, http.StatusBadRequest},
+		{"acme", http.StatusBadRequest},
+		{"ghost", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.tenant, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/queryTransaction?transactionId=missing", nil)
+			res := httptest.NewRecorder()
+			handler(res, asTenant(req, test.tenant))
+			if res.Code != test.status {
+				t.Errorf("got status %d but expected %d", res.Code, test.status)
+			}
+		})
+	}
+
+	if err := tenants.Create("globex"); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/queryTransaction?transactionId=missing", nil)
+	res := httptest.NewRecorder()
+	handler(res, asTenant(req, "globex"))
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d but expected %d beyond max tenants", res.Code, http.StatusServiceUnavailable)
+	}
+	tenants.Close(context.Background())
+}
@@ -0,0 +1,347 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Exporter sends batches of spans, encoded as an OTLP-JSON
+// ExportTraceServiceRequest, to where they are kept.
+type Exporter interface {
+	Export(ctx context.Context, request []byte) error
+}
+
+const (
+	// spans exported at once
+	batchSize = 512
+	// longest time an ended span waits for its batch
+	flushInterval = 5 * time.Second
+	// spans waiting for export beyond which new ones are dropped
+	queueSize = 4096
+	// time given to an exporter to take a batch
+	exportTimeout = 10 * time.Second
+)
+
+// Tracer starts spans and exports them in batches, from a goroutine of its
+// own so that requests never wait for the exporter.
+type Tracer struct {
+	service  string
+	exporter Exporter
+
+	queue   chan *Span
+	flush   chan chan error
+	stop    chan chan error
+	dropped atomic.Int64
+}
+
+// NewTracer returns a tracer exporting the spans of service to exporter.
+// With no exporter spans are only propagated.
+func NewTracer(service string, exporter Exporter) *Tracer {
+	t := &Tracer{service: service, exporter: exporter}
+	if exporter != nil {
+		t.queue = make(chan *Span, queueSize)
+		t.flush = make(chan chan error)
+		t.stop = make(chan chan error)
+		go t.run()
+	}
+	return t
+}
+
+// Start starts a span, child of the span of ctx when there is one, and
+// returns a copy of ctx carrying it.
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent := FromContext(ctx); parent.IsValid() {
+		s.context.TraceID = parent.TraceID
+		s.context.Sampled = parent.Sampled
+		s.parent = parent.SpanID
+	} else {
+		newID(s.context.TraceID[:])
+		s.context.Sampled = true
+	}
+	newID(s.context.SpanID[:])
+	return WithSpanContext(ctx, s.context), s
+}
+
+// Dropped returns the number of spans dropped because the exporter could
+// not keep up.
+func (t *Tracer) Dropped() int64 {
+	return t.dropped.Load()
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	if t.queue == nil {
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// Flush exports the spans ended so far.
+func (t *Tracer) Flush(ctx context.Context) error {
+	if t.queue == nil {
+		return nil
+	}
+	reply := make(chan error, 1)
+	select {
+	case t.flush <- reply:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown exports the spans ended so far and closes the exporter when it
+// is an io.Closer. It is called once, when the server exits; spans ended
+// afterwards are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t.queue == nil {
+		return nil
+	}
+	reply := make(chan error, 1)
+	select {
+	case t.stop <- reply:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	var err error
+	select {
+	case err = <-reply:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if closer, ok := t.exporter.(io.Closer); ok {
+		err = errors.Join(err, closer.Close())
+	}
+	return err
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	export := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := t.export(batch)
+		batch = nil
+		return err
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case reply := <-t.flush:
+			for pending := len(t.queue); pending > 0; pending-- {
+				batch = append(batch, <-t.queue)
+			}
+			reply <- export()
+		case reply := <-t.stop:
+			for pending := len(t.queue); pending > 0; pending-- {
+				batch = append(batch, <-t.queue)
+			}
+			reply <- export()
+			return
+		}
+	}
+}
+
+func (t *Tracer) export(spans []*Span) error {
+	request, err := json.Marshal(encodeRequest(t.service, spans))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	if err = t.exporter.Export(ctx, request); err != nil {
+		slog.Warn("Trace export failed", "spans", len(spans), "error", err)
+	}
+	return err
+}
+
+// OTLP-JSON encoding of ExportTraceServiceRequest, ids are written in hex
+// and 64 bit integers as strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              Kind           `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+// status codes of OTLP, unset spans are taken as successful
+const statusError = 2
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func encodeValue(value any) otlpValue {
+	var v otlpValue
+	switch value := value.(type) {
+	case string:
+		v.StringValue = &value
+	case bool:
+		v.BoolValue = &value
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		s := fmt.Sprint(value)
+		v.IntValue = &s
+	case float32:
+		f := float64(value)
+		v.DoubleValue = &f
+	case float64:
+		v.DoubleValue = &value
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+	return v
+}
+
+func encodeRequest(service string, spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           s.context.TraceID.String(),
+			SpanID:            s.context.SpanID.String(),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent.IsValid() {
+			span.ParentSpanID = s.parent.String()
+		}
+		for _, a := range s.attributes {
+			span.Attributes = append(span.Attributes, otlpKeyValue{Key: a.key, Value: encodeValue(a.value)})
+		}
+		if s.failure != "" {
+			span.Status = otlpStatus{Code: statusError, Message: s.failure}
+		}
+		s.mu.Unlock()
+		encoded[i] = span
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: encodeValue(service)},
+		}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: service}, Spans: encoded}},
+	}}}
+}
+
+// FileExporter appends each batch to a file as a line of OTLP-JSON, the
+// format read by the file receiver of the OpenTelemetry collector.
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: file}, nil
+}
+
+func (e *FileExporter) Export(ctx context.Context, request []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.file.Write(append(request, '\n'))
+	return err
+}
+
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
+
+// CollectorExporter posts each batch to the OTLP/HTTP traces endpoint of a
+// collector, e.g. http://localhost:4318/v1/traces.
+type CollectorExporter struct {
+	Endpoint string
+}
+
+func (e CollectorExporter) Export(ctx context.Context, request []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Endpoint, bytes.NewReader(request))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Collector returned status %v", res.StatusCode)
+	}
+	return nil
+}
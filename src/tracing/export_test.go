@@ -0,0 +1,187 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureExporter keeps the requests it is given.
+type captureExporter struct {
+	mu       sync.Mutex
+	requests [][]byte
+	tracer   *Tracer
+}
+
+func (e *captureExporter) Export(ctx context.Context, request []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requests = append(e.requests, request)
+	return nil
+}
+
+// flush exports the spans ended by the default tracer and returns those of
+// every request exported so far.
+func (e *captureExporter) flush(t *testing.T) []otlpSpan {
+	t.Helper()
+	tracer := e.tracer
+	if tracer == nil {
+		tracer = Default()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := tracer.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var spans []otlpSpan
+	for _, body := range e.requests {
+		var request otlpRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Fatal(err)
+		}
+		for _, resource := range request.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				spans = append(spans, scope.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+// attributeValue returns the value of an attribute of span as written in json.
+func attributeValue(span otlpSpan, key string) string {
+	for _, a := range span.Attributes {
+		if a.Key != key {
+			continue
+		}
+		switch {
+		case a.Value.StringValue != nil:
+			return *a.Value.StringValue
+		case a.Value.IntValue != nil:
+			return *a.Value.IntValue
+		}
+		value, _ := json.Marshal(a.Value)
+		return string(value)
+	}
+	return ""
+}
+
+func TestExport(t *testing.T) {
+	exporter := &captureExporter{}
+	tracer := NewTracer("wex", exporter)
+	exporter.tracer = tracer
+
+	ctx, root := tracer.Start(context.Background(), "GET /rates", KindServer)
+	_, child := tracer.Start(ctx, "GET rates_of_exchange", KindClient)
+	child.Set("treasury.page", 2)
+	child.Set("retried", false)
+	child.Set("ratio", 0.5)
+	child.Fail(errors.New("Treasury api returned status 500"))
+	child.End()
+	child.End()
+	root.End()
+
+	unsampled, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, skipped := tracer.Start(WithSpanContext(context.Background(), unsampled), "GET /rates", KindServer)
+	skipped.End()
+
+	spans := exporter.flush(t)
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %+v", spans)
+	}
+	exported, parent := spans[0], spans[1]
+	if exported.TraceID != root.Context().TraceID.String() || exported.ParentSpanID != parent.SpanID || parent.ParentSpanID != "" {
+		t.Errorf("Spans not linked: %+v %+v", exported, parent)
+	}
+	if exported.Kind != KindClient || exported.Status.Code != statusError ||
+		exported.Status.Message != "Treasury api returned status 500" {
+		t.Errorf("Unexpected span %+v", exported)
+	}
+	for key, expected := range map[string]string{"treasury.page": "2", "retried": `{"boolValue":false}`, "ratio": `{"doubleValue":0.5}`} {
+		if value := attributeValue(exported, key); value != expected {
+			t.Errorf("Attribute %v exported as %v, expected %v", key, value, expected)
+		}
+	}
+	if exported.StartTimeUnixNano == "" || exported.EndTimeUnixNano < exported.StartTimeUnixNano {
+		t.Errorf("Unexpected times %v %v", exported.StartTimeUnixNano, exported.EndTimeUnixNano)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	exporter, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer("wex", exporter)
+	for i := 0; i < 2; i++ {
+		_, span := tracer.Start(context.Background(), "PersistanceDriver.QueryTransaction", KindInternal)
+		span.End()
+		if err := tracer.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the last spans are exported on shutdown, which closes the file
+	_, span := tracer.Start(context.Background(), "PersistanceDriver.ListTransactions", KindInternal)
+	span.End()
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := exporter.Export(context.Background(), []byte("{}")); err == nil {
+		t.Error("File still open after shutdown")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(file); scanner.Scan(); lines++ {
+		var request otlpRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			t.Fatalf("Line %v is not OTLP-JSON: %v", lines, err)
+		}
+	}
+	if lines != 3 {
+		t.Errorf("Expected a line per batch, got %v", lines)
+	}
+}
+
+func TestCollectorExporter(t *testing.T) {
+	var received []byte
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected request %v %v %v", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		received, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	exporter := CollectorExporter{Endpoint: server.URL + "/v1/traces"}
+	if err := exporter.Export(context.Background(), []byte(`{"resourceSpans":[]}`)); err != nil {
+		t.Errorf("Export failed: %v", err)
+	}
+	if string(received) != `{"resourceSpans":[]}` {
+		t.Errorf("Unexpected body %s", received)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := exporter.Export(context.Background(), []byte(`{"resourceSpans":[]}`)); err == nil {
+		t.Error("No error received for refused export")
+	}
+}
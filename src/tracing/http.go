@@ -0,0 +1,44 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"wex/src/logging"
+	"wex/src/response"
+)
+
+// Inject sets the traceparent header of an outbound request to the span of
+// ctx, so that the callee joins the trace.
+func Inject(ctx context.Context, header http.Header) {
+	if sc := FromContext(ctx); sc.IsValid() {
+		header.Set(TraceparentHeader, sc.Traceparent())
+	}
+}
+
+// Middleware serves every request of route in a server span, continuing the
+// trace of the traceparent header when the client sent a valid one. The
+// logger of the request tags its records with the trace id.
+func Middleware(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if parent, ok := ParseTraceparent(r.Header.Get(TraceparentHeader)); ok {
+			ctx = WithSpanContext(ctx, parent)
+		}
+		ctx, span := Start(ctx, r.Method+" "+route, KindServer)
+		defer span.End()
+		span.Set("http.request.method", r.Method)
+		span.Set("http.route", route)
+		span.Set("url.path", r.URL.Path)
+		ctx = logging.WithLogger(ctx, logging.FromContext(ctx).With("traceId", span.Context().TraceID.String()))
+
+		recorder := response.NewRecorder(w)
+		next(recorder, r.WithContext(ctx))
+
+		status := recorder.Status()
+		span.Set("http.response.status_code", status)
+		if status >= http.StatusInternalServerError {
+			span.Fail(errors.New(http.StatusText(status)))
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Package tracing records spans of the work done for each request and
+// exports them as OTLP-JSON. Traces are joined with those of the callers and
+// of the Treasury api through the W3C traceparent header.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceparentHeader carries the trace and the calling span, it is accepted
+// from clients and set on every upstream request.
+const TraceparentHeader = "traceparent"
+
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// SpanContext identifies a span across processes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// unsampled spans are propagated but not exported
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats sc as a version 00 traceparent header.
+func (sc SpanContext) Traceparent() string {
+	flags := 0
+	if sc.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%v-%v-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses a traceparent header. Headers of later versions
+// are read as version 00, as the specification requires.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	var sc SpanContext
+	const length = 55
+	if len(header) < length || header[2] != '-' || header[35] != '-' || header[52] != '-' {
+		return sc, false
+	}
+	version, ok := decodeHex(header[0:2])
+	if !ok || version[0] == 0xff || (version[0] == 0 && len(header) != length) ||
+		(len(header) > length && header[length] != '-') {
+		return sc, false
+	}
+	traceID, ok := decodeHex(header[3:35])
+	if !ok {
+		return sc, false
+	}
+	spanID, ok := decodeHex(header[36:52])
+	if !ok {
+		return sc, false
+	}
+	flags, ok := decodeHex(header[53:55])
+	if !ok {
+		return sc, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// decodeHex decodes lowercase hex only, as traceparent headers are written.
+func decodeHex(s string) ([]byte, bool) {
+	if strings.ToLower(s) != s {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
+
+type contextKey int
+
+const spanContextKey contextKey = 0
+
+// WithSpanContext returns a copy of ctx whose spans are children of sc.
+func WithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey, sc)
+}
+
+// FromContext returns the span the work of ctx is done for, invalid when
+// there is none.
+func FromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanContextKey).(SpanContext)
+	return sc
+}
+
+// Kind tells how a span relates to other processes, the values are those of
+// the OTLP SpanKind.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// Span is an operation of a trace, exported once ended.
+type Span struct {
+	tracer  *Tracer
+	name    string
+	kind    Kind
+	context SpanContext
+	parent  SpanID
+	start   time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []attribute
+	failure    string
+}
+
+func (s *Span) Context() SpanContext {
+	return s.context
+}
+
+// Set records an attribute of the span, of type string, bool, an integer or
+// a float. Other values are recorded as strings.
+func (s *Span) Set(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, attribute{key: key, value: value})
+}
+
+// Fail marks the span as failed by err.
+func (s *Span) Fail(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failure = err.Error()
+	if s.failure == "" {
+		s.failure = "failed"
+	}
+}
+
+// End ends the span and queues it for export, later calls are ignored.
+func (s *Span) End() {
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.context.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+var defaultTracer atomic.Pointer[Tracer]
+
+func init() {
+	defaultTracer.Store(NewTracer("wex", nil))
+}
+
+// SetDefault makes t the tracer of Start.
+func SetDefault(t *Tracer) {
+	defaultTracer.Store(t)
+}
+
+func Default() *Tracer {
+	return defaultTracer.Load()
+}
+
+// Start starts a span with the default tracer.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	return Default().Start(ctx, name, kind)
+}
+
+func newID(id []byte) {
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("could not generate a trace id: %v", err))
+	}
+}
@@ -0,0 +1,116 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"wex/src/logging"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		valid   bool
+		sampled bool
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"later version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"version 00 with extra", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"forbidden version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"uppercase", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01", false, false},
+		{"not hex", "00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01", false, false},
+		{"truncated", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false, false},
+		{"empty", "", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(test.header)
+			if ok != test.valid {
+				t.Fatalf("Expected valid %v, got %v", test.valid, ok)
+			}
+			if !ok {
+				return
+			}
+			if sc.Sampled != test.sampled {
+				t.Errorf("Expected sampled %v, got %v", test.sampled, sc.Sampled)
+			}
+			if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+				t.Errorf("Unexpected ids %v %v", sc.TraceID, sc.SpanID)
+			}
+			if strings.HasPrefix(test.header, "00-") && sc.Traceparent() != test.header {
+				t.Errorf("Header formatted as %v", sc.Traceparent())
+			}
+		})
+	}
+}
+
+func TestStart(t *testing.T) {
+	tracer := NewTracer("wex", nil)
+	ctx, root := tracer.Start(context.Background(), "root", KindServer)
+	if !root.Context().IsValid() || !root.Context().Sampled || root.parent.IsValid() {
+		t.Errorf("Unexpected root span %+v", root)
+	}
+	_, child := tracer.Start(ctx, "child", KindInternal)
+	if child.Context().TraceID != root.Context().TraceID || child.parent != root.Context().SpanID {
+		t.Errorf("Child span %+v not in the trace of %+v", child, root)
+	}
+
+	header := http.Header{}
+	Inject(ctx, header)
+	if header.Get(TraceparentHeader) != root.Context().Traceparent() {
+		t.Errorf("Unexpected traceparent %q", header.Get(TraceparentHeader))
+	}
+	Inject(context.Background(), header)
+	if header.Get(TraceparentHeader) != root.Context().Traceparent() {
+		t.Error("Traceparent overwritten without a span")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	exporter := &captureExporter{}
+	previous := Default()
+	SetDefault(NewTracer("wex", exporter))
+	defer SetDefault(previous)
+
+	var logs bytes.Buffer
+	var handled SpanContext
+	handler := Middleware("/convertTransaction", func(w http.ResponseWriter, r *http.Request) {
+		handled = FromContext(r.Context())
+		logging.FromContext(r.Context()).Info("Converting")
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/convertTransaction?id=1", nil)
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req = req.WithContext(logging.WithLogger(req.Context(), slog.New(slog.NewTextHandler(&logs, nil))))
+	handler(httptest.NewRecorder(), req)
+
+	if handled.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || handled.SpanID.String() == "00f067aa0ba902b7" {
+		t.Errorf("Trace of the client not continued: %+v", handled)
+	}
+	if !strings.Contains(logs.String(), "traceId=4bf92f3577b34da6a3ce929d0e0e4736") {
+		t.Errorf("Logs not tagged with the trace id: %v", logs.String())
+	}
+
+	spans := exporter.flush(t)
+	if len(spans) != 1 {
+		t.Fatalf("Expected a single span, got %v", spans)
+	}
+	span := spans[0]
+	if span.Name != "GET /convertTransaction" || span.Kind != KindServer || span.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("Unexpected span %+v", span)
+	}
+	if span.Status.Code != statusError || attributeValue(span, "http.response.status_code") != "502" ||
+		attributeValue(span, "http.route") != "/convertTransaction" {
+		t.Errorf("Response not recorded %+v", span)
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"wex/src/application"
+	"wex/src/auth"
+	"wex/src/external"
+	"wex/src/logging"
+	"wex/src/persistance"
+)
+
+// webPages are the templates of the UI, each rendered within layout.html.
+var webPages = []string{"list", "view", "form", "login"}
+
+// webTemplates parses the UI templates once, or on every render when they
+// are served from disk for UI development.
+type webTemplates struct {
+	assets fs.FS
+	reload bool
+
+	mu    sync.Mutex
+	pages map[string]*template.Template
+}
+
+func newWebTemplates(assets fs.FS, reload bool) (*webTemplates, error) {
+	t := &webTemplates{assets: assets, reload: reload, pages: make(map[string]*template.Template)}
+	for _, name := range webPages {
+		page, err := t.parse(name)
+		if err != nil {
+			return nil, err
+		}
+		t.pages[name] = page
+	}
+	return t, nil
+}
+
+func (t *webTemplates) parse(name string) (*template.Template, error) {
+	return template.ParseFS(t.assets, "templates/layout.html", "templates/"+name+".html")
+}
+
+func (t *webTemplates) render(w http.ResponseWriter, status int, name string, data any) {
+	t.mu.Lock()
+	page := t.pages[name]
+	t.mu.Unlock()
+	if t.reload {
+		var err error
+		if page, err = t.parse(name); err != nil {
+			slog.Error("Could not parse template", "page", name, "error", err)
+			http.Error(w, "Could not render page", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// rendered to a buffer first, so that errors do not leave half a page
+	var buffer bytes.Buffer
+	if err := page.ExecuteTemplate(&buffer, "layout", data); err != nil {
+		slog.Error("Could not render page", "page", name, "error", err)
+		http.Error(w, "Could not render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(buffer.Bytes())
+}
+
+type webUI struct {
+	templates *webTemplates
+	csrf      csrfProtection
+	auth      auth.Authenticator
+}
+
+// webFlashes are the messages shown after a redirect, chosen by key so that
+// links cannot inject text into the page.
+var webFlashes = map[string]string{
+	"created": "Transaction registered.",
+	"updated": "Transaction updated.",
+	"deleted": "Transaction deleted.",
+	"logout":  "Logged out.",
+}
+
+type webPage struct {
+	Title     string
+	Flash     string
+	CSRFToken string
+	// name of the API key logged in
+	User string
+	// validation messages by form field, "" for the whole page
+	Errors map[string]string
+}
+
+type webFieldError struct {
+	Errors map[string]string
+	Field  string
+}
+
+// Field selects the message shown next to a form field.
+func (p webPage) Field(name string) webFieldError {
+	return webFieldError{Errors: p.Errors, Field: name}
+}
+
+func (ui webUI) page(w http.ResponseWriter, r *http.Request, title string) webPage {
+	page := webPage{
+		Title:     title,
+		Flash:     webFlashes[r.URL.Query().Get("flash")],
+		CSRFToken: ui.csrf.token(w, r),
+		Errors:    make(map[string]string),
+	}
+	if principal, ok := auth.PrincipalFrom(r.Context()); ok && !ui.auth.Disabled {
+		page.User = principal.Name
+	}
+	return page
+}
+
+// checkPost rejects requests other than POST and forms without a valid
+// CSRF token.
+func (ui webUI) checkPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		badRequest(w, r, "Unsupported method")
+		return false
+	}
+	if err := r.ParseForm(); err != nil {
+		badRequest(w, r, "Could not parse form")
+		return false
+	}
+	if !ui.csrf.valid(r) {
+		logging.FromContext(r.Context()).Warn("Invalid CSRF token", "path", r.URL.Path)
+		http.Error(w, "Invalid or missing CSRF token, reload the page and try again", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func redirectTo(w http.ResponseWriter, r *http.Request, path string, query url.Values) {
+	http.Redirect(w, r, path+"?"+query.Encode(), http.StatusSeeOther)
+}
+
+// formField returns the field of a form a validation error belongs to.
+func formField(err error) string {
+	switch {
+	case errors.Is(err, application.ErrDescription):
+		return "description"
+	case errors.Is(err, application.ErrDate):
+		return "date"
+	case errors.Is(err, application.ErrAmount):
+		return "amount"
+	case errors.Is(err, application.ErrRatePolicy):
+		return "policy"
+	default:
+		return "currency"
+	}
+}
+
+func webCurrencies(r *http.Request, catalog external.CurrencyCatalogInterface, page *webPage) []application.Currency {
+	currencies, err := catalog.Currencies(r.Context())
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Could not load currency catalog", "error", err)
+		page.Errors["currency"] = "The currency list is not available right now."
+	}
+	return currencies
+}
+
+type webListPage struct {
+	webPage
+	Filter       map[string]string
+	Transactions []application.IdentifiedTransaction
+}
+
+func getWebList(ui webUI, tenants persistance.Tenants) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			badRequest(w, r, "Unsupported method")
+			return
+		}
+
+		query := r.URL.Query()
+		data := webListPage{
+			webPage: ui.page(w, r, "Transactions"),
+			Filter: map[string]string{
+				"from":        query.Get("from"),
+				"to":          query.Get("to"),
+				"description": query.Get("description"),
+			},
+		}
+		status := http.StatusOK
+		filter, err := application.NewTransactionFilter(query.Get("from"), query.Get("to"), query.Get("description"))
+		if err != nil {
+			data.Errors["filter"] = err.Error()
+			status = http.StatusBadRequest
+		} else {
+			data.Transactions, err = tenantDriver(tenants, r).ListTransactions(r.Context(), filter)
+			if err != nil {
+				storageUnavailable(w, r, err)
+				return
+			}
+		}
+		ui.templates.render(w, status, "list", data)
+	}
+}
+
+type webViewPage struct {
+	webPage
+	Transaction application.IdentifiedTransaction
+	Currencies  []application.Currency
+	Policies    []application.RatePolicy
+	Form        map[string]string
+	Conversion  *currencyConversion
+	History     []application.Conversion
+}
+
+func getWebView(ui webUI, tenants persistance.Tenants,
+	middleware external.FiscalDataInterface,
+	catalog external.CurrencyCatalogInterface,
+	defaults application.RateSelection) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// viewing is read only, conversions are recorded by the convert form,
+		// posted with its CSRF token
+		switch r.Method {
+		case "GET":
+		case "POST":
+			if !ui.checkPost(w, r) {
+				return
+			}
+		default:
+			badRequest(w, r, "Unsupported method")
+			return
+		}
+
+		driver := tenantDriver(tenants, r)
+		settings, tenantDefaults := tenantSettings(tenants, r, defaults)
+		transaction, err := driver.QueryTransaction(r.Context(), r.URL.Query().Get("id"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		data := webViewPage{
+			webPage:     ui.page(w, r, transaction.Description),
+			Transaction: transaction,
+			Policies: []application.RatePolicy{
+				application.LatestRate, application.NearestRate, application.AverageRate},
+			Form: map[string]string{"currency": r.FormValue("currency"), "policy": r.FormValue("policy")},
+		}
+		if data.Form["policy"] == "" {
+			data.Form["policy"] = string(tenantDefaults.Policy)
+		}
+		if data.Form["currency"] == "" {
+			data.Form["currency"] = settings.Currency
+		}
+		data.Currencies = webCurrencies(r, catalog, &data.webPage)
+
+		status := http.StatusOK
+		principal, _ := auth.PrincipalFrom(r.Context())
+		if currency := r.PostFormValue("currency"); currency != "" && !principal.Has(auth.ScopeConvert) {
+			data.Errors["currency"] = fmt.Sprintf("API key %v is not granted the %v scope", principal.Name, auth.ScopeConvert)
+			status = http.StatusForbidden
+		} else if currency != "" {
+			if err := webConvert(r.Context(), &data, driver, middleware, catalog, tenantDefaults); err != nil {
+				data.Errors[formField(err)] = err.Error()
+				status = http.StatusBadRequest
+			}
+		}
+
+		data.History, _ = driver.QueryConversions(r.Context(), transaction.Uid)
+		ui.templates.render(w, status, "view", data)
+	}
+}
+
+// webConvert converts the transaction of the page to the currency chosen,
+// answering with a conversion already recorded when there is one.
+func webConvert(ctx context.Context, data *webViewPage, driver persistance.PersistanceDriver,
+	middleware external.FiscalDataInterface,
+	catalog external.CurrencyCatalogInterface,
+	defaults application.RateSelection) error {
+
+	selection, err := newRateSelection(data.Form["policy"], "", "", defaults)
+	if err != nil {
+		return err
+	}
+	if selection.Policy == application.RecordDateRate {
+		return application.ErrRatePolicy
+	}
+	conversions, err := convertToCurrencies(ctx, driver, data.Transaction, []string{data.Form["currency"]},
+		selection, true, middleware, catalog)
+	if err != nil {
+		return err
+	}
+	if conversions[0].Error != "" {
+		return errors.New(conversions[0].Error)
+	}
+	data.Conversion = &conversions[0]
+	return nil
+}
+
+type webFormPage struct {
+	webPage
+	Action     string
+	Form       map[string]string
+	Currencies []application.Currency
+}
+
+var webFormFields = []string{"description", "date", "amount", "currency"}
+
+func postedForm(r *http.Request) map[string]string {
+	form := make(map[string]string)
+	for _, field := range webFormFields {
+		form[field] = r.PostFormValue(field)
+	}
+	return form
+}
+
+// transactionForm validates every field of a posted transaction form, so
+// that all messages are shown at once, and converts foreign amounts to USD.
+func transactionForm(r *http.Request, errs map[string]string,
+	middleware external.FiscalDataInterface,
+	catalog external.CurrencyCatalogInterface,
+	defaults application.RateSelection) (application.Transaction, bool) {
+
+	if _, err := application.NewDescription(r.PostFormValue("description")); err != nil {
+		errs["description"] = err.Error()
+	}
+	if _, err := application.NewTime(r.PostFormValue("date")); err != nil {
+		errs["date"] = err.Error()
+	}
+	if _, err := application.NewMoney(r.PostFormValue("amount")); err != nil {
+		errs["amount"] = err.Error()
+	}
+	if len(errs) > 0 {
+		return application.Transaction{}, false
+	}
+
+	transaction, err := application.NewTransaction(
+		r.PostFormValue("description"), r.PostFormValue("date"), r.PostFormValue("amount"))
+	if err != nil {
+		errs[formField(err)] = err.Error()
+		return transaction, false
+	}
+	if r.PostFormValue("currency") != "" {
+		transaction, err = foreignTransaction(r, transaction, middleware, catalog, defaults)
+		if err != nil {
+			errs[formField(err)] = err.Error()
+			return transaction, false
+		}
+	}
+	return transaction, true
+}
+
+func getWebNew(ui webUI, tenants persistance.Tenants,
+	middleware external.FiscalDataInterface,
+	catalog external.CurrencyCatalogInterface,
+	defaults application.RateSelection) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := webFormPage{Action: "/transactions/new", Form: map[string]string{}}
+
+		switch r.Method {
+		case "GET":
+			data.webPage = ui.page(w, r, "New transaction")
+			data.Currencies = webCurrencies(r, catalog, &data.webPage)
+			ui.templates.render(w, http.StatusOK, "form", data)
+		case "POST":
+			if !ui.checkPost(w, r) {
+				return
+			}
+			data.webPage = ui.page(w, r, "New transaction")
+			data.Form = postedForm(r)
+			_, selection := tenantSettings(tenants, r, defaults)
+			transaction, ok := transactionForm(r, data.Errors, middleware, catalog, selection)
+			if !ok {
+				data.Currencies = webCurrencies(r, catalog, &data.webPage)
+				ui.templates.render(w, http.StatusBadRequest, "form", data)
+				return
+			}
+			if principal, ok := auth.PrincipalFrom(r.Context()); ok {
+				transaction.CreatedBy = principal.KeyId
+			}
+			uid, err := tenantDriver(tenants, r).RegisterTransaction(r.Context(), transaction)
+			if errors.Is(err, persistance.ErrNotPersisted) {
+				// stored and written later, shown as any other transaction
+				logging.FromContext(r.Context()).Warn("Transaction registered but not yet durable",
+					"transactionId", uid, "error", err)
+			} else if err != nil {
+				storageUnavailable(w, r, err)
+				return
+			}
+			logging.FromContext(r.Context()).Info("Transaction registered", "transactionId", uid)
+			redirectTo(w, r, "/transactions/view", url.Values{"id": {uid}, "flash": {"created"}})
+		default:
+			badRequest(w, r, "Unsupported method")
+		}
+	}
+}
+
+func getWebEdit(ui webUI, tenants persistance.Tenants,
+	middleware external.FiscalDataInterface,
+	catalog external.CurrencyCatalogInterface,
+	defaults application.RateSelection) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		driver := tenantDriver(tenants, r)
+		uid := r.URL.Query().Get("id")
+		existing, err := driver.QueryTransaction(r.Context(), uid)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		data := webFormPage{Action: "/transactions/edit?" + url.Values{"id": {uid}}.Encode()}
+
+		switch r.Method {
+		case "GET":
+			data.webPage = ui.page(w, r, "Edit transaction")
+			data.Form = map[string]string{
+				"description": existing.Description,
+				"date":        existing.Date.ToString(),
+				"amount":      existing.Amount.ToString(),
+			}
+			if foreign := existing.Foreign; foreign != nil {
+				data.Form["amount"] = foreign.Amount.ToString()
+				data.Form["currency"] = foreign.Currency
+			}
+			data.Currencies = webCurrencies(r, catalog, &data.webPage)
+			ui.templates.render(w, http.StatusOK, "form", data)
+		case "POST":
+			if !ui.checkPost(w, r) {
+				return
+			}
+			data.webPage = ui.page(w, r, "Edit transaction")
+			data.Form = postedForm(r)
+
+			var transaction application.Transaction
+			if sameForeignAmount(existing, data.Form) {
+				// the rate the amount was converted with is kept
+				transaction = existing.Transaction
+				if _, err := application.NewDescription(data.Form["description"]); err != nil {
+					data.Errors["description"] = err.Error()
+				}
+				transaction.Description = data.Form["description"]
+			} else {
+				_, selection := tenantSettings(tenants, r, defaults)
+				transaction, _ = transactionForm(r, data.Errors, middleware, catalog, selection)
+			}
+			if len(data.Errors) > 0 {
+				data.Currencies = webCurrencies(r, catalog, &data.webPage)
+				ui.templates.render(w, http.StatusBadRequest, "form", data)
+				return
+			}
+			transaction.CreatedBy = existing.CreatedBy
+
+			if err := driver.UpdateTransaction(r.Context(), application.IdentifiedTransaction{Transaction: transaction, Uid: uid}); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			logging.FromContext(r.Context()).Info("Transaction updated", "transactionId", uid)
+			redirectTo(w, r, "/transactions/view", url.Values{"id": {uid}, "flash": {"updated"}})
+		default:
+			badRequest(w, r, "Unsupported method")
+		}
+	}
+}
+
+// sameForeignAmount reports whether the form leaves the foreign amount, its
+// currency and the purchase date of a transaction unchanged.
+func sameForeignAmount(existing application.IdentifiedTransaction, form map[string]string) bool {
+	foreign := existing.Foreign
+	if foreign == nil {
+		return false
+	}
+	return form["currency"] == foreign.Currency && form["amount"] == foreign.Amount.ToString() &&
+		form["date"] == existing.Date.ToString()
+}
+
+func getWebDelete(ui webUI, tenants persistance.Tenants) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ui.checkPost(w, r) {
+			return
+		}
+		uid := r.PostFormValue("id")
+		if err := tenantDriver(tenants, r).DeleteTransaction(r.Context(), uid); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		logging.FromContext(r.Context()).Info("Transaction deleted", "transactionId", uid)
+		redirectTo(w, r, "/transactions", url.Values{"flash": {"deleted"}})
+	}
+}
+
+type webLoginPage struct {
+	webPage
+	Next string
+}
+
+// localPath keeps redirects after login within the site.
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/transactions"
+	}
+	return next
+}
+
+// getWebLogin checks the API key typed in and starts a session, whose token
+// the browser sends along with the UI requests in a cookie.
+func getWebLogin(ui webUI) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			data := webLoginPage{webPage: ui.page(w, r, "Log in"), Next: localPath(r.URL.Query().Get("next"))}
+			ui.templates.render(w, http.StatusOK, "login", data)
+		case "POST":
+			if !ui.checkPost(w, r) {
+				return
+			}
+			data := webLoginPage{webPage: ui.page(w, r, "Log in"), Next: localPath(r.PostFormValue("next"))}
+			principal, err := ui.auth.Check(r.PostFormValue("key"))
+			if err != nil {
+				data.Errors["key"] = err.Error()
+				ui.templates.render(w, http.StatusUnauthorized, "login", data)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     auth.SessionCookie,
+				Value:    ui.auth.Sessions.Start(r.PostFormValue("key")),
+				Path:     "/",
+				MaxAge:   int(auth.SessionTTL.Seconds()),
+				Secure:   r.TLS != nil,
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			logging.FromContext(r.Context()).Info("Logged in", "keyId", principal.KeyId)
+			http.Redirect(w, r, data.Next, http.StatusSeeOther)
+		default:
+			badRequest(w, r, "Unsupported method")
+		}
+	}
+}
+
+func getWebLogout(ui webUI) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ui.checkPost(w, r) {
+			return
+		}
+		if cookie, err := r.Cookie(auth.SessionCookie); err == nil && ui.auth.Sessions != nil {
+			ui.auth.Sessions.End(cookie.Value)
+		}
+		http.SetCookie(w, &http.Cookie{Name: auth.SessionCookie, Value: "", Path: "/", MaxAge: -1})
+		redirectTo(w, r, "/login", url.Values{"flash": {"logout"}})
+	}
+}
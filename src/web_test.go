@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"wex/src/application"
+	"wex/src/auth"
+	"wex/src/persistance"
+)
+
+// memoryDriver stores transactions and conversions in memory.
+type memoryDriver struct {
+	transactions map[string]application.IdentifiedTransaction
+	conversions  map[string][]application.Conversion
+	next         int
+}
+
+func newMemoryDriver() *memoryDriver {
+	return &memoryDriver{
+		transactions: make(map[string]application.IdentifiedTransaction),
+		conversions:  make(map[string][]application.Conversion),
+	}
+}
+
+func (m *memoryDriver) RegisterTransaction(ctx context.Context, tran application.Transaction) (string, error) {
+	m.next++
+	uid := string(rune('A' + m.next - 1))
+	m.transactions[uid] = application.IdentifiedTransaction{Transaction: tran, Uid: uid}
+	return uid, nil
+}
+
+func (m *memoryDriver) QueryTransaction(ctx context.Context, uid string) (application.IdentifiedTransaction, error) {
+	tran, ok := m.transactions[uid]
+	if !ok {
+		return tran, persistance.QueryNotFoundError
+	}
+	return tran, nil
+}
+
+func (m *memoryDriver) ListTransactions(ctx context.Context, filter application.TransactionFilter) ([]application.IdentifiedTransaction, error) {
+	var list []application.IdentifiedTransaction
+	for _, tran := range m.transactions {
+		if filter.Matches(tran) {
+			list = append(list, tran)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Uid < list[j].Uid })
+	return list, nil
+}
+
+func (m *memoryDriver) UpdateTransaction(ctx context.Context, tran application.IdentifiedTransaction) error {
+	if _, ok := m.transactions[tran.Uid]; !ok {
+		return persistance.QueryNotFoundError
+	}
+	m.transactions[tran.Uid] = tran
+	return nil
+}
+
+func (m *memoryDriver) DeleteTransaction(ctx context.Context, uid string) error {
+	if _, ok := m.transactions[uid]; !ok {
+		return persistance.QueryNotFoundError
+	}
+	delete(m.transactions, uid)
+	return nil
+}
+
+func (m *memoryDriver) RecordConversion(ctx context.Context, conversion application.Conversion) error {
+	m.conversions[conversion.TransactionUid] = append(m.conversions[conversion.TransactionUid], conversion)
+	return nil
+}
+
+func (m *memoryDriver) QueryConversions(ctx context.Context, uid string) ([]application.Conversion, error) {
+	if _, ok := m.transactions[uid]; !ok {
+		return nil, persistance.QueryNotFoundError
+	}
+	return m.conversions[uid], nil
+}
+
+func newTestWebUI(t *testing.T) webUI {
+	templates, err := newWebTemplates(uiAssets(""), false)
+	if err != nil {
+		t.Fatalf("Could not parse templates: %v", err)
+	}
+	return webUI{templates: templates, csrf: newCSRFProtection()}
+}
+
+// postForm posts a form with the CSRF cookie and token of a browser session.
+func postForm(ui webUI, handler http.HandlerFunc, target string, form url.Values) *httptest.ResponseRecorder {
+	session := "test-session"
+	form.Set(csrfField, ui.csrf.sign(session))
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: session})
+	req = req.WithContext(auth.WithPrincipal(req.Context(), testPrincipal))
+	res := httptest.NewRecorder()
+	handler(res, req)
+	return res
+}
+
+var testPrincipal = auth.Principal{KeyId: "test", Name: "test",
+	Scopes: []auth.Scope{auth.ScopeRead, auth.ScopeWrite, auth.ScopeConvert}}
+
+func getPage(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req = req.WithContext(auth.WithPrincipal(req.Context(), testPrincipal))
+	res := httptest.NewRecorder()
+	handler(res, req)
+	return res
+}
+
+func TestWebNewTransaction(t *testing.T) {
+	ui := newTestWebUI(t)
+	driver := newMemoryDriver()
+	handler := getWebNew(ui, oneTenant(driver), MockExternalApi{}, MockCatalog{}, testRateSelection)
+
+	res := getPage(handler, "/transactions/new")
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `name="csrfToken"`) ||
+		!strings.Contains(res.Body.String(), "Mexico-Peso (MXN)") {
+		t.Fatalf("unexpected form page %d %v", res.Code, res.Body.String())
+	}
+	if len(res.Result().Cookies()) != 1 {
+		t.Errorf("expected CSRF cookie to be set, got %v", res.Result().Cookies())
+	}
+
+	tests := []struct {
+		name     string
+		form     url.Values
+		status   int
+		contains []string
+	}{
+		{"invalid fields", url.Values{
+			"description": {strings.Repeat("x", 60)}, "date": {"2023-07-02"}, "amount": {"-1.00"}},
+			http.StatusBadRequest,
+			[]string{application.ErrDescription.Error(), application.ErrAmount.Error()}},
+		{"invalid date", url.Values{"description": {"lunch"}, "date": {"yesterday"}, "amount": {"1.00"}},
+			http.StatusBadRequest, []string{application.ErrDate.Error(), `value="lunch"`}},
+		{"no rate available", url.Values{
+			"description": {"lunch"}, "date": {"2023-07-02"}, "amount": {"1.00"}, "currency": {"Canada-Dollar"}},
+			http.StatusBadRequest, []string{"no conversion rate is available"}},
+		{"usd", url.Values{"description": {"lunch"}, "date": {"2023-07-02"}, "amount": {"12.50"}},
+			http.StatusSeeOther, nil},
+		{"foreign", url.Values{
+			"description": {"tacos"}, "date": {"2023-07-02"}, "amount": {"341.54"}, "currency": {"Mexico-Peso"}},
+			http.StatusSeeOther, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := postForm(ui, handler, "/transactions/new", test.form)
+			if res.Code != test.status {
+				t.Fatalf("got status %d but expected %d: %v", res.Code, test.status, res.Body.String())
+			}
+			for _, s := range test.contains {
+				if !strings.Contains(res.Body.String(), s) {
+					t.Errorf("page does not show %q", s)
+				}
+			}
+		})
+	}
+
+	if len(driver.transactions) != 2 {
+		t.Fatalf("expected 2 transactions registered, got %v", driver.transactions)
+	}
+	if tran := driver.transactions["A"]; tran.CreatedBy != testPrincipal.KeyId {
+		t.Errorf("transaction not recorded with its key, got %q", tran.CreatedBy)
+	}
+	if tran := driver.transactions["B"]; tran.Amount.ToString() != "20.00" || tran.Foreign == nil {
+		t.Errorf("unexpected foreign transaction %+v", tran)
+	}
+}
+
+func TestWebCSRF(t *testing.T) {
+	ui := newTestWebUI(t)
+	driver := newMemoryDriver()
+	driver.RegisterTransaction(context.Background(), application.GetSampleTransaction())
+	handler := getWebDelete(ui, oneTenant(driver))
+
+	form := url.Values{"id": {"A"}}
+	tests := []struct {
+		name   string
+		token  string
+		cookie string
+		origin string
+	}{
+		{"missing token", "", "session", ""},
+		{"missing cookie", ui.csrf.sign("session"), "", ""},
+		{"token of another session", ui.csrf.sign("other"), "session", ""},
+		{"cross origin", ui.csrf.sign("session"), "session", "http://evil.example"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := url.Values{"id": form["id"], csrfField: {test.token}}
+			req := httptest.NewRequest(http.MethodPost, "/transactions/delete", strings.NewReader(body.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if test.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: csrfCookie, Value: test.cookie})
+			}
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			res := httptest.NewRecorder()
+			handler(res, req)
+			if res.Code != http.StatusForbidden {
+				t.Errorf("got status %d but expected %d", res.Code, http.StatusForbidden)
+			}
+		})
+	}
+	if len(driver.transactions) != 1 {
+		t.Error("transaction deleted without valid CSRF token")
+	}
+
+	if res := postForm(ui, handler, "/transactions/delete", form); res.Code != http.StatusSeeOther {
+		t.Errorf("got status %d but expected %d", res.Code, http.StatusSeeOther)
+	}
+	if len(driver.transactions) != 0 {
+		t.Error("transaction not deleted")
+	}
+}
+
+func TestWebList(t *testing.T) {
+	ui := newTestWebUI(t)
+	driver := newMemoryDriver()
+	for _, description := range []string{"Lunch", "Dinner"} {
+		tran, _ := application.NewTransaction(description, "2023-07-02", "10.00")
+		driver.RegisterTransaction(context.Background(), tran)
+	}
+	handler := getWebList(ui, oneTenant(driver))
+
+	res := getPage(handler, "/transactions?description=lunch&flash=deleted")
+	body := res.Body.String()
+	if res.Code != http.StatusOK || !strings.Contains(body, "Lunch") || strings.Contains(body, "Dinner") {
+		t.Errorf("unexpected list page %d %v", res.Code, body)
+	}
+	if !strings.Contains(body, webFlashes["deleted"]) {
+		t.Error("flash message not shown")
+	}
+
+	res = getPage(handler, "/transactions?from=someday")
+	if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), application.ErrDate.Error()) {
+		t.Errorf("unexpected list page %d %v", res.Code, res.Body.String())
+	}
+}
+
+func TestWebViewConversion(t *testing.T) {
+	ui := newTestWebUI(t)
+	driver := newMemoryDriver()
+	tran, _ := application.NewTransaction("Lunch", "2023-07-02", "10.00")
+	uid, _ := driver.RegisterTransaction(context.Background(), tran)
+	handler := getWebView(ui, oneTenant(driver), MockExternalApi{}, MockCatalog{}, testRateSelection)
+
+	convert := url.Values{"currency": {"Mexico-Peso"}}
+
+	// viewing, even with a currency chosen, converts nothing
+	res := getPage(handler, "/transactions/view?id="+uid+"&currency=Mexico-Peso")
+	if res.Code != http.StatusOK || strings.Contains(res.Body.String(), "170.77 Mexico-Peso") || len(driver.conversions[uid]) != 0 {
+		t.Fatalf("conversion made on view %d %v", res.Code, driver.conversions)
+	}
+
+	res = postForm(ui, handler, "/transactions/view?id="+uid, convert)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "170.77 Mexico-Peso") {
+		t.Fatalf("conversion not shown %d %v", res.Code, res.Body.String())
+	}
+	if !strings.Contains(res.Body.String(), "Conversion history") || len(driver.conversions[uid]) != 1 {
+		t.Errorf("conversion not recorded %v", driver.conversions)
+	}
+
+	// converting again answers with the conversion recorded
+	postForm(ui, handler, "/transactions/view?id="+uid, convert)
+	if len(driver.conversions[uid]) != 1 {
+		t.Errorf("conversion recorded twice %v", driver.conversions)
+	}
+
+	res = postForm(ui, handler, "/transactions/view?id="+uid, url.Values{"currency": {"atlantis"}})
+	if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), application.ErrUnknownCurrency.Error()) {
+		t.Errorf("currency error not shown %d %v", res.Code, res.Body.String())
+	}
+
+	session := "test-session"
+	convert.Set(csrfField, ui.csrf.sign(session))
+	req := httptest.NewRequest(http.MethodPost, "/transactions/view?id="+uid, strings.NewReader(convert.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: session})
+	reader := auth.Principal{Name: "reader", Scopes: []auth.Scope{auth.ScopeRead}}
+	res = httptest.NewRecorder()
+	handler(res, req.WithContext(auth.WithPrincipal(req.Context(), reader)))
+	if res.Code != http.StatusForbidden || !strings.Contains(res.Body.String(), "convert scope") {
+		t.Errorf("conversion without convert scope, got %d", res.Code)
+	}
+
+	// conversions are not recorded from posts without the CSRF token
+	req = httptest.NewRequest(http.MethodPost, "/transactions/view?id="+uid, strings.NewReader("currency=Canada-Dollar"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res = httptest.NewRecorder()
+	handler(res, req.WithContext(auth.WithPrincipal(req.Context(), testPrincipal)))
+	if res.Code != http.StatusForbidden || len(driver.conversions[uid]) != 1 {
+		t.Errorf("conversion without CSRF token, got %d", res.Code)
+	}
+
+	if res := getPage(handler, "/transactions/view?id=missing"); res.Code != http.StatusNotFound {
+		t.Errorf("got status %d but expected %d", res.Code, http.StatusNotFound)
+	}
+}
+
+func TestWebEdit(t *testing.T) {
+	ui := newTestWebUI(t)
+	driver := newMemoryDriver()
+	tran, _ := application.NewTransaction("tacos", "2023-07-02", "341.54")
+	rate, _ := application.NewExchangeRate("Mexico-Peso", "17.000", "2023-06-30")
+	tran, _ = application.NewForeignTransaction(tran, rate, application.LatestRate, "test")
+	uid, _ := driver.RegisterTransaction(context.Background(), tran)
+	handler := getWebEdit(ui, oneTenant(driver), MockExternalApi{}, MockCatalog{}, testRateSelection)
+
+	res := getPage(handler, "/transactions/edit?id="+uid)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `value="341.54"`) {
+		t.Fatalf("form not prefilled %d %v", res.Code, res.Body.String())
+	}
+
+	form := url.Values{"description": {"more tacos"}, "date": {"2023-07-02"},
+		"amount": {"341.54"}, "currency": {"Mexico-Peso"}}
+	if res := postForm(ui, handler, "/transactions/edit?id="+uid, form); res.Code != http.StatusSeeOther {
+		t.Fatalf("got status %d but expected %d", res.Code, http.StatusSeeOther)
+	}
+	edited := driver.transactions[uid]
+	if edited.Description != "more tacos" || edited.Foreign.ExchangeRate.ToString() != "17.000" {
+		t.Errorf("description edit should keep the rate, got %+v", edited.Foreign)
+	}
+
+	form.Set("amount", "683.08")
+	postForm(ui, handler, "/transactions/edit?id="+uid, form)
+	if edited := driver.transactions[uid]; edited.Amount.ToString() != "40.00" ||
+		edited.Foreign.ExchangeRate.ToString() != "17.077" {
+		t.Errorf("amount edit should be converted again, got %+v", edited)
+	}
+
+	form.Set("amount", "abc")
+	if res := postForm(ui, handler, "/transactions/edit?id="+uid, form); res.Code != http.StatusBadRequest ||
+		!strings.Contains(res.Body.String(), application.ErrAmount.Error()) {
+		t.Errorf("validation error not shown %d", res.Code)
+	}
+}
+
+func TestWebLogin(t *testing.T) {
+	key, secret, _ := auth.NewAPIKey("browser", []auth.Scope{auth.ScopeRead})
+	ui := newTestWebUI(t)
+	ui.auth = auth.Authenticator{Keys: testKeyStore{key.Id: key}, Sessions: auth.NewSessions()}
+	handler := getWebLogin(ui)
+
+	res := getPage(handler, "/login?next=%2Ftransactions%3Fdescription%3Dlunch")
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `value="/transactions?description=lunch"`) {
+		t.Fatalf("unexpected login page %d %v", res.Code, res.Body.String())
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		next     string
+		status   int
+		location string
+	}{
+		{"invalid key", "wex_x_y", "/transactions", http.StatusUnauthorized, ""},
+		{"valid key", secret, "/transactions?description=lunch", http.StatusSeeOther, "/transactions?description=lunch"},
+		{"external redirect", secret, "//evil.example", http.StatusSeeOther, "/transactions"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := postForm(ui, handler, "/login", url.Values{"key": {test.key}, "next": {test.next}})
+			if res.Code != test.status {
+				t.Fatalf("got status %d but expected %d", res.Code, test.status)
+			}
+			if test.location != "" && res.Header().Get("Location") != test.location {
+				t.Errorf("got redirect to %v but expected %v", res.Header().Get("Location"), test.location)
+			}
+			if test.status == http.StatusSeeOther {
+				cookies := res.Result().Cookies()
+				if len(cookies) == 0 || cookies[len(cookies)-1].Name != auth.SessionCookie || !cookies[len(cookies)-1].HttpOnly {
+					t.Fatalf("session cookie not set, got %v", cookies)
+				}
+				session := cookies[len(cookies)-1]
+				if session.Value == secret || session.Secure {
+					t.Errorf("unexpected session cookie %v", session)
+				}
+				req := httptest.NewRequest(http.MethodGet, "/transactions", nil)
+				req.AddCookie(session)
+				if p, err := ui.auth.AuthenticateSession(req); err != nil || p.KeyId != key.Id {
+					t.Errorf("session does not authenticate: %+v (%v)", p, err)
+				}
+			}
+		})
+	}
+}
+
+type testKeyStore map[string]auth.APIKey
+
+func (m testKeyStore) QueryKey(id string) (auth.APIKey, error) {
+	key, ok := m[id]
+	if !ok {
+		return key, persistance.KeyNotFoundError
+	}
+	return key, nil
+}
@@ -0,0 +1,17 @@
+// Package ui holds the web UI, embedded into the server binary: html
+// templates rendered by the server and static assets.
+package ui
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed templates static
+var assets embed.FS
+
+// FS returns the embedded UI. Templates are found under templates/, every
+// page being rendered within layout.html, and assets under static/.
+func FS() fs.FS {
+	return assets
+}